@@ -0,0 +1,79 @@
+package main
+
+import (
+	"errors"
+
+	"github.com/nareix/joy4/av"
+)
+
+var errNoAudioStream = errors.New("stream has no audio")
+
+// audioOnlyDemuxer passes through only the audio streams of a demuxer, so
+// listeners don't have to download the video
+type audioOnlyDemuxer struct {
+	demuxer av.Demuxer
+	streams []av.CodecData
+	idx     []int // new index of every source stream, -1 for dropped streams
+}
+
+func newAudioOnlyDemuxer(demuxer av.Demuxer) *audioOnlyDemuxer {
+	return &audioOnlyDemuxer{demuxer: demuxer}
+}
+
+func (a *audioOnlyDemuxer) Streams() ([]av.CodecData, error) {
+	if a.idx == nil {
+		streams, err := a.demuxer.Streams()
+		if err != nil {
+			return nil, err
+		}
+		a.setSource(streams)
+	}
+
+	if len(a.streams) == 0 {
+		return nil, errNoAudioStream
+	}
+	return a.streams, nil
+}
+
+func (a *audioOnlyDemuxer) ReadPacket() (av.Packet, error) {
+	if _, err := a.Streams(); err != nil {
+		return av.Packet{}, err
+	}
+
+	for {
+		pkt, err := a.demuxer.ReadPacket()
+		if err != nil {
+			return pkt, err
+		}
+
+		if int(pkt.Idx) < len(a.idx) && a.idx[pkt.Idx] >= 0 {
+			pkt.Idx = int8(a.idx[pkt.Idx])
+			return pkt, nil
+		}
+	}
+}
+
+// setSource picks the audio streams of the source, again when the source of
+// the demuxer changes.  It returns the audio streams.
+func (a *audioOnlyDemuxer) setSource(streams []av.CodecData) []av.CodecData {
+	a.idx = make([]int, len(streams))
+	a.streams = nil
+	for i, stream := range streams {
+		a.idx[i] = -1
+		if stream.Type().IsAudio() {
+			a.idx[i] = len(a.streams)
+			a.streams = append(a.streams, stream)
+		}
+	}
+	return a.streams
+}
+
+// hasAudioStream checks if any of the streams is audio
+func hasAudioStream(streams []av.CodecData) bool {
+	for _, stream := range streams {
+		if stream.Type().IsAudio() {
+			return true
+		}
+	}
+	return false
+}
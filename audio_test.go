@@ -0,0 +1,86 @@
+package main
+
+import (
+	"io"
+	"testing"
+	"time"
+
+	"github.com/nareix/joy4/av"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/zorchenhimer/MovieNight/common"
+)
+
+func TestAudioOnlyDemuxer(t *testing.T) {
+	queue := newTestQueue(t, av.H264, av.AAC)
+	queue.SetMaxGopCount(100)
+	cursor := queue.Oldest()
+
+	for i := 0; i < 4; i++ {
+		require.NoError(t, queue.WritePacket(av.Packet{Idx: 0, IsKeyFrame: true, Time: time.Duration(i) * 40 * time.Millisecond, Data: []byte{0x65}}))
+		require.NoError(t, queue.WritePacket(av.Packet{Idx: 1, Time: time.Duration(i) * 40 * time.Millisecond, Data: []byte{0x21}}))
+	}
+	queue.Close()
+
+	demuxer := newAudioOnlyDemuxer(cursor)
+	streams, err := demuxer.Streams()
+	require.NoError(t, err)
+	require.Len(t, streams, 1)
+	assert.Equal(t, av.AAC, streams[0].Type())
+
+	count := 0
+	for {
+		pkt, err := demuxer.ReadPacket()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+		assert.Equal(t, int8(0), pkt.Idx, "audio packets should be moved to the first stream")
+		assert.Equal(t, []byte{0x21}, pkt.Data)
+		count++
+	}
+	assert.Equal(t, 4, count)
+}
+
+func TestAudioOnlyDemuxer_NoAudio(t *testing.T) {
+	demuxer := newAudioOnlyDemuxer(newTestQueue(t, av.H264).Latest())
+
+	_, err := demuxer.Streams()
+	assert.ErrorIs(t, err, errNoAudioStream)
+	_, err = demuxer.ReadPacket()
+	assert.ErrorIs(t, err, errNoAudioStream)
+}
+
+func TestHLSChannel_AudioOnly(t *testing.T) {
+	common.SetupLogging(common.LLError, "/dev/null")
+
+	queue := newTestQueue(t, av.H264, av.AAC)
+	queue.SetMaxGopCount(100)
+
+	config := DefaultHLSConfig()
+	config.AudioOnly = true
+	config.EnableLowLatency = false
+	config.SegmentDuration = time.Second
+	config.BaseURI = "/hls/live/audio"
+	hlsChan, err := NewHLSChannelWithConfig(queue, config)
+	require.NoError(t, err)
+	defer hlsChan.Stop()
+
+	require.NoError(t, hlsChan.Start())
+	time.Sleep(50 * time.Millisecond)
+
+	for i := 0; i <= 25; i++ {
+		pktTime := time.Duration(i) * 100 * time.Millisecond
+		require.NoError(t, queue.WritePacket(av.Packet{Idx: 0, IsKeyFrame: i%10 == 0, Time: pktTime, Data: []byte{0x00, 0x00, 0x00, 0x02, 0x09, 0xf0}}))
+		require.NoError(t, queue.WritePacket(av.Packet{Idx: 1, Time: pktTime, Data: []byte{0x21, 0x00}}))
+	}
+	queue.Close()
+	waitForDone(t, hlsChan.Done())
+
+	assert.Eventually(t, func() bool {
+		params, ok := hlsChan.variantParams()
+		return ok && params.Codecs == "mp4a.40.2" && params.Resolution == ""
+	}, 2*time.Second, 10*time.Millisecond, "audio only segments should be generated")
+
+	assert.Contains(t, hlsChan.GetPlaylist(), "/hls/live/audio/segment_")
+}
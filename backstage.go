@@ -0,0 +1,119 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/zorchenhimer/MovieNight/common"
+)
+
+// viewerID returns the random ID that ties a browser's HTTP requests to its
+// chat connection, creating it if the session doesn't have one yet
+func viewerID(w http.ResponseWriter, r *http.Request) string {
+	if sstore == nil {
+		return ""
+	}
+
+	session, err := sstore.Get(r, "moviesession")
+	if err != nil {
+		// Don't return as server error here, just make a new session.
+		common.LogErrorf("Unable to get session for client %s: %v\n", r.RemoteAddr, err)
+	}
+
+	if id, ok := session.Values["viewer"].(string); ok && id != "" {
+		return id
+	}
+
+	id := randStringRunes(24)
+	session.Values["viewer"] = id
+	err = session.Save(r, w)
+	if err != nil {
+		common.LogErrorf("Unable to save session for client %s: %v\n", r.RemoteAddr, err)
+	}
+	return id
+}
+
+// requestViewerID returns the viewer ID of the request's session, or an empty
+// string if there is none.  Signed stream URLs are passed around, so the
+// session they were issued to doesn't say who is making the request.
+func requestViewerID(r *http.Request) string {
+	if sstore == nil {
+		return ""
+	}
+
+	session, err := sstore.Get(r, "moviesession")
+	if err != nil {
+		return ""
+	}
+	id, _ := session.Values["viewer"].(string)
+	return id
+}
+
+// requesterLevel returns the highest chat role of the person making the
+// request.  People that aren't in chat and holders of signed stream URLs are
+// regular users.
+func requesterLevel(r *http.Request) common.CommandLevel {
+	level := common.CmdlUser
+	id := requestViewerID(r)
+	if id == "" {
+		return level
+	}
+
+	for _, room := range allChatRooms() {
+		room.clientsMtx.Lock()
+		for _, client := range room.clients {
+			if client.conn != nil && client.conn.viewerID == id && client.CmdLevel > level {
+				level = client.CmdLevel
+			}
+		}
+		room.clientsMtx.Unlock()
+	}
+	return level
+}
+
+// isBackstage checks if the channel is only shown to mods and admins
+func (ch *Channel) isBackstage() bool {
+	l.RLock()
+	defer l.RUnlock()
+	return ch.backstage
+}
+
+// visibleTo checks if the requester can watch the channel.  Backstage
+// channels can only be watched by mods and admins.
+func (ch *Channel) visibleTo(r *http.Request) bool {
+	return !ch.isBackstage() || requesterLevel(r) >= common.CmdlMod
+}
+
+// goLive shows a backstage stream to everybody
+func goLive(streamName string) error {
+	l.Lock()
+	defer l.Unlock()
+
+	found := findRenditions(streamName)
+	if len(found) == 0 {
+		return fmt.Errorf("stream %q is not live", streamName)
+	}
+
+	promoted := false
+	for _, r := range found {
+		if r.ch.backstage {
+			r.ch.backstage = false
+			r.ch.startVOD(r.streamPath)
+			promoted = true
+		}
+	}
+	if !promoted {
+		return fmt.Errorf("stream %s is already public", streamName)
+	}
+
+	common.LogInfof("Stream %s is now public\n", streamName)
+	return nil
+}
+
+// announceBackstage lets the mods of the channel know a stream is waiting for
+// them to check it before it is shown to everybody.  The caller is expected to
+// hold the channel lock.
+func announceBackstage(streamPath string) {
+	common.LogInfof("Stream %s is backstage\n", streamPath)
+	groupModNotice(groupName(streamPath), fmt.Sprintf("%s is live backstage, only mods can see it.  Use /golive %s to show it to everybody", streamPath, streamPath))
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/gorilla/sessions"
+	"github.com/nareix/joy4/av"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/zorchenhimer/MovieNight/common"
+)
+
+func TestBackstage(t *testing.T) {
+	common.SetupLogging(common.LLError, "/dev/null")
+	settings = &Settings{TitleLength: 50, BackstagePreview: true, SessionKey: "backstage-test-session-key"}
+	sstore = sessions.NewCookieStore([]byte("backstage-test-session-key"))
+
+	streams := testStreams(t, av.AAC)
+
+	l.Lock()
+	ch := newChannel("backstage-test", streams)
+	channels["backstage-test"] = ch
+	l.Unlock()
+	defer func() {
+		l.Lock()
+		delete(channels, "backstage-test")
+		ch.close()
+		l.Unlock()
+		waitForDone(t, channelDone(ch)...)
+	}()
+	assert.True(t, ch.isBackstage())
+
+	// A browser gets its viewer ID when it loads the page
+	w := httptest.NewRecorder()
+	id := viewerID(w, httptest.NewRequest(http.MethodGet, "/", nil))
+	require.NotEmpty(t, id)
+
+	req := httptest.NewRequest(http.MethodGet, "/live/backstage-test", nil)
+	for _, cookie := range w.Result().Cookies() {
+		req.AddCookie(cookie)
+	}
+	assert.Equal(t, id, requestViewerID(req))
+	assert.False(t, ch.visibleTo(req), "people that aren't in chat can't watch")
+
+	// The same browser is in chat as a regular user, then as a mod
+	client := &Client{name: "viewer", conn: &chatConnection{viewerID: id}, CmdLevel: common.CmdlUser}
+	room, err := chatRoomFor("backstage-test")
+	require.NoError(t, err)
+	room.clientsMtx.Lock()
+	room.clients = append(room.clients, client)
+	room.clientsMtx.Unlock()
+	defer func() {
+		room.clientsMtx.Lock()
+		room.clients = nil
+		room.clientsMtx.Unlock()
+	}()
+
+	assert.False(t, ch.visibleTo(req))
+	assert.Empty(t, listChannels(requesterLevel(req)), "backstage channels aren't listed")
+
+	room.clientsMtx.Lock()
+	client.CmdLevel = common.CmdlMod
+	room.clientsMtx.Unlock()
+	assert.True(t, ch.visibleTo(req), "mods can watch backstage streams")
+	assert.Len(t, listChannels(requesterLevel(req)), 1)
+
+	link, err := url.Parse(streamURL("backstage-test", id, time.Now()))
+	require.NoError(t, err)
+	tokenReq := httptest.NewRequest(http.MethodGet, "/live/backstage-test?"+link.RawQuery, nil)
+	assert.False(t, ch.visibleTo(tokenReq), "the signed URL of a mod doesn't make its holder a mod")
+
+	require.NoError(t, goLive("backstage-test"))
+	assert.False(t, ch.isBackstage())
+	assert.True(t, ch.visibleTo(httptest.NewRequest(http.MethodGet, "/live/backstage-test", nil)))
+	assert.Error(t, goLive("backstage-test"), "the stream is already public")
+	assert.Error(t, goLive("not-a-stream"))
+}
@@ -0,0 +1,294 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/zorchenhimer/MovieNight/common"
+)
+
+// defaultStream is the stream shown on the main page.  Its chat is the
+// global chat room.
+const defaultStream = "live"
+
+var (
+	// chat rooms of the channels other than the default stream
+	chatRooms    = map[string]*ChatRoom{}
+	chatRoomsMtx sync.Mutex
+)
+
+// isValidStreamName checks that a stream name can be used in URLs
+func isValidStreamName(name string) bool {
+	return name != "" && len(name) <= 64 && !strings.ContainsAny(name, "/?#%\\ ")
+}
+
+var errUnknownChannel = errors.New("channel is not live")
+
+// chatRoomFor returns the chat room of a channel group, creating it the first
+// time it's needed.  The default stream uses the global chat room.  The
+// caller makes sure the channel is live or configured, use openChatRoom for
+// names that come from viewers.
+func chatRoomFor(name string) (*ChatRoom, error) {
+	if name == "" || name == defaultStream {
+		return chat, nil
+	}
+	if !isValidStreamName(name) {
+		return nil, fmt.Errorf("invalid channel name %q", name)
+	}
+
+	chatRoomsMtx.Lock()
+	defer chatRoomsMtx.Unlock()
+
+	room, ok := chatRooms[name]
+	if !ok {
+		room = newRoom()
+		chatRooms[name] = room
+		common.LogInfof("Created chat room for channel %s\n", name)
+	}
+	return room, nil
+}
+
+// openChatRoom returns the chat room viewers of a channel group join.  Rooms
+// are only made for channels that are live or configured, so viewers can't
+// make up as many as they like.
+func openChatRoom(name string) (*ChatRoom, error) {
+	if name != "" && name != defaultStream && existingChatRoom(name) == nil &&
+		!groupLive(name) && !settings.IsConfiguredChannel(name) {
+		return nil, fmt.Errorf("%w: %s", errUnknownChannel, name)
+	}
+	return chatRoomFor(name)
+}
+
+// groupLive checks if any channel of a group is live
+func groupLive(name string) bool {
+	l.RLock()
+	defer l.RUnlock()
+	return len(findRenditions(name)) > 0
+}
+
+// dropEmptyChatRoom removes the chat room of a channel group once nobody is in
+// it and the channel isn't live anymore
+func dropEmptyChatRoom(name string) {
+	if name == defaultStream || groupLive(name) {
+		return
+	}
+
+	chatRoomsMtx.Lock()
+	defer chatRoomsMtx.Unlock()
+
+	room, ok := chatRooms[name]
+	if !ok || !room.closeIfEmpty() {
+		return
+	}
+	delete(chatRooms, name)
+	common.LogInfof("Removed chat room of channel %s\n", name)
+}
+
+// endChannel removes a channel that has ended and closes it.  The chat room of
+// its group goes away too if nobody is in it.  The caller is expected to hold
+// the channel lock.
+func endChannel(streamPath string, ch *Channel) {
+	group := groupName(streamPath)
+	stats.endStream()
+	delete(channels, streamPath)
+	ch.close()
+	go dropEmptyChatRoom(group)
+}
+
+// streamModNotice sends a notice to the mods in the chat room of the channel
+// group a stream belongs to.  The caller must not hold the channel lock.
+func streamModNotice(streamPath, msg string) {
+	l.RLock()
+	group := groupName(streamPath)
+	l.RUnlock()
+
+	groupModNotice(group, msg)
+}
+
+// groupModNotice sends a notice to the mods in the chat room of a channel
+// group.  Nobody is told if nobody joined it.
+func groupModNotice(group, msg string) {
+	if room := existingChatRoom(group); room != nil {
+		room.AddModNotice(msg)
+	}
+}
+
+// allChatRooms returns the main chat room and the rooms of every channel
+func allChatRooms() []*ChatRoom {
+	chatRoomsMtx.Lock()
+	defer chatRoomsMtx.Unlock()
+
+	rooms := make([]*ChatRoom, 0, len(chatRooms)+1)
+	if chat != nil {
+		rooms = append(rooms, chat)
+	}
+	for _, room := range chatRooms {
+		rooms = append(rooms, room)
+	}
+	return rooms
+}
+
+// existingChatRoom returns the chat room of a channel group if anybody has
+// joined it
+func existingChatRoom(name string) *ChatRoom {
+	if name == defaultStream {
+		return chat
+	}
+
+	chatRoomsMtx.Lock()
+	defer chatRoomsMtx.Unlock()
+	return chatRooms[name]
+}
+
+// roomStreamName returns the name of the channel group a chat room belongs to
+func roomStreamName(room *ChatRoom) string {
+	if room == chat {
+		return defaultStream
+	}
+
+	chatRoomsMtx.Lock()
+	defer chatRoomsMtx.Unlock()
+	for name, r := range chatRooms {
+		if r == room {
+			return name
+		}
+	}
+	return defaultStream
+}
+
+// addViewer and removeViewer count the FLV viewers of the channel
+func (ch *Channel) addViewer() {
+	atomic.AddInt32(&ch.flvViewers, 1)
+}
+
+func (ch *Channel) removeViewer() {
+	atomic.AddInt32(&ch.flvViewers, -1)
+}
+
+// viewerCount returns the number of people watching the channel
+func (ch *Channel) viewerCount() int {
+	return int(atomic.LoadInt32(&ch.flvViewers)) + ch.hlsChan.GetViewerCount() + ch.audioHLS.GetViewerCount()
+}
+
+// ChannelInfo is a live channel as listed in the directory
+type ChannelInfo struct {
+	Name      string
+	Title     string
+	Link      string
+	Viewers   int
+	Chatters  int
+	Backstage bool   // only mods and admins can watch it
+	Page      string // page with the player and the channel's chat
+	Live      string // the URL players are pointed at
+	HLS       string // HLS playlist
+}
+
+// groupName returns the channel group a stream belongs to.  The caller is
+// expected to hold the channel lock.
+func groupName(streamPath string) string {
+	name, _ := splitRenditionName(streamPath)
+	if _, ok := channels[name]; !ok && len(findRenditions(name)) < 2 {
+		// Not actually a rendition, just a name with an underscore
+		return streamPath
+	}
+	return name
+}
+
+// listChannels returns the live channels with their renditions combined,
+// the default stream first and the rest by name.  Backstage channels are only
+// listed for mods and admins.
+func listChannels(level common.CommandLevel) []ChannelInfo {
+	l.RLock()
+	groups := map[string]*ChannelInfo{}
+	for streamPath, ch := range channels {
+		name := groupName(streamPath)
+		info, ok := groups[name]
+		if !ok {
+			info = &ChannelInfo{Name: name}
+			groups[name] = info
+		}
+		info.Viewers += ch.viewerCount()
+		info.Backstage = info.Backstage || ch.backstage
+	}
+	l.RUnlock()
+
+	list := make([]ChannelInfo, 0, len(groups))
+	for name, info := range groups {
+		if info.Backstage && level < common.CmdlMod {
+			continue
+		}
+
+		info.Page = "/c/" + name
+		info.Live = "/live"
+		info.HLS = "/live?format=hls"
+		if name != defaultStream {
+			info.Live = "/live/" + name
+			info.HLS = "/live/" + name + "?format=hls"
+		}
+
+		if room := existingChatRoom(name); room != nil {
+			info.Title, info.Link = room.Playing()
+			room.clientsMtx.Lock()
+			info.Chatters = room.UserCount()
+			room.clientsMtx.Unlock()
+		}
+		list = append(list, *info)
+	}
+
+	sort.Slice(list, func(i, j int) bool {
+		if (list[i].Name == defaultStream) != (list[j].Name == defaultStream) {
+			return list[i].Name == defaultStream
+		}
+		return list[i].Name < list[j].Name
+	})
+	return list
+}
+
+// handleChannelPage serves the player and chat of a single channel at
+// /c/<name>
+func handleChannelPage(w http.ResponseWriter, r *http.Request) {
+	name := strings.Trim(strings.TrimPrefix(r.URL.Path, "/c/"), "/")
+	if !isValidStreamName(name) {
+		http.NotFound(w, r)
+		return
+	}
+	renderIndex(w, r, name, nil)
+}
+
+// handleDirectory lists the live channels
+func handleDirectory(w http.ResponseWriter, r *http.Request) {
+	type Data struct {
+		Title    string
+		Channels []ChannelInfo
+	}
+
+	data := Data{
+		Title:    settings.PageTitle + " - channels",
+		Channels: listChannels(requesterLevel(r)),
+	}
+
+	if settings.NoCache {
+		w.Header().Set("Cache-Control", "no-cache, must-revalidate")
+	}
+
+	err := common.ExecuteServerTemplate(w, "channels", data)
+	if err != nil {
+		common.LogErrorf("Error executing file, %v", err)
+	}
+}
+
+// handleChannelsAPI serves the channel directory as JSON
+func handleChannelsAPI(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-cache")
+	err := json.NewEncoder(w).Encode(listChannels(requesterLevel(r)))
+	if err != nil {
+		common.LogErrorf("Could not write channel list: %v\n", err)
+	}
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/nareix/joy4/av"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/zorchenhimer/MovieNight/common"
+)
+
+func TestIsValidStreamName(t *testing.T) {
+	for _, name := range []string{"live", "movies", "live_720p", "anime-night"} {
+		assert.True(t, isValidStreamName(name), name)
+	}
+	for _, name := range []string{"", "a/b", "a?b", "a b", "../live"} {
+		assert.False(t, isValidStreamName(name), name)
+	}
+}
+
+func TestChatRoomFor(t *testing.T) {
+	room, err := chatRoomFor("")
+	require.NoError(t, err)
+	assert.Equal(t, chat, room, "the default stream uses the main chat room")
+
+	movies, err := chatRoomFor("movies-room-test")
+	require.NoError(t, err)
+	require.NotNil(t, movies)
+	again, err := chatRoomFor("movies-room-test")
+	require.NoError(t, err)
+	assert.Same(t, movies, again, "a channel keeps its chat room")
+	assert.Same(t, movies, existingChatRoom("movies-room-test"))
+	assert.Nil(t, existingChatRoom("nobody-joined"))
+
+	_, err = chatRoomFor("bad/name")
+	assert.Error(t, err)
+}
+
+func TestOpenChatRoom(t *testing.T) {
+	common.SetupLogging(common.LLError, "/dev/null")
+	settings = &Settings{
+		TitleLength:   50,
+		LibraryStream: "live",
+		StreamKeys:    []StreamKeyInfo{{Name: "friday", Key: "key", Channel: "friday-room-test"}},
+	}
+
+	_, err := openChatRoom("made-up-room-test")
+	assert.ErrorIs(t, err, errUnknownChannel)
+	assert.Nil(t, existingChatRoom("made-up-room-test"), "no room is made for channels that aren't live")
+
+	room, err := openChatRoom("friday-room-test")
+	require.NoError(t, err, "channels with a stream key get a room")
+	require.NotNil(t, room)
+
+	// The room goes away once it's empty and the channel isn't live
+	dropEmptyChatRoom("friday-room-test")
+	assert.Nil(t, existingChatRoom("friday-room-test"))
+	_, err = room.Join(&chatConnection{}, common.JoinData{Name: "late"})
+	assert.ErrorIs(t, err, errRoomClosed)
+
+	// Rooms of live channels are kept
+	l.Lock()
+	channels["live-room-test"] = &Channel{}
+	l.Unlock()
+	defer func() {
+		l.Lock()
+		delete(channels, "live-room-test")
+		l.Unlock()
+		chatRoomsMtx.Lock()
+		delete(chatRooms, "live-room-test")
+		chatRoomsMtx.Unlock()
+	}()
+	room, err = openChatRoom("live-room-test")
+	require.NoError(t, err)
+	dropEmptyChatRoom("live-room-test")
+	assert.Same(t, room, existingChatRoom("live-room-test"))
+}
+
+func TestListChannels(t *testing.T) {
+	common.SetupLogging(common.LLError, "/dev/null")
+	settings = &Settings{TitleLength: 50}
+
+	streams := testStreams(t, av.AAC)
+
+	l.Lock()
+	for _, name := range []string{"movies", "anime_720p", "anime_480p"} {
+		channels[name] = newChannel(name, streams)
+	}
+	l.Unlock()
+	defer func() {
+		l.Lock()
+		var done []<-chan struct{}
+		for _, name := range []string{"movies", "anime_720p", "anime_480p"} {
+			channels[name].close()
+			done = append(done, channelDone(channels[name])...)
+			delete(channels, name)
+		}
+		l.Unlock()
+		waitForDone(t, done...)
+	}()
+
+	room, err := chatRoomFor("movies")
+	require.NoError(t, err)
+	room.playing = "Some Movie"
+
+	list := listChannels(common.CmdlUser)
+	require.Len(t, list, 2, "renditions should be listed as one channel")
+	assert.Equal(t, "anime", list[0].Name)
+	assert.Equal(t, "movies", list[1].Name)
+	assert.Equal(t, "Some Movie", list[1].Title)
+	assert.Equal(t, "/c/movies", list[1].Page)
+	assert.Equal(t, "/live/movies?format=hls", list[1].HLS)
+
+	l.RLock()
+	assert.Equal(t, "/live/movies", channels["movies"].hlsChan.config.BaseURI)
+	l.RUnlock()
+}
+
+func TestHandleLiveSegments_Channel(t *testing.T) {
+	common.SetupLogging(common.LLError, "/dev/null")
+
+	w := httptest.NewRecorder()
+	handleLiveSegments(w, httptest.NewRequest(http.MethodGet, "/live/no-such-channel/segment_0123456789abcdef0123456789abcdef.ts", nil))
+	assert.Equal(t, http.StatusNotFound, w.Code)
+
+	w = httptest.NewRecorder()
+	handleLiveSegments(w, httptest.NewRequest(http.MethodGet, "/live/a/b/segment_1.ts", nil))
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/Eyevinn/hls-m3u8/m3u8"
+)
+
+const (
+	maxIntermission = 2 * time.Hour
+
+	// chapterClass is the CLASS of the EXT-X-DATERANGE tags of chapters
+	chapterClass = "com.movienight.chapter"
+)
+
+// Chapter is a marker mods put on a stream with /chapter and /intermission
+type Chapter struct {
+	ID       string
+	Title    string
+	Start    time.Time
+	Duration time.Duration // planned length of an intermission, 0 for chapters
+}
+
+func newChapter(title string, duration time.Duration) Chapter {
+	now := time.Now()
+	return Chapter{
+		ID:       fmt.Sprintf("chapter-%d", now.UnixMilli()),
+		Title:    title,
+		Start:    now,
+		Duration: duration,
+	}
+}
+
+// dateRange is the EXT-X-DATERANGE tag of the chapter.  A chapter lasts until
+// the next one starts.
+func (c Chapter) dateRange() *m3u8.DateRange {
+	dr := &m3u8.DateRange{
+		ID:        c.ID,
+		Class:     chapterClass,
+		StartDate: c.Start.UTC().Truncate(time.Millisecond),
+		EndOnNext: true,
+		XAttrs:    []m3u8.Attribute{{Key: "X-TITLE", Val: `"` + quotedStringReplacer.Replace(c.Title) + `"`}},
+	}
+	if c.Duration > 0 {
+		planned := c.Duration.Seconds()
+		dr.PlannedDuration = &planned
+	}
+	return dr
+}
+
+// Quoted strings in playlists can't have quotes or line breaks
+var quotedStringReplacer = strings.NewReplacer(`"`, "'", "\r", " ", "\n", " ")
+
+// trimChapters drops the chapters that were over before first
+func trimChapters(chapters []Chapter, first time.Time) []Chapter {
+	drop := 0
+	for drop < len(chapters)-1 && !chapters[drop+1].Start.After(first) {
+		drop++
+	}
+	if drop == 0 {
+		return chapters
+	}
+	return append([]Chapter(nil), chapters[drop:]...)
+}
+
+// chapterMark is a chapter of a recording or a VOD, relative to its start
+type chapterMark struct {
+	At    time.Duration
+	Title string
+}
+
+// writeChaptersVTT writes the marks as a WebVTT chapters file.  Every chapter
+// lasts until the next one starts, the last one until end.
+func writeChaptersVTT(w io.Writer, marks []chapterMark, end time.Duration) error {
+	_, err := io.WriteString(w, "WEBVTT\n")
+	if err != nil {
+		return err
+	}
+
+	cue := 0
+	for i, mark := range marks {
+		stop := end
+		if i+1 < len(marks) {
+			stop = marks[i+1].At
+		}
+		if stop <= mark.At {
+			// Replaced by a chapter that started at the same time
+			continue
+		}
+
+		cue++
+		_, err = fmt.Fprintf(w, "\n%d\n%s --> %s\n%s\n", cue, vttTimestamp(mark.At), vttTimestamp(stop), vttTextReplacer.Replace(mark.Title))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// saveChaptersVTT writes the chapters file of a recording or a VOD
+func saveChaptersVTT(file string, marks []chapterMark, end time.Duration) error {
+	f, err := os.Create(file)
+	if err != nil {
+		return fmt.Errorf("could not create chapters file: %w", err)
+	}
+
+	err = writeChaptersVTT(f, marks, end)
+	if err != nil {
+		f.Close()
+		return fmt.Errorf("could not write chapters file: %w", err)
+	}
+	return f.Close()
+}
+
+var vttTextReplacer = strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;", "\r", " ", "\n", " ")
+
+// vttTimestamp formats d as hh:mm:ss.ttt
+func vttTimestamp(d time.Duration) string {
+	if d < 0 {
+		d = 0
+	}
+	ms := d.Milliseconds()
+	return fmt.Sprintf("%02d:%02d:%02d.%03d", ms/3600000, ms/60000%60, ms/1000%60, ms%1000)
+}
+
+// addChapter marks a chapter on everything the channel puts out.  The caller
+// is expected to hold the channel lock.
+func (ch *Channel) addChapter(chapter Chapter) {
+	ch.hlsChan.addChapter(chapter)
+	ch.audioHLS.addChapter(chapter)
+	ch.recorder.addChapter(chapter)
+	ch.vod.addChapter(chapter)
+}
+
+// markChapter adds a chapter to every rendition of a group.  It returns false
+// if the group isn't live.
+func markChapter(group string, chapter Chapter) bool {
+	l.Lock()
+	defer l.Unlock()
+
+	found := findRenditions(group)
+	for _, r := range found {
+		r.ch.addChapter(chapter)
+	}
+	return len(found) > 0
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/nareix/joy4/av"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/zorchenhimer/MovieNight/common"
+)
+
+func TestWriteChaptersVTT(t *testing.T) {
+	marks := []chapterMark{
+		{At: 0, Title: "Pre-show"},
+		{At: 0, Title: "Movie <1>"},
+		{At: 90*time.Minute + 1500*time.Millisecond, Title: "Intermission"},
+	}
+
+	buf := &bytes.Buffer{}
+	require.NoError(t, writeChaptersVTT(buf, marks, 2*time.Hour))
+	assert.Equal(t, "WEBVTT\n"+
+		"\n1\n00:00:00.000 --> 01:30:01.500\nMovie &lt;1&gt;\n"+
+		"\n2\n01:30:01.500 --> 02:00:00.000\nIntermission\n",
+		buf.String(), "a chapter replaced at the same time has no cue")
+}
+
+func TestHLSChannel_Chapters(t *testing.T) {
+	common.SetupLogging(common.LLError, "/dev/null")
+
+	config := DefaultHLSConfig()
+	config.EnableLowLatency = false
+	config.MaxSegments = 3
+	hlsChan, err := NewHLSChannelWithConfig(newTestQueue(t, av.AAC), config)
+	require.NoError(t, err)
+	defer hlsChan.Close()
+
+	start := time.Date(2024, 1, 1, 20, 0, 0, 0, time.UTC)
+	addSegment := func(i int) {
+		hlsChan.addGeneratedSegment(HLSSegment{
+			URI:             fmt.Sprintf("/live/segment_%d.ts", i),
+			Duration:        4,
+			Data:            []byte{byte(i)},
+			Sequence:        uint64(i),
+			ProgramDateTime: start.Add(time.Duration(i) * 4 * time.Second),
+		})
+	}
+
+	addSegment(0)
+	hlsChan.addChapter(Chapter{ID: "chapter-1", Title: `The "First" Movie`, Start: start.Add(2 * time.Second)})
+	addSegment(1)
+	hlsChan.addChapter(Chapter{ID: "chapter-2", Title: "Intermission", Start: start.Add(6 * time.Second), Duration: 10 * time.Minute})
+
+	playlist := hlsChan.GetPlaylist()
+	assert.Contains(t, playlist, `#EXT-X-DATERANGE:ID="chapter-1",CLASS="com.movienight.chapter",START-DATE="2024-01-01T20:00:02Z",END-ON-NEXT=YES,X-TITLE="The 'First' Movie"`)
+	assert.Contains(t, playlist, `#EXT-X-DATERANGE:ID="chapter-2",CLASS="com.movienight.chapter",START-DATE="2024-01-01T20:00:06Z",PLANNED-DURATION=600.000,END-ON-NEXT=YES,X-TITLE="Intermission"`)
+
+	// The first chapter is over once the window starts after the intermission
+	for i := 2; i < 5; i++ {
+		addSegment(i)
+	}
+	playlist = hlsChan.GetPlaylist()
+	assert.NotContains(t, playlist, "chapter-1")
+	assert.Contains(t, playlist, "chapter-2", "the newest chapter stays")
+}
+
+func TestRecorder_Chapters(t *testing.T) {
+	common.SetupLogging(common.LLError, "/dev/null")
+
+	dir := t.TempDir()
+	queue := newTestQueue(t, av.AAC)
+	recorder, err := NewRecorder(queue, "live", RecorderConfig{Dir: dir, Format: "ts"})
+	require.NoError(t, err)
+	require.NoError(t, recorder.Start())
+
+	// Give the recorder a moment to attach its cursor to the queue
+	time.Sleep(50 * time.Millisecond)
+
+	writePackets := func(from, to int) {
+		for i := from; i < to; i++ {
+			err := queue.WritePacket(av.Packet{
+				Time: time.Duration(i) * time.Second,
+				Data: []byte{0x21, 0x00, 0x49, 0x90, 0x02, 0x19},
+			})
+			require.NoError(t, err)
+		}
+	}
+
+	writePackets(0, 5)
+	require.Eventually(t, func() bool {
+		recorder.mutex.RLock()
+		defer recorder.mutex.RUnlock()
+		return recorder.position == 4*time.Second
+	}, time.Second, 10*time.Millisecond)
+	recorder.addChapter(Chapter{Title: "Second Feature"})
+	writePackets(5, 10)
+	queue.Close()
+
+	select {
+	case <-recorder.Done():
+	case <-time.After(2 * time.Second):
+		t.Fatal("recorder did not finish after the queue was closed")
+	}
+
+	files, err := filepath.Glob(filepath.Join(dir, "*.vtt"))
+	require.NoError(t, err)
+	require.Len(t, files, 1, "the chapters are saved next to the recording")
+
+	data, err := os.ReadFile(files[0])
+	require.NoError(t, err)
+	assert.Equal(t, "WEBVTT\n\n1\n00:00:04.000 --> 00:00:09.000\nSecond Feature\n", string(data))
+}
+
+func TestVODWriter_Chapters(t *testing.T) {
+	common.SetupLogging(common.LLError, "/dev/null")
+	dir := t.TempDir()
+	settings = &Settings{TitleLength: 50, KeepVODs: true, VODDir: dir}
+
+	writer, err := newVODWriter(dir, "live", nil)
+	require.NoError(t, err)
+
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		writer.addSegment(nil, HLSSegment{URI: fmt.Sprintf("/live/segment_%d.ts", i), Duration: 4, Data: []byte{byte(i)}, Sequence: uint64(i), ProgramDateTime: start})
+	}
+	writer.addChapter(Chapter{ID: "chapter-1", Title: "Second Feature", Start: time.Now()})
+	writer.addSegment(nil, HLSSegment{URI: "/live/segment_3.ts", Duration: 4, Data: []byte{3}, Sequence: 3, ProgramDateTime: start})
+
+	vod, ok := writer.finish()
+	require.True(t, ok)
+	require.Len(t, vod.Chapters, 1)
+	assert.InDelta(t, 12.0, vod.Chapters[0].Time, 0.5)
+
+	w := httptest.NewRecorder()
+	handleVOD(w, httptest.NewRequest(http.MethodGet, "/vod/"+vod.ID+"/playlist.m3u8", nil))
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), `#EXT-X-DATERANGE:ID="chapter-1"`)
+
+	w = httptest.NewRecorder()
+	handleVOD(w, httptest.NewRequest(http.MethodGet, "/vod/"+vod.ID+"/chapters.vtt", nil))
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "text/vtt", w.Header().Get("Content-Type"))
+	assert.Contains(t, w.Body.String(), "Second Feature")
+	assert.Contains(t, w.Body.String(), "--> 00:00:16.000")
+}
@@ -69,7 +69,7 @@ func (cl *Client) NewMsg(data common.ClientData) {
 	case common.CdUsers:
 		common.LogChatf("[chat|hidden] <%s> get list of users\n", cl.name)
 
-		names := chat.GetNames()
+		names := cl.belongsTo.GetNames()
 		idx := -1
 		for i := range names {
 			if names[i] == cl.name {
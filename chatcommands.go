@@ -3,6 +3,10 @@ package main
 import (
 	"fmt"
 	"html"
+	"net"
+	"net/url"
+	"sort"
+	"strconv"
 	"strings"
 	"time"
 
@@ -22,6 +26,9 @@ type Command struct {
 
 type CommandFunction func(client *Client, args []string) (string, error)
 
+// maximum number of files listed by the /library command
+const maxLibraryListing = 50
+
 var commands = &CommandControl{
 	user: map[string]Command{
 		common.CNMe.String(): {
@@ -284,14 +291,30 @@ var commands = &CommandControl{
 				cl.belongsTo.clientsMtx.Unlock()
 
 				// Just print max users and time alive here
-				return fmt.Sprintf("Current users in chat: <b>%d</b><br />Max users in chat: <b>%d</b><br />Server uptime: <b>%s</b><br />Stream uptime: <b>%s</b><br />Viewers: <b>%d</b><br />Max Viewers: <b>%d</b>",
+				msg := fmt.Sprintf("Current users in chat: <b>%d</b><br />Max users in chat: <b>%d</b><br />Server uptime: <b>%s</b><br />Stream uptime: <b>%s</b><br />Viewers: <b>%d</b><br />Max Viewers: <b>%d</b>",
 					users,
 					stats.getMaxUsers(),
 					time.Since(stats.start),
 					stats.getStreamLength(),
 					stats.getViewerCount(),
 					stats.getMaxViewerCount(),
-				), nil
+				)
+
+				// What the streamer is sending
+				group := roomStreamName(cl.belongsTo)
+				for _, status := range streamStatuses(cl.CmdLevel) {
+					if status.Group == group && status.Metadata != nil {
+						msg += "<br />" + html.EscapeString(fmt.Sprintf("%s: %s", status.Stream, status.Metadata))
+					}
+				}
+
+				// Admins also get the health of the incoming streams
+				if cl.CmdLevel == common.CmdlAdmin {
+					for _, ingest := range ingestStats() {
+						msg += "<br />" + html.EscapeString(ingest.String())
+					}
+				}
+				return msg, nil
 			},
 		},
 
@@ -307,6 +330,38 @@ var commands = &CommandControl{
 				return "Room is open access.  Anybody can join.", nil
 			},
 		},
+
+		common.CNPlayToken.String(): {
+			HelpText: "Get a personal token to watch the stream in an RTMP player like VLC.",
+			Function: func(cl *Client, args []string) (string, error) {
+				if settings.DisableRTMPPlay {
+					return "", newChatError("RTMP playback is disabled")
+				}
+
+				token := newPlayToken(cl.name, cl.Host())
+				host := "<server>"
+				if u, err := url.Parse(settings.AccessLink); err == nil && u.Hostname() != "" {
+					host = u.Hostname()
+				}
+				if _, port, err := net.SplitHostPort(settings.RtmpListenAddress); err == nil && port != "1935" {
+					host = net.JoinHostPort(host, port)
+				}
+				return html.EscapeString(fmt.Sprintf("Your play token is valid for %s.  Do not share it: rtmp://%s/%s?token=%s",
+					playTokenLifetime, host, roomStreamName(cl.belongsTo), token)), nil
+			},
+		},
+
+		common.CNStreamURL.String(): {
+			HelpText: "Get a personal link to the stream for players like VLC or mpv.",
+			Function: func(cl *Client, args []string) (string, error) {
+				if cl.conn == nil || cl.conn.viewerID == "" {
+					return "", newChatError("Reload the page to get a stream link")
+				}
+
+				link := streamURL(roomStreamName(cl.belongsTo), cl.conn.viewerID, time.Now())
+				return html.EscapeString(fmt.Sprintf("Your stream link is valid for %s.  Do not share it: %s", signedURLLifetime, link)), nil
+			},
+		},
 	},
 
 	mod: map[string]Command{
@@ -363,6 +418,46 @@ var commands = &CommandControl{
 			},
 		},
 
+		common.CNClip.String(): {
+			HelpText: "Save the last seconds of the stream and post a link to it.  Usage: /clip [seconds] [title]",
+			Function: cmdClip,
+		},
+
+		common.CNChapter.String(): {
+			HelpText: "Start a new chapter of the stream, eg. when the second movie starts.  Usage: /chapter <title>",
+			Function: cmdChapter,
+		},
+
+		common.CNIntermission.String(): {
+			HelpText: "Start an intermission with a countdown in chat.  Usage: /intermission <minutes>, /intermission stop ends it early",
+			Function: cmdIntermission,
+		},
+
+		common.CNLibrary.String(): {
+			HelpText: "List the files in the media library.  An optional argument filters the list.",
+			Function: func(cl *Client, args []string) (string, error) {
+				names, err := library.List(strings.Join(args, " "))
+				if err != nil {
+					return "", newChatError("Unable to list media library: %s", err)
+				}
+
+				if len(names) == 0 {
+					return "No files found in the media library.", nil
+				}
+
+				more := ""
+				if len(names) > maxLibraryListing {
+					more = fmt.Sprintf("<br />...and %d more", len(names)-maxLibraryListing)
+					names = names[:maxLibraryListing]
+				}
+
+				for i, name := range names {
+					names[i] = html.EscapeString(name)
+				}
+				return "Media library:<br />" + strings.Join(names, "<br />") + more, nil
+			},
+		},
+
 		common.CNUnmod.String(): {
 			HelpText: "Revoke a user's moderator privilages.  Moderators can only unmod themselves.",
 			Function: func(cl *Client, args []string) (string, error) {
@@ -523,6 +618,103 @@ var commands = &CommandControl{
 			},
 		},
 
+		common.CNRelay.String(): {
+			HelpText: "Show the status of the relays to external RTMP servers.",
+			Function: cmdRelay,
+		},
+
+		common.CNPull.String(): {
+			HelpText: "Pull a stream from an RTMP or HTTP-FLV URL: /pull [start <name> <url>|stop <name>].  Shows the pulled streams without arguments.",
+			Function: cmdPull,
+		},
+
+		common.CNStreamKey.String(): {
+			HelpText: "Manage named stream keys: /streamkey [create <name> <owner> [channel|*] [expires in, eg 48h]|revoke <name>].  Lists the keys without arguments.",
+			Function: cmdStreamKey,
+		},
+
+		common.CNHandoff.String(): {
+			HelpText: "Let a new publisher take over a running stream: /handoff [approve|deny] <stream>.  Lists the waiting publishers without arguments.",
+			Function: cmdHandoff,
+		},
+
+		common.CNGoLive.String(): {
+			HelpText: "Show a backstage stream to everybody: /golive [stream].  Defaults to the stream of this chat room.",
+			Function: func(cl *Client, args []string) (string, error) {
+				// The stream of the room the command was sent in
+				streamName := roomStreamName(cl.belongsTo)
+				if len(args) > 0 {
+					streamName = args[0]
+				}
+
+				err := goLive(streamName)
+				if err != nil {
+					return "", newChatError("%s", err)
+				}
+				cl.belongsTo.AddModNotice(fmt.Sprintf("%s made %s public", cl.name, streamName))
+
+				// Players gave up on the stream while it was hidden
+				if room := existingChatRoom(streamName); room != nil {
+					room.AddCmdMsg(common.CmdRefreshPlayer, nil)
+				}
+				return html.EscapeString(fmt.Sprintf("%s is now public.", streamName)), nil
+			},
+		},
+
+		common.CNRecord.String(): {
+			HelpText: "Start or stop recording a stream to disk.  Usage: /record [start|stop] [stream].  Defaults to the stream of this chat room.",
+			Function: cmdRecord,
+		},
+
+		common.CNQueue.String(): {
+			HelpText: "Add a file from the media library to the play queue.  Shows the queue if no file is given.",
+			Function: func(cl *Client, args []string) (string, error) {
+				if len(args) == 0 {
+					playing := library.NowPlaying()
+					queue := library.Queue()
+					if playing == "" && len(queue) == 0 {
+						return "Nothing is playing or queued.", nil
+					}
+
+					lines := []string{"Now playing: " + html.EscapeString(playing)}
+					for i, name := range queue {
+						lines = append(lines, fmt.Sprintf("%d. %s", i+1, html.EscapeString(name)))
+					}
+					return strings.Join(lines, "<br />"), nil
+				}
+
+				name := html.UnescapeString(strings.Join(args, " "))
+				err := library.Enqueue(name)
+				if err != nil {
+					return "", newChatError("Unable to queue file: %s", err)
+				}
+
+				cl.belongsTo.AddModNotice(cl.name + " queued " + html.EscapeString(name))
+				return "Queued " + html.EscapeString(name), nil
+			},
+		},
+
+		common.CNSkip.String(): {
+			HelpText: "Skip the media library file that is currently playing.",
+			Function: func(cl *Client, args []string) (string, error) {
+				err := library.Skip()
+				if err != nil {
+					return "", newChatError("Unable to skip: %s", err)
+				}
+				cl.belongsTo.AddModNotice(cl.name + " skipped the current file")
+				return "Skipping current file.", nil
+			},
+		},
+
+		common.CNStopPlayback.String(): {
+			HelpText: "Stop media library playback and clear the queue.",
+			Function: func(cl *Client, args []string) (string, error) {
+				library.Stop()
+				cl.belongsTo.AddModNotice(cl.name + " stopped media library playback")
+				return "Playback stopped and queue cleared.", nil
+			},
+		},
+
 		common.CNIP.String(): {
 			HelpText: "List users and IP in the server console.  Requires logging level to be set to info or above.",
 			Function: func(cl *Client, args []string) (string, error) {
@@ -593,6 +785,382 @@ func cmdHelp(cl *Client, args []string) (string, error) {
 	return `Opening help in new window.`, nil
 }
 
+func cmdRelay(cl *Client, args []string) (string, error) {
+	l.RLock()
+	defer l.RUnlock()
+
+	names := make([]string, 0, len(channels))
+	for name := range channels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	lines := []string{}
+	for _, name := range names {
+		for _, relay := range channels[name].relays {
+			status := relay.Status()
+			line := fmt.Sprintf("%s -> %s: %s for %s, %d reconnect(s), %d packets",
+				name,
+				status.Target,
+				status.State,
+				time.Since(status.Since).Round(time.Second),
+				status.Reconnects,
+				status.Packets,
+			)
+			if status.LastError != nil {
+				line += ", last error: " + status.LastError.Error()
+			}
+			lines = append(lines, html.EscapeString(line))
+		}
+	}
+
+	if len(lines) == 0 {
+		return "No streams are being relayed.", nil
+	}
+	return strings.Join(lines, "<br />"), nil
+}
+
+func cmdPull(cl *Client, args []string) (string, error) {
+	action := ""
+	if len(args) > 0 {
+		action = strings.ToLower(args[0])
+	}
+
+	switch action {
+	case "":
+		statuses := PullStatuses()
+		if len(statuses) == 0 {
+			return "No streams are being pulled.", nil
+		}
+		sort.Slice(statuses, func(i, j int) bool { return statuses[i].Name < statuses[j].Name })
+
+		lines := []string{}
+		for _, status := range statuses {
+			line := fmt.Sprintf("%s <- %s: %s for %s, %d reconnect(s), %d packets",
+				status.Name,
+				status.Source,
+				status.State,
+				time.Since(status.Since).Round(time.Second),
+				status.Reconnects,
+				status.Packets,
+			)
+			if status.LastError != nil {
+				line += ", last error: " + status.LastError.Error()
+			}
+			lines = append(lines, html.EscapeString(line))
+		}
+		return strings.Join(lines, "<br />"), nil
+
+	case "start":
+		if len(args) != 3 {
+			return "", newChatError("Usage: /pull start <name> <url>")
+		}
+		_, err := StartPull(args[1], args[2])
+		if err != nil {
+			return "", newChatError("Unable to pull stream: %s", err)
+		}
+		cl.belongsTo.AddModNotice(fmt.Sprintf("%s started pulling %s from %s", cl.name, args[1], redactPullURL(args[2])))
+		return html.EscapeString(fmt.Sprintf("Pulling %s from %s.", args[1], redactPullURL(args[2]))), nil
+
+	case "stop":
+		if len(args) != 2 {
+			return "", newChatError("Usage: /pull stop <name>")
+		}
+		err := StopPull(args[1])
+		if err != nil {
+			return "", newChatError("Unable to stop pulling: %s", err)
+		}
+		cl.belongsTo.AddModNotice(fmt.Sprintf("%s stopped pulling %s", cl.name, args[1]))
+		return html.EscapeString(fmt.Sprintf("Stopped pulling %s.", args[1])), nil
+
+	default:
+		return "", newChatError("Unknown action %q, use start or stop", action)
+	}
+}
+
+func cmdStreamKey(cl *Client, args []string) (string, error) {
+	action := ""
+	if len(args) > 0 {
+		action = strings.ToLower(args[0])
+	}
+
+	switch action {
+	case "":
+		keys := settings.GetStreamKeys()
+		if len(keys) == 0 {
+			return "There are no named stream keys.", nil
+		}
+
+		lines := []string{}
+		for _, key := range keys {
+			line := fmt.Sprintf("%s: owned by %s", key.Name, key.Owner)
+			if key.Channel != "" {
+				line += ", only for " + key.Channel
+			}
+			if !key.Expires.IsZero() {
+				if time.Now().After(key.Expires) {
+					line += ", expired"
+				} else {
+					line += ", expires in " + time.Until(key.Expires).Round(time.Minute).String()
+				}
+			}
+			lines = append(lines, html.EscapeString(line))
+		}
+		return strings.Join(lines, "<br />"), nil
+
+	case "create":
+		if len(args) < 3 || len(args) > 5 {
+			return "", newChatError("Usage: /streamkey create <name> <owner> [channel|*] [expires in]")
+		}
+
+		channel := ""
+		if len(args) > 3 && args[3] != "*" {
+			channel = args[3]
+			if !isValidStreamName(channel) {
+				return "", newChatError("Invalid channel name %q", channel)
+			}
+		}
+
+		var expires time.Time
+		if len(args) > 4 {
+			d, err := time.ParseDuration(args[4])
+			if err != nil || d <= 0 {
+				return "", newChatError("Invalid expiry %q, use something like 48h", args[4])
+			}
+			expires = time.Now().Add(d)
+		}
+
+		key, err := settings.AddStreamKey(args[1], args[2], channel, expires)
+		if err != nil {
+			return "", newChatError("Unable to create stream key: %s", err)
+		}
+		cl.belongsTo.AddModNotice(fmt.Sprintf("%s created stream key %s for %s", cl.name, key.Name, key.Owner))
+		return html.EscapeString(fmt.Sprintf("Stream key %s for %s: %s", key.Name, key.Owner, key.Key)), nil
+
+	case "revoke":
+		if len(args) != 2 {
+			return "", newChatError("Usage: /streamkey revoke <name>")
+		}
+		err := settings.RevokeStreamKey(args[1])
+		if err != nil {
+			return "", newChatError("Unable to revoke stream key: %s", err)
+		}
+		cl.belongsTo.AddModNotice(fmt.Sprintf("%s revoked stream key %s", cl.name, args[1]))
+		return html.EscapeString(fmt.Sprintf("Stream key %s revoked.", args[1])), nil
+
+	default:
+		return "", newChatError("Unknown action %q, use create or revoke", action)
+	}
+}
+
+func cmdHandoff(cl *Client, args []string) (string, error) {
+	if len(args) == 0 {
+		l.RLock()
+		defer l.RUnlock()
+
+		if len(handoffs) == 0 {
+			return "No publishers are waiting to take over a stream.", nil
+		}
+
+		lines := []string{}
+		for streamPath, h := range handoffs {
+			lines = append(lines, html.EscapeString(fmt.Sprintf("%s wants to take over %s, waiting for %s",
+				h.owner, streamPath, time.Since(h.since).Round(time.Second))))
+		}
+		sort.Strings(lines)
+		return strings.Join(lines, "<br />"), nil
+	}
+
+	if len(args) != 2 {
+		return "", newChatError("Usage: /handoff [approve|deny] <stream>")
+	}
+
+	var approve bool
+	switch strings.ToLower(args[0]) {
+	case "approve":
+		approve = true
+	case "deny":
+		approve = false
+	default:
+		return "", newChatError("Unknown action %q, use approve or deny", args[0])
+	}
+
+	owner, err := decideHandoff(args[1], approve)
+	if err != nil {
+		return "", newChatError("%s", err)
+	}
+
+	if approve {
+		cl.belongsTo.AddModNotice(fmt.Sprintf("%s approved %s taking over %s", cl.name, owner, args[1]))
+		return html.EscapeString(fmt.Sprintf("%s is taking over %s.", owner, args[1])), nil
+	}
+	cl.belongsTo.AddModNotice(fmt.Sprintf("%s denied %s taking over %s", cl.name, owner, args[1]))
+	return html.EscapeString(fmt.Sprintf("%s was turned away.", owner)), nil
+}
+
+func cmdRecord(cl *Client, args []string) (string, error) {
+	action := ""
+	streamName := ""
+	if len(args) > 0 {
+		action = strings.ToLower(args[0])
+	}
+	if len(args) > 1 {
+		streamName = args[1]
+	}
+	group := roomStreamName(cl.belongsTo)
+
+	if action == "start" {
+		err := createRecordingsDir()
+		if err != nil {
+			return "", newChatError("Unable to start recording: %s", err)
+		}
+	}
+
+	// The channel must not end between finding it and starting its recorder
+	l.Lock()
+	defer l.Unlock()
+
+	// The stream of the room the command was sent in, the best rendition for
+	// a group
+	if streamName == "" {
+		streamName = group
+		if _, ok := channels[group]; !ok {
+			if found := findRenditions(group); len(found) > 0 {
+				streamName = found[0].streamPath
+			}
+		}
+	}
+
+	streamName, ch, err := lookupChannel(streamName)
+	if err != nil {
+		return "", newChatError("Unable to find stream: %s", err)
+	}
+
+	switch action {
+	case "":
+		if ch.recorder == nil {
+			return fmt.Sprintf("Stream %s is not being recorded.", streamName), nil
+		}
+		status := ch.recorder.Status()
+		return fmt.Sprintf("Recording %s for %s to %s (%d file(s), %d bytes)",
+			streamName,
+			time.Since(status.Started).Round(time.Second),
+			status.CurrentFile,
+			status.Files,
+			status.Bytes,
+		), nil
+
+	case "start":
+		err = ch.startRecording(streamName)
+		if err != nil {
+			return "", newChatError("Unable to start recording: %s", err)
+		}
+		cl.belongsTo.AddModNotice(cl.name + " started recording " + streamName)
+		return "Recording started for " + streamName, nil
+
+	case "stop":
+		if !ch.stopRecording() {
+			return "", newChatError("Stream %s is not being recorded.", streamName)
+		}
+		cl.belongsTo.AddModNotice(cl.name + " stopped recording " + streamName)
+		return "Recording stopped for " + streamName, nil
+	}
+
+	return "", newChatError("Usage: /record [start|stop] [stream]")
+}
+
+func cmdClip(cl *Client, args []string) (string, error) {
+	length := defaultClipLength
+	if len(args) > 0 {
+		if seconds, err := strconv.Atoi(args[0]); err == nil {
+			if seconds <= 0 || time.Duration(seconds)*time.Second > maxClipLength {
+				return "", newChatError("Clips can be 1 to %d seconds long", int(maxClipLength.Seconds()))
+			}
+			length = time.Duration(seconds) * time.Second
+			args = args[1:]
+		}
+	}
+	title := html.UnescapeString(strings.Join(args, " "))
+	if len(title) > settings.TitleLength {
+		return "", newChatError("Title too long (%d/%d)", len(title), settings.TitleLength)
+	}
+
+	stream := roomStreamName(cl.belongsTo)
+	ch, ok := groupChannel(stream)
+	if !ok || ch.hlsChan == nil {
+		return "", newChatError("Stream %s is not live", stream)
+	}
+
+	clip, err := createClip(settings.GetClipsDir(), ch, stream, title, cl.name, length)
+	if err != nil {
+		common.LogErrorf("[clip] %v\n", err)
+		return "", newChatError("Unable to save the clip: %s", err)
+	}
+
+	link := strings.TrimRight(settings.AccessLink, "/") + clip.URL()
+	if title == "" {
+		title = "a clip"
+	}
+	cl.belongsTo.AddMsg(cl, false, true, fmt.Sprintf(`%s saved %s (%.0fs): <a href="%s" target="_blank">%s</a>`,
+		html.EscapeString(cl.name), html.EscapeString(title), clip.Duration, html.EscapeString(link), html.EscapeString(link)))
+	return "", nil
+}
+
+func cmdChapter(cl *Client, args []string) (string, error) {
+	title := strings.TrimSpace(html.UnescapeString(strings.Join(args, " ")))
+	if title == "" {
+		return "", newChatError("Usage: /chapter <title>")
+	}
+	if len(title) > settings.TitleLength {
+		return "", newChatError("Title too long (%d/%d)", len(title), settings.TitleLength)
+	}
+
+	stream := roomStreamName(cl.belongsTo)
+	if !markChapter(stream, newChapter(title, 0)) {
+		return "", newChatError("Stream %s is not live", stream)
+	}
+
+	// The show goes on
+	if time.Until(cl.belongsTo.Intermission()) > 0 {
+		cl.belongsTo.SetIntermission(time.Time{})
+	}
+
+	cl.belongsTo.AddModNotice(cl.name + " started the chapter '" + html.EscapeString(title) + "'")
+	cl.belongsTo.AddMsg(cl, false, true, "Now starting: "+html.EscapeString(title))
+	return "", nil
+}
+
+func cmdIntermission(cl *Client, args []string) (string, error) {
+	if len(args) != 1 {
+		return "", newChatError("Usage: /intermission <minutes>, /intermission stop")
+	}
+
+	if strings.ToLower(args[0]) == "stop" {
+		if time.Until(cl.belongsTo.Intermission()) <= 0 {
+			return "", newChatError("There is no intermission going on")
+		}
+		cl.belongsTo.SetIntermission(time.Time{})
+		cl.belongsTo.AddModNotice(cl.name + " ended the intermission")
+		return "", nil
+	}
+
+	minutes, err := strconv.Atoi(args[0])
+	if err != nil || minutes <= 0 || time.Duration(minutes)*time.Minute > maxIntermission {
+		return "", newChatError("Intermissions can be 1 to %d minutes long", int(maxIntermission.Minutes()))
+	}
+	length := time.Duration(minutes) * time.Minute
+
+	stream := roomStreamName(cl.belongsTo)
+	if !markChapter(stream, newChapter("Intermission", length)) {
+		return "", newChatError("Stream %s is not live", stream)
+	}
+
+	cl.belongsTo.SetIntermission(time.Now().Add(length))
+	cl.belongsTo.AddModNotice(fmt.Sprintf("%s started a %d minute intermission", cl.name, minutes))
+	cl.belongsTo.AddMsg(cl, false, true, fmt.Sprintf("Intermission, the stream continues in %d minute(s)", minutes))
+	return "", nil
+}
+
 func getHelp(lvl common.CommandLevel) map[string]string {
 	var cmdList map[string]Command
 	switch lvl {
@@ -1,8 +1,9 @@
 package main
 
 import (
+	"errors"
 	"fmt"
-
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -23,28 +24,47 @@ type ChatRoom struct {
 
 	playing     string
 	playingLink string
+	playingMtx  sync.Mutex
+
+	intermission    time.Time // end of the intermission countdown
+	intermissionMtx sync.Mutex
 
 	modPasswords    []string // single-use mod passwords
 	modPasswordsMtx sync.Mutex
+
+	replays    []*vodWriter // VODs the messages are recorded to
+	replaysMtx sync.Mutex
+
+	closed bool          // the room was removed, guarded by clientsMtx
+	done   chan struct{} // closed along with the room to stop Broadcast
 }
 
+var errRoomClosed = errors.New("chat room was closed")
+
 // initializing the chatroom
 func newChatRoom() (*ChatRoom, error) {
-	cr := &ChatRoom{
-		queue:    make(chan common.ChatData, 1000),
-		modqueue: make(chan common.ChatData, 1000),
-		clients:  []*Client{},
-	}
-
 	err := loadEmotes()
 	if err != nil {
 		return nil, fmt.Errorf("error loading emotes: %w", err)
 	}
 	common.LogInfof("Loaded %d emotes\n", len(common.Emotes))
 
+	return newRoom(), nil
+}
+
+// newRoom creates an empty chat room.  Emotes are shared by every room and
+// loaded with the main one.
+func newRoom() *ChatRoom {
+	cr := &ChatRoom{
+		queue:    make(chan common.ChatData, 1000),
+		modqueue: make(chan common.ChatData, 1000),
+		clients:  []*Client{},
+		done:     make(chan struct{}),
+	}
+
 	//the "heartbeat" for broadcasting messages
 	go cr.Broadcast()
-	return cr, nil
+	return cr
 }
 
 // A new client joined
@@ -52,6 +72,10 @@ func (cr *ChatRoom) Join(conn *chatConnection, data common.JoinData) (*Client, e
 	defer cr.clientsMtx.Unlock()
 	cr.clientsMtx.Lock()
 
+	if cr.closed {
+		return nil, errRoomClosed
+	}
+
 	sendHiddenMessage := func(cd common.ClientDataType, i interface{}) {
 		// If the message cant be converted, then just don't send
 		if d, err := common.NewChatHiddenMessage(cd, i).ToJSON(); err == nil {
@@ -109,7 +133,8 @@ func (cr *ChatRoom) Join(conn *chatConnection, data common.JoinData) (*Client, e
 	cr.clients = append(cr.clients, client)
 
 	common.LogChatf("[join] %s %s\n", host, data.Color)
-	playingCommand, err := common.NewChatCommand(common.CmdPlaying, []string{cr.playing, cr.playingLink}).ToJSON()
+	title, link := cr.Playing()
+	playingCommand, err := common.NewChatCommand(common.CmdPlaying, []string{title, link}).ToJSON()
 	if err != nil {
 		common.LogErrorf("Unable to encode playing command on join: %s\n", err)
 	} else {
@@ -118,6 +143,14 @@ func (cr *ChatRoom) Join(conn *chatConnection, data common.JoinData) (*Client, e
 			common.LogErrorf("could not send playing command on join: %v\n", err)
 		}
 	}
+	if end := cr.Intermission(); time.Until(end) > 0 {
+		intermissionCommand, err := common.NewChatCommand(common.CmdIntermission, intermissionArgs(end)).ToJSON()
+		if err != nil {
+			common.LogErrorf("Unable to encode intermission command on join: %s\n", err)
+		} else if err = client.Send(intermissionCommand); err != nil {
+			common.LogErrorf("could not send intermission command on join: %v\n", err)
+		}
+	}
 	if !settings.LetThemLurk {
 		cr.AddEventMsg(common.EvJoin, data.Name, data.Color)
 	}
@@ -210,6 +243,7 @@ func (cr *ChatRoom) Ban(name string) error {
 		}
 	}
 
+	revokePlayTokens(append(names, name)...)
 	err = settings.AddBan(host, names)
 	if err != nil {
 		common.LogErrorf("[BAN] Error banning %q: %s\n", name, err)
@@ -333,7 +367,10 @@ func (cr *ChatRoom) Broadcast() {
 
 	for {
 		select {
+		case <-cr.done:
+			return
 		case msg := <-cr.queue:
+			cr.recordReplays(msg)
 			cr.clientsMtx.Lock()
 			for _, client := range cr.clients {
 				go send(msg, client)
@@ -356,16 +393,73 @@ func (cr *ChatRoom) Broadcast() {
 	}
 }
 
+// closeIfEmpty closes the room if nobody is in it.  Nobody can join a closed
+// room.
+func (cr *ChatRoom) closeIfEmpty() bool {
+	cr.clientsMtx.Lock()
+	defer cr.clientsMtx.Unlock()
+
+	if len(cr.clients) > 0 || cr.closed {
+		return false
+	}
+	cr.closed = true
+	close(cr.done)
+	return true
+}
+
 func (cr *ChatRoom) ClearPlaying() {
-	cr.playing = ""
-	cr.playingLink = ""
-	cr.AddCmdMsg(common.CmdPlaying, []string{"", ""})
+	cr.SetPlaying("", "")
 }
 
+// SetPlaying sets the title and link of what is playing.  A new title is put
+// into the HLS streams of the room too, so players get it in sync with the
+// video.
 func (cr *ChatRoom) SetPlaying(title, link string) {
+	cr.playingMtx.Lock()
+	changed := title != cr.playing
 	cr.playing = title
 	cr.playingLink = link
+	cr.playingMtx.Unlock()
+
 	cr.AddCmdMsg(common.CmdPlaying, []string{title, link})
+	if changed {
+		markTitle(roomStreamName(cr), title)
+	}
+}
+
+// Playing returns the title and link of what is playing
+func (cr *ChatRoom) Playing() (title, link string) {
+	cr.playingMtx.Lock()
+	defer cr.playingMtx.Unlock()
+	return cr.playing, cr.playingLink
+}
+
+// SetIntermission starts the intermission countdown of everyone in the room.
+// A zero end stops it.
+func (cr *ChatRoom) SetIntermission(end time.Time) {
+	cr.intermissionMtx.Lock()
+	cr.intermission = end
+	cr.intermissionMtx.Unlock()
+
+	cr.AddCmdMsg(common.CmdIntermission, intermissionArgs(end))
+}
+
+// Intermission returns the end of the intermission countdown, which is in
+// the past if there is none
+func (cr *ChatRoom) Intermission() time.Time {
+	cr.intermissionMtx.Lock()
+	defer cr.intermissionMtx.Unlock()
+	return cr.intermission
+}
+
+// intermissionArgs are the seconds left until end.  Clocks of the viewers may
+// be off, so the countdown isn't sent as a date.
+func intermissionArgs(end time.Time) []string {
+	seconds := 0
+	if left := time.Until(end); left > 0 {
+		seconds = int(left.Round(time.Second).Seconds())
+	}
+	return []string{strconv.Itoa(seconds)}
 }
 
 func (cr *ChatRoom) GetNames() []string {
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/zorchenhimer/MovieNight/common"
+)
+
+const (
+	defaultClipLength = 30 * time.Second
+	maxClipLength     = 10 * time.Minute
+)
+
+// Clip is a saved piece of a live stream.  Its details are kept next to the
+// video in <ID>.json.
+type Clip struct {
+	ID       string
+	Title    string
+	Stream   string
+	Creator  string
+	Created  time.Time
+	Duration float64 // seconds
+	File     string  // name of the video in the clips directory
+}
+
+var clipIDPattern = regexp.MustCompile(`^[0-9]{8}-[0-9]{6}-[0-9a-zA-Z]{6}$`)
+
+// URL is the stable address the clip is served at
+func (c Clip) URL() string {
+	return "/clips/" + c.File
+}
+
+// createClip saves the last length of a channel's HLS segments to the clips
+// directory
+func createClip(dir string, ch *Channel, stream, title, creator string, length time.Duration) (Clip, error) {
+	init, segments := ch.hlsChan.RecentSegments(length)
+	if len(segments) == 0 {
+		return Clip{}, fmt.Errorf("stream %s has nothing to clip yet", stream)
+	}
+
+	now := time.Now()
+	clip := Clip{
+		ID:      fmt.Sprintf("%s-%s", now.Format("20060102-150405"), randStringRunes(6)),
+		Title:   title,
+		Stream:  stream,
+		Creator: creator,
+		Created: now,
+	}
+
+	ext := ".ts"
+	if init != nil {
+		ext = ".mp4"
+	}
+	clip.File = clip.ID + ext
+
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return Clip{}, fmt.Errorf("could not create clips directory: %w", err)
+	}
+
+	// TS segments can simply be put after each other, fMP4 fragments need
+	// the init segment in front of them
+	data := append([]byte(nil), init...)
+	for _, segment := range segments {
+		data = append(data, segment.Data...)
+		clip.Duration += segment.Duration
+	}
+
+	err = os.WriteFile(filepath.Join(dir, clip.File), data, 0644)
+	if err != nil {
+		return Clip{}, fmt.Errorf("could not write clip: %w", err)
+	}
+
+	details, err := json.MarshalIndent(clip, "", "\t")
+	if err != nil {
+		return Clip{}, fmt.Errorf("could not encode clip details: %w", err)
+	}
+	err = os.WriteFile(filepath.Join(dir, clip.ID+".json"), details, 0644)
+	if err != nil {
+		return Clip{}, fmt.Errorf("could not write clip details: %w", err)
+	}
+
+	common.LogInfof("[clip] %s saved %.1fs of %s to %s\n", creator, clip.Duration, stream, clip.File)
+	return clip, nil
+}
+
+// loadClip reads the details of a clip
+func loadClip(dir, id string) (Clip, error) {
+	var clip Clip
+	if !clipIDPattern.MatchString(id) {
+		return clip, fmt.Errorf("invalid clip ID %q", id)
+	}
+
+	data, err := os.ReadFile(filepath.Join(dir, id+".json"))
+	if err != nil {
+		return clip, err
+	}
+	err = json.Unmarshal(data, &clip)
+	return clip, err
+}
+
+// clipFileName turns the title of a clip into a name for the download
+func clipFileName(clip Clip) string {
+	name := strings.Map(func(r rune) rune {
+		if strings.ContainsRune(`<>:"/\|?*`, r) || r < ' ' {
+			return '_'
+		}
+		return r
+	}, strings.TrimSpace(clip.Title))
+	if name == "" {
+		name = "clip-" + clip.ID
+	}
+	return name + filepath.Ext(clip.File)
+}
+
+// handleClip serves clips as downloads at /clips/<ID>.<ts|mp4>
+func handleClip(w http.ResponseWriter, r *http.Request) {
+	file := strings.TrimPrefix(r.URL.Path, "/clips/")
+	ext := filepath.Ext(file)
+	if ext != ".ts" && ext != ".mp4" {
+		http.NotFound(w, r)
+		return
+	}
+
+	dir := settings.GetClipsDir()
+	clip, err := loadClip(dir, strings.TrimSuffix(file, ext))
+	if err != nil || clip.File != file {
+		http.NotFound(w, r)
+		return
+	}
+
+	f, err := os.Open(filepath.Join(dir, clip.File))
+	if err != nil {
+		common.LogErrorf("Could not open clip %s: %v\n", clip.File, err)
+		http.NotFound(w, r)
+		return
+	}
+	defer f.Close()
+
+	w.Header().Set("Content-Type", hlsSegmentContentType(clip.File))
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", clipFileName(clip)))
+	http.ServeContent(w, r, clip.File, clip.Created, f)
+}
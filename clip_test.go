@@ -0,0 +1,110 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/nareix/joy4/av"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/zorchenhimer/MovieNight/common"
+)
+
+func TestHLSChannel_RecentSegments(t *testing.T) {
+	common.SetupLogging(common.LLError, "/dev/null")
+
+	config := DefaultHLSConfig()
+	config.ClipBuffer = 20 * time.Second
+	hlsChan, err := NewHLSChannelWithConfig(newTestQueue(t, av.AAC), config)
+	require.NoError(t, err)
+	defer hlsChan.Close()
+
+	for i := 0; i < 20; i++ {
+		hlsChan.addGeneratedSegment(HLSSegment{URI: fmt.Sprintf("/live/segment_%d.ts", i), Duration: 4, Data: []byte{byte(i)}, Sequence: uint64(i)})
+	}
+
+	_, segments := hlsChan.RecentSegments(10 * time.Second)
+	require.Len(t, segments, 3)
+	assert.Equal(t, uint64(17), segments[0].Sequence)
+	assert.Equal(t, uint64(19), segments[2].Sequence)
+
+	// Asking for more than the clip buffer gets all of it
+	_, segments = hlsChan.RecentSegments(time.Minute)
+	assert.Len(t, segments, 5)
+
+	// fMP4 clips stop where the codecs changed
+	for i := 20; i < 25; i++ {
+		init := "/live/init_a.mp4"
+		if i >= 23 {
+			init = "/live/init_b.mp4"
+		}
+		hlsChan.addGeneratedSegment(HLSSegment{URI: fmt.Sprintf("/live/segment_%d.m4s", i), Duration: 4, Data: []byte{byte(i)}, Sequence: uint64(i), InitURI: init})
+	}
+	hlsChan.mutex.Lock()
+	hlsChan.initSegments["/live/init_a.mp4"] = []byte("init a")
+	hlsChan.initSegments["/live/init_b.mp4"] = []byte("init b")
+	hlsChan.mutex.Unlock()
+	init, segments := hlsChan.RecentSegments(time.Minute)
+	assert.Equal(t, []byte("init b"), init)
+	require.Len(t, segments, 2)
+	assert.Equal(t, uint64(23), segments[0].Sequence)
+
+	// Without a clip buffer only the playlist window is there
+	config.ClipBuffer = 0
+	hlsChan2, err := NewHLSChannelWithConfig(newTestQueue(t, av.AAC), config)
+	require.NoError(t, err)
+	defer hlsChan2.Close()
+	for i := 0; i < 20; i++ {
+		hlsChan2.addGeneratedSegment(HLSSegment{URI: fmt.Sprintf("/live/segment_%d.ts", i), Duration: 4, Data: []byte{byte(i)}, Sequence: uint64(i)})
+	}
+	_, segments = hlsChan2.RecentSegments(time.Minute)
+	assert.Len(t, segments, config.MaxSegments)
+}
+
+func TestCreateClip(t *testing.T) {
+	common.SetupLogging(common.LLError, "/dev/null")
+	dir := t.TempDir()
+	settings = &Settings{TitleLength: 50, ClipsDir: dir}
+
+	hlsChan, err := NewHLSChannelWithConfig(newTestQueue(t, av.AAC), DefaultHLSConfig())
+	require.NoError(t, err)
+	defer hlsChan.Close()
+	ch := &Channel{hlsChan: hlsChan}
+
+	_, err = createClip(dir, ch, "live", "Nothing yet", "mod", 30*time.Second)
+	assert.Error(t, err, "there are no segments yet")
+
+	for i := 0; i < 3; i++ {
+		hlsChan.addGeneratedSegment(HLSSegment{URI: fmt.Sprintf("/live/segment_%d.ts", i), Duration: 4, Data: []byte{'a' + byte(i)}, Sequence: uint64(i)})
+	}
+
+	clip, err := createClip(dir, ch, "live", "What a twist?", "mod", 8*time.Second)
+	require.NoError(t, err)
+	assert.Equal(t, 8.0, clip.Duration)
+	assert.Equal(t, clip.ID+".ts", clip.File)
+
+	data, err := os.ReadFile(filepath.Join(dir, clip.File))
+	require.NoError(t, err)
+	assert.Equal(t, "bc", string(data))
+
+	loaded, err := loadClip(dir, clip.ID)
+	require.NoError(t, err)
+	assert.Equal(t, "What a twist?", loaded.Title)
+
+	w := httptest.NewRecorder()
+	handleClip(w, httptest.NewRequest(http.MethodGet, clip.URL(), nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "bc", w.Body.String())
+	assert.Equal(t, `attachment; filename="What a twist_.ts"`, w.Header().Get("Content-Disposition"))
+
+	for _, path := range []string{"/clips/" + clip.ID + ".mp4", "/clips/../settings.json", "/clips/" + clip.ID + ".json"} {
+		w = httptest.NewRecorder()
+		handleClip(w, httptest.NewRequest(http.MethodGet, path, nil))
+		assert.Equal(t, http.StatusNotFound, w.Code, path)
+	}
+}
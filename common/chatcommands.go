@@ -25,13 +25,17 @@ var (
 	CNPin    ChatCommandNames = []string{"pin", "password"}
 	CNEmotes ChatCommandNames = []string{"emotes"}
 	// Mod Commands
-	CNSv      ChatCommandNames = []string{"sv"}
-	CNPlaying ChatCommandNames = []string{"playing"}
-	CNUnmod   ChatCommandNames = []string{"unmod"}
-	CNKick    ChatCommandNames = []string{"kick"}
-	CNBan     ChatCommandNames = []string{"ban"}
-	CNUnban   ChatCommandNames = []string{"unban"}
-	CNPurge   ChatCommandNames = []string{"purge"}
+	CNSv           ChatCommandNames = []string{"sv"}
+	CNPlaying      ChatCommandNames = []string{"playing"}
+	CNUnmod        ChatCommandNames = []string{"unmod"}
+	CNKick         ChatCommandNames = []string{"kick"}
+	CNBan          ChatCommandNames = []string{"ban"}
+	CNUnban        ChatCommandNames = []string{"unban"}
+	CNPurge        ChatCommandNames = []string{"purge"}
+	CNLibrary      ChatCommandNames = []string{"library", "lib"}
+	CNClip         ChatCommandNames = []string{"clip"}
+	CNChapter      ChatCommandNames = []string{"chapter"}
+	CNIntermission ChatCommandNames = []string{"intermission"}
 	// Admin Commands
 	CNMod          ChatCommandNames = []string{"mod"}
 	CNReloadPlayer ChatCommandNames = []string{"reloadplayer"}
@@ -39,6 +43,17 @@ var (
 	CNModpass      ChatCommandNames = []string{"modpass"}
 	CNIP           ChatCommandNames = []string{"iplist"}
 	CNRoomAccess   ChatCommandNames = []string{"changeaccess", "hodor"}
+	CNRecord       ChatCommandNames = []string{"record"}
+	CNQueue        ChatCommandNames = []string{"queue", "enqueue"}
+	CNSkip         ChatCommandNames = []string{"skip"}
+	CNStopPlayback ChatCommandNames = []string{"stopplayback"}
+	CNRelay        ChatCommandNames = []string{"relay", "relays"}
+	CNPull         ChatCommandNames = []string{"pull"}
+	CNStreamKey    ChatCommandNames = []string{"streamkey", "streamkeys"}
+	CNHandoff      ChatCommandNames = []string{"handoff"}
+	CNGoLive       ChatCommandNames = []string{"golive"}
+	CNPlayToken    ChatCommandNames = []string{"playtoken"}
+	CNStreamURL    ChatCommandNames = []string{"streamurl"}
 )
 
 var ChatCommands = []ChatCommandNames{
@@ -54,6 +69,8 @@ var ChatCommands = []ChatCommandNames{
 	CNStats,
 	CNPin,
 	CNEmotes,
+	CNPlayToken,
+	CNStreamURL,
 
 	// Mod
 	CNSv,
@@ -63,6 +80,10 @@ var ChatCommands = []ChatCommandNames{
 	CNBan,
 	CNUnban,
 	CNPurge,
+	CNLibrary,
+	CNClip,
+	CNChapter,
+	CNIntermission,
 
 	// Admin
 	CNMod,
@@ -71,6 +92,15 @@ var ChatCommands = []ChatCommandNames{
 	CNModpass,
 	CNIP,
 	CNRoomAccess,
+	CNRecord,
+	CNQueue,
+	CNSkip,
+	CNStopPlayback,
+	CNRelay,
+	CNPull,
+	CNStreamKey,
+	CNHandoff,
+	CNGoLive,
 }
 
 func GetFullChatCommand(c string) string {
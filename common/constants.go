@@ -4,14 +4,15 @@ type ClientDataType int
 
 // Data types for communicating with the client
 const (
-	CdMessage ClientDataType = iota // a normal message from the client meant to be broadcast
-	CdUsers                         // get a list of users
-	CdPing                          // ping the server to keep the connection alive
-	CdAuth                          // get the auth levels of the user
-	CdColor                         // get the users color
-	CdEmote                         // get a list of emotes
-	CdJoin                          // a message saying the client wants to join
-	CdNotify                        // a notify message for the client to show
+	CdMessage  ClientDataType = iota // a normal message from the client meant to be broadcast
+	CdUsers                          // get a list of users
+	CdPing                           // ping the server to keep the connection alive
+	CdAuth                           // get the auth levels of the user
+	CdColor                          // get the users color
+	CdEmote                          // get a list of emotes
+	CdJoin                           // a message saying the client wants to join
+	CdNotify                         // a notify message for the client to show
+	CdPosition                       // the playback position of a VOD replay in seconds
 )
 
 type DataType int
@@ -35,6 +36,7 @@ const (
 	CmdPurgeChat
 	CmdHelp
 	CmdEmotes
+	CmdIntermission
 )
 
 type CommandLevel int
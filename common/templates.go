@@ -16,10 +16,11 @@ func InitTemplates(filesystem fs.FS) error {
 
 	// keys and files to load for that template
 	var serverTemplateDefs map[string][]string = map[string][]string{
-		"pin":    {"static/base.html", "static/thedoor.html"},
-		"main":   {"static/base.html", "static/main.html"},
-		"help":   {"static/base.html", "static/help.html"},
-		"emotes": {"static/base.html", "static/emotes.html"},
+		"pin":      {"static/base.html", "static/thedoor.html"},
+		"main":     {"static/base.html", "static/main.html"},
+		"help":     {"static/base.html", "static/help.html"},
+		"emotes":   {"static/base.html", "static/emotes.html"},
+		"channels": {"static/base.html", "static/channels.html"},
 	}
 
 	// Parse server templates
@@ -15,6 +15,7 @@ type chatConnection struct {
 	mutex        sync.RWMutex
 	forwardedFor string
 	clientName   string
+	viewerID     string // ties the connection to the browser's HTTP session
 }
 
 func (cc *chatConnection) ReadData(data interface{}) error {
@@ -0,0 +1,543 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+	"regexp"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/nareix/joy4/av"
+	"github.com/nareix/joy4/av/pubsub"
+	"github.com/nareix/joy4/codec/aacparser"
+	"github.com/nareix/joy4/codec/h264parser"
+	"github.com/zorchenhimer/MovieNight/common"
+)
+
+var errNoDASHSegments = errors.New("no DASH segments available yet")
+
+var (
+	dashInitPattern  = regexp.MustCompile(`^init_(\d+)\.mp4$`)
+	dashChunkPattern = regexp.MustCompile(`^chunk_(\d+)_(\d+)\.m4s$`)
+)
+
+// DASHChannel generates a live MPEG-DASH presentation from a stream.  Every
+// track gets its own adaptation set of fragmented MP4 segments, which are cut
+// on the same video keyframes so they line up.  A source with other codecs
+// starts a new period.
+type DASHChannel struct {
+	que    *pubsub.Queue
+	ctx    context.Context
+	cancel context.CancelFunc
+	done   chan struct{} // closed once the segmenter has finished
+
+	segmentDuration time.Duration
+	maxDuration     time.Duration // segments are cut without a keyframe once they are this long
+	maxSegments     int
+
+	mutex           sync.RWMutex
+	periods         []*dashPeriod // the periods of the segment window, the current one last
+	segments        []dashSegment
+	nextNumber      uint64
+	nextPeriod      int
+	nextTrack       int
+	startTime       time.Time          // wall clock time of media time zero
+	discontinuities []hlsDiscontinuity // source changes the segmenter hasn't reached yet
+}
+
+// dashPeriod is a run of segments with the same codecs
+type dashPeriod struct {
+	id     int
+	start  time.Duration // media time of its first segment
+	tracks []*dashTrack
+}
+
+// dashTrack is a single representation of the presentation
+type dashTrack struct {
+	id    int // number of the track in segment names, unique over all periods
+	codec av.CodecData
+	muxer *fmp4Muxer
+	init  []byte
+	buf   bytes.Buffer
+}
+
+type dashSegment struct {
+	number   uint64
+	start    time.Duration
+	duration time.Duration
+	period   *dashPeriod
+	data     [][]byte // one fragment per track of the period
+}
+
+// NewDASHChannel creates a new DASH channel for the stream in que
+func NewDASHChannel(que *pubsub.Queue) (*DASHChannel, error) {
+	return NewDASHChannelWithConfig(que, DefaultHLSConfig())
+}
+
+// NewDASHChannelWithConfig creates a new DASH channel with the segment
+// duration, target duration and window size of the HLS configuration
+func NewDASHChannelWithConfig(que *pubsub.Queue, config HLSConfig) (*DASHChannel, error) {
+	if que == nil {
+		return nil, fmt.Errorf("queue cannot be nil")
+	}
+
+	maxDuration := config.TargetDuration
+	if maxDuration < config.SegmentDuration {
+		maxDuration = config.SegmentDuration
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	return &DASHChannel{
+		que:             que,
+		ctx:             ctx,
+		cancel:          cancel,
+		done:            make(chan struct{}),
+		segmentDuration: config.SegmentDuration,
+		maxDuration:     maxDuration,
+		maxSegments:     config.MaxSegments,
+		nextNumber:      1,
+	}, nil
+}
+
+// Start begins DASH segment generation
+func (d *DASHChannel) Start() error {
+	if d == nil {
+		return fmt.Errorf("DASH channel is nil")
+	}
+
+	go d.generateSegments()
+	return nil
+}
+
+// Close stops DASH segment generation
+func (d *DASHChannel) Close() {
+	if d == nil {
+		return
+	}
+	d.cancel()
+}
+
+// Done returns a channel that is closed once segment generation has finished
+func (d *DASHChannel) Done() <-chan struct{} {
+	if d == nil {
+		return nil
+	}
+	return d.done
+}
+
+// addDiscontinuity tells the segmenter the source of the stream changes at
+// the packet with the given time
+func (d *DASHChannel) addDiscontinuity(at time.Duration, streams []av.CodecData) {
+	if d == nil {
+		return
+	}
+
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	d.discontinuities = append(d.discontinuities, hlsDiscontinuity{at: at, streams: streams})
+}
+
+// nextDiscontinuity returns the source change the packet at t belongs to if
+// the segmenter hasn't seen it yet
+func (d *DASHChannel) nextDiscontinuity(t time.Duration) (hlsDiscontinuity, bool) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	var change hlsDiscontinuity
+	found := false
+	for len(d.discontinuities) > 0 && d.discontinuities[0].at <= t {
+		change, found = d.discontinuities[0], true
+		d.discontinuities = d.discontinuities[1:]
+	}
+	return change, found
+}
+
+// newPeriod creates the tracks of a period for the streams.  trackIdx maps
+// stream indexes to tracks, codecs fMP4 can't hold are left out.
+func (d *DASHChannel) newPeriod(streams []av.CodecData) (period *dashPeriod, trackIdx []int, videoIdx int) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	period = &dashPeriod{id: d.nextPeriod}
+	trackIdx = make([]int, len(streams))
+	videoIdx = -1
+	for i, stream := range streams {
+		trackIdx[i] = -1
+
+		muxer, err := newFMP4Muxer([]av.CodecData{stream})
+		if err != nil {
+			common.LogErrorf("Skipping stream %d for DASH: %v\n", i, err)
+			continue
+		}
+
+		trackIdx[i] = len(period.tracks)
+		period.tracks = append(period.tracks, &dashTrack{id: d.nextTrack, codec: stream, muxer: muxer, init: muxer.InitSegment()})
+		d.nextTrack++
+		if videoIdx < 0 && stream.Type().IsVideo() {
+			videoIdx = i
+		}
+	}
+
+	if len(period.tracks) == 0 {
+		return nil, nil, -1
+	}
+	d.nextPeriod++
+	return period, trackIdx, videoIdx
+}
+
+// generateSegments reads the stream and cuts it into segments on video
+// keyframes, the same way HLS segments are cut
+func (d *DASHChannel) generateSegments() {
+	defer close(d.done)
+	defer func() {
+		// A broken segment shouldn't take the whole server down
+		if r := recover(); r != nil {
+			common.LogErrorf("DASH segment generation stopped: %v\n", r)
+		}
+	}()
+
+	cursor := d.que.Latest()
+	streams, err := cursor.Streams()
+	if err != nil {
+		common.LogErrorf("Cannot read streams for DASH segments: %v\n", err)
+		return
+	}
+
+	period, trackIdx, videoIdx := d.newPeriod(streams)
+	if period == nil {
+		common.LogErrorf("No streams can be served over DASH\n")
+		return
+	}
+
+	started := false
+	var segmentStart, lastPacketTime time.Duration
+
+	for {
+		packet, err := cursor.ReadPacket()
+		if err != nil {
+			if err != io.EOF {
+				common.LogErrorf("Error reading from stream cursor: %v\n", err)
+			}
+			if started {
+				d.finalizeSegment(period, segmentStart, lastPacketTime)
+			}
+			return
+		}
+
+		select {
+		case <-d.ctx.Done():
+			return
+		default:
+		}
+
+		if change, ok := d.nextDiscontinuity(packet.Time); ok {
+			// The new source starts a new segment, and a new period if the codecs changed
+			if started {
+				d.finalizeSegment(period, segmentStart, packet.Time)
+				started = false
+			}
+
+			if len(change.streams) > 0 && !reflect.DeepEqual(change.streams, streams) {
+				common.LogInfof("[DASH] The codecs changed, starting a new period\n")
+				streams = change.streams
+				period, trackIdx, videoIdx = d.newPeriod(streams)
+				if period == nil {
+					common.LogErrorf("No streams can be served over DASH\n")
+					return
+				}
+			}
+		}
+
+		// The queue may be ahead of the segmenter with the streams of a new source
+		if int(packet.Idx) >= len(trackIdx) || trackIdx[packet.Idx] < 0 {
+			continue
+		}
+
+		isCutPoint := videoIdx < 0 || (int(packet.Idx) == videoIdx && packet.IsKeyFrame)
+		if !started {
+			// Every segment has to start with a keyframe
+			if !isCutPoint {
+				continue
+			}
+
+			started = true
+			segmentStart = packet.Time
+			d.mutex.Lock()
+			if d.startTime.IsZero() {
+				d.startTime = time.Now().Add(-packet.Time)
+			}
+			if len(d.periods) == 0 || d.periods[len(d.periods)-1] != period {
+				period.start = packet.Time
+				d.periods = append(d.periods, period)
+			}
+			d.mutex.Unlock()
+		} else if elapsed := packet.Time - segmentStart; (isCutPoint && elapsed >= d.segmentDuration) || elapsed >= d.maxDuration {
+			d.finalizeSegment(period, segmentStart, packet.Time)
+			segmentStart = packet.Time
+		}
+
+		pkt := packet
+		pkt.Idx = 0
+		err = period.tracks[trackIdx[packet.Idx]].muxer.WritePacket(pkt)
+		if err != nil {
+			common.LogErrorf("Error writing packet to DASH segment: %v\n", err)
+			continue
+		}
+		lastPacketTime = packet.Time
+	}
+}
+
+// finalizeSegment flushes the fragments of every track of the period and
+// adds them to the window as a new segment
+func (d *DASHChannel) finalizeSegment(period *dashPeriod, start, end time.Duration) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	segment := dashSegment{
+		number:   d.nextNumber,
+		start:    start,
+		duration: end - start,
+		period:   period,
+	}
+
+	for _, track := range period.tracks {
+		track.buf.Reset()
+		err := track.muxer.Flush(&track.buf)
+		if err != nil {
+			common.LogErrorf("Error flushing DASH segment: %v\n", err)
+		}
+
+		data := make([]byte, track.buf.Len())
+		copy(data, track.buf.Bytes())
+		segment.data = append(segment.data, data)
+	}
+
+	d.nextNumber++
+	d.segments = append(d.segments, segment)
+	if len(d.segments) > d.maxSegments {
+		d.segments = d.segments[len(d.segments)-d.maxSegments:]
+	}
+
+	// Periods without segments in the window are gone
+	for len(d.periods) > 1 && d.periods[0] != d.segments[0].period {
+		d.periods = d.periods[1:]
+	}
+
+	common.LogDebugf("Finalized DASH segment %d, duration %.2fs\n", segment.number, segment.duration.Seconds())
+}
+
+// GetSegment returns an init segment ("init_<track>.mp4") or a media segment
+// ("chunk_<track>_<number>.m4s") by its file name
+func (d *DASHChannel) GetSegment(name string) ([]byte, error) {
+	d.mutex.RLock()
+	defer d.mutex.RUnlock()
+
+	if m := dashInitPattern.FindStringSubmatch(name); m != nil {
+		id, _ := strconv.Atoi(m[1])
+		for _, period := range d.periods {
+			for _, track := range period.tracks {
+				if track.id == id {
+					return track.init, nil
+				}
+			}
+		}
+		return nil, fmt.Errorf("no DASH track %d", id)
+	}
+
+	m := dashChunkPattern.FindStringSubmatch(name)
+	if m == nil {
+		return nil, fmt.Errorf("invalid DASH segment name %q", name)
+	}
+
+	id, _ := strconv.Atoi(m[1])
+	number, _ := strconv.ParseUint(m[2], 10, 64)
+	for _, seg := range d.segments {
+		if seg.number != number {
+			continue
+		}
+		for i, track := range seg.period.tracks {
+			if track.id == id {
+				return seg.data[i], nil
+			}
+		}
+	}
+	return nil, fmt.Errorf("DASH segment %s not found", name)
+}
+
+// IsValidDASHSegmentName checks if name is a DASH init or media segment name
+func IsValidDASHSegmentName(name string) bool {
+	return dashInitPattern.MatchString(name) || dashChunkPattern.MatchString(name)
+}
+
+// GetManifest renders the live MPD of the current segment window, with a
+// period for each run of segments with the same codecs.  Segment URLs are
+// relative to the manifest.
+func (d *DASHChannel) GetManifest() (string, error) {
+	d.mutex.RLock()
+	defer d.mutex.RUnlock()
+
+	if len(d.segments) == 0 {
+		return "", errNoDASHSegments
+	}
+
+	var window time.Duration
+	for _, seg := range d.segments {
+		window += seg.duration
+	}
+
+	manifest := mpd{
+		Xmlns:                      "urn:mpeg:dash:schema:mpd:2011",
+		Profiles:                   "urn:mpeg:dash:profile:isoff-live:2011",
+		Type:                       "dynamic",
+		AvailabilityStartTime:      d.startTime.UTC().Format(time.RFC3339Nano),
+		PublishTime:                time.Now().UTC().Format(time.RFC3339Nano),
+		MinimumUpdatePeriod:        mpdDuration(d.segmentDuration / 2),
+		MinBufferTime:              mpdDuration(d.segmentDuration),
+		TimeShiftBufferDepth:       mpdDuration(window),
+		SuggestedPresentationDelay: mpdDuration(3 * d.segmentDuration),
+	}
+
+	for first := 0; first < len(d.segments); {
+		period := d.segments[first].period
+		last := first + 1
+		for last < len(d.segments) && d.segments[last].period == period {
+			last++
+		}
+		manifest.Periods = append(manifest.Periods, period.mpd(d.segments[first:last]))
+		first = last
+	}
+
+	out, err := xml.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal MPD: %w", err)
+	}
+	return xml.Header + string(out) + "\n", nil
+}
+
+// mpd renders the period with its segments in the window
+func (p *dashPeriod) mpd(segments []dashSegment) mpdPeriod {
+	var duration time.Duration
+	for _, seg := range segments {
+		duration += seg.duration
+	}
+
+	period := mpdPeriod{
+		ID:    strconv.Itoa(p.id),
+		Start: mpdDuration(p.start),
+	}
+
+	for i, track := range p.tracks {
+		timeScale := track.muxer.tracks[0].timeScale
+
+		var size int
+		template := mpdSegmentTemplate{
+			Timescale:              timeScale,
+			PresentationTimeOffset: int64(p.start) * timeScale / int64(time.Second),
+			Initialization:         fmt.Sprintf("init_%d.mp4", track.id),
+			Media:                  fmt.Sprintf("chunk_%d_$Number$.m4s", track.id),
+			StartNumber:            segments[0].number,
+		}
+		for _, seg := range segments {
+			start := int64(seg.start) * timeScale / int64(time.Second)
+			end := int64(seg.start+seg.duration) * timeScale / int64(time.Second)
+			template.Timeline = append(template.Timeline, mpdS{T: start, D: end - start})
+			size += len(seg.data[i])
+		}
+
+		rep := mpdRepresentation{
+			ID:              strconv.Itoa(track.id),
+			Bandwidth:       1,
+			SegmentTemplate: template,
+		}
+		if seconds := duration.Seconds(); seconds > 0 && size > 0 {
+			rep.Bandwidth = int(float64(size*8) / seconds)
+		}
+
+		set := mpdAdaptationSet{
+			MimeType:         "video/mp4",
+			ContentType:      "video",
+			SegmentAlignment: true,
+			StartWithSAP:     1,
+		}
+
+		rep.Codecs = rfc6381Codec(track.codec)
+		switch codec := track.codec.(type) {
+		case h264parser.CodecData:
+			rep.Width = codec.Width()
+			rep.Height = codec.Height()
+		case aacparser.CodecData:
+			set.MimeType = "audio/mp4"
+			set.ContentType = "audio"
+			rep.AudioSamplingRate = codec.SampleRate()
+		}
+
+		set.Representation = rep
+		period.AdaptationSets = append(period.AdaptationSets, set)
+	}
+	return period
+}
+
+// mpdDuration formats a duration as an xs:duration
+func mpdDuration(d time.Duration) string {
+	return fmt.Sprintf("PT%.3fS", d.Seconds())
+}
+
+// The parts of the MPD schema used for live fMP4 streams
+
+type mpd struct {
+	XMLName                    xml.Name    `xml:"MPD"`
+	Xmlns                      string      `xml:"xmlns,attr"`
+	Profiles                   string      `xml:"profiles,attr"`
+	Type                       string      `xml:"type,attr"`
+	AvailabilityStartTime      string      `xml:"availabilityStartTime,attr"`
+	PublishTime                string      `xml:"publishTime,attr"`
+	MinimumUpdatePeriod        string      `xml:"minimumUpdatePeriod,attr"`
+	MinBufferTime              string      `xml:"minBufferTime,attr"`
+	TimeShiftBufferDepth       string      `xml:"timeShiftBufferDepth,attr"`
+	SuggestedPresentationDelay string      `xml:"suggestedPresentationDelay,attr"`
+	Periods                    []mpdPeriod `xml:"Period"`
+}
+
+type mpdPeriod struct {
+	ID             string             `xml:"id,attr"`
+	Start          string             `xml:"start,attr"`
+	AdaptationSets []mpdAdaptationSet `xml:"AdaptationSet"`
+}
+
+type mpdAdaptationSet struct {
+	ContentType      string            `xml:"contentType,attr"`
+	MimeType         string            `xml:"mimeType,attr"`
+	SegmentAlignment bool              `xml:"segmentAlignment,attr"`
+	StartWithSAP     int               `xml:"startWithSAP,attr"`
+	Representation   mpdRepresentation `xml:"Representation"`
+}
+
+type mpdRepresentation struct {
+	ID                string             `xml:"id,attr"`
+	Codecs            string             `xml:"codecs,attr"`
+	Bandwidth         int                `xml:"bandwidth,attr"`
+	Width             int                `xml:"width,attr,omitempty"`
+	Height            int                `xml:"height,attr,omitempty"`
+	AudioSamplingRate int                `xml:"audioSamplingRate,attr,omitempty"`
+	SegmentTemplate   mpdSegmentTemplate `xml:"SegmentTemplate"`
+}
+
+type mpdSegmentTemplate struct {
+	Timescale              int64  `xml:"timescale,attr"`
+	PresentationTimeOffset int64  `xml:"presentationTimeOffset,attr,omitempty"`
+	Initialization         string `xml:"initialization,attr"`
+	Media                  string `xml:"media,attr"`
+	StartNumber            uint64 `xml:"startNumber,attr"`
+	Timeline               []mpdS `xml:"SegmentTimeline>S"`
+}
+
+type mpdS struct {
+	T int64 `xml:"t,attr"`
+	D int64 `xml:"d,attr"`
+}
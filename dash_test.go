@@ -0,0 +1,195 @@
+package main
+
+import (
+	"encoding/xml"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/nareix/joy4/av"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/zorchenhimer/MovieNight/common"
+)
+
+func TestDetectDeviceCapabilities_SmartTV(t *testing.T) {
+	tests := []struct {
+		name      string
+		userAgent string
+		smartTV   bool
+	}{
+		{"Samsung Tizen", "Mozilla/5.0 (SMART-TV; LINUX; Tizen 6.0) AppleWebKit/537.36 (KHTML, like Gecko) 76.0.3809.146/6.0 TV Safari/537.36", true},
+		{"LG webOS", "Mozilla/5.0 (Web0S; Linux/SmartTV) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/79.0.3945.79 Safari/537.36 WebAppManager", true},
+		{"Fire TV", "Mozilla/5.0 (Linux; Android 9; AFTMM Build/PS7233) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/70.0.3538.110 Mobile Safari/537.36", true},
+		{"Chromecast", "Mozilla/5.0 (X11; Linux armv7l) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/91.0.4472.225 Safari/537.36 CrKey/1.56.500000", true},
+		{"Android phone", "Mozilla/5.0 (Linux; Android 11; SM-G991B) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/93.0.4577.62 Mobile Safari/537.36", false},
+		{"Desktop Chrome", "Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/93.0.4577.63 Safari/537.36", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/live", nil)
+			req.Header.Set("User-Agent", tt.userAgent)
+
+			capabilities := DetectDeviceCapabilities(req)
+			assert.Equal(t, tt.smartTV, capabilities.IsSmartTV)
+			assert.Equal(t, tt.smartTV, capabilities.SupportsDASH)
+			if tt.smartTV {
+				assert.Equal(t, "dash", capabilities.PreferredCodec)
+			}
+		})
+	}
+}
+
+func TestNewDASHChannelWithConfig(t *testing.T) {
+	config := DefaultHLSConfig()
+	config.SegmentDuration = 6 * time.Second
+	config.TargetDuration = 2 * time.Second
+	config.MaxSegments = 10
+
+	dashChan, err := NewDASHChannelWithConfig(newTestQueue(t, av.H264), config)
+	require.NoError(t, err)
+	defer dashChan.Close()
+
+	assert.Equal(t, 6*time.Second, dashChan.segmentDuration)
+	assert.Equal(t, 6*time.Second, dashChan.maxDuration, "segments can get as long as the segment duration")
+	assert.Equal(t, 10, dashChan.maxSegments)
+}
+
+func TestIsValidDASHSegmentName(t *testing.T) {
+	assert.True(t, IsValidDASHSegmentName("init_0.mp4"))
+	assert.True(t, IsValidDASHSegmentName("chunk_1_42.m4s"))
+	assert.False(t, IsValidDASHSegmentName("chunk_1.m4s"))
+	assert.False(t, IsValidDASHSegmentName("../init_0.mp4"))
+	assert.False(t, IsValidDASHSegmentName("manifest.mpd"))
+}
+
+func TestDASHChannel_Manifest(t *testing.T) {
+	common.SetupLogging(common.LLError, "/dev/null")
+
+	queue := newTestQueue(t, av.H264)
+	queue.SetMaxGopCount(100)
+
+	dashChan, err := NewDASHChannel(queue)
+	require.NoError(t, err)
+	defer dashChan.Close()
+	dashChan.segmentDuration = time.Second
+
+	_, err = dashChan.GetManifest()
+	assert.ErrorIs(t, err, errNoDASHSegments)
+
+	require.NoError(t, dashChan.Start())
+	time.Sleep(50 * time.Millisecond)
+
+	for i := 0; i <= 25; i++ {
+		err = queue.WritePacket(av.Packet{
+			Time:       time.Duration(i) * 100 * time.Millisecond,
+			IsKeyFrame: i%10 == 0,
+			Data:       []byte{0x00, 0x00, 0x00, 0x02, 0x09, 0xf0},
+		})
+		require.NoError(t, err)
+	}
+	queue.Close()
+	waitForDone(t, dashChan.Done())
+
+	assert.Eventually(t, func() bool {
+		dashChan.mutex.RLock()
+		defer dashChan.mutex.RUnlock()
+		return len(dashChan.segments) == 3
+	}, 2*time.Second, 10*time.Millisecond, "segments should be generated")
+
+	manifest, err := dashChan.GetManifest()
+	require.NoError(t, err)
+
+	var parsed mpd
+	require.NoError(t, xml.Unmarshal([]byte(manifest), &parsed))
+	assert.Equal(t, "dynamic", parsed.Type)
+	require.Len(t, parsed.Periods, 1)
+	require.Len(t, parsed.Periods[0].AdaptationSets, 1)
+
+	rep := parsed.Periods[0].AdaptationSets[0].Representation
+	assert.Equal(t, "avc1.42c01e", rep.Codecs)
+	assert.Equal(t, "init_0.mp4", rep.SegmentTemplate.Initialization)
+	assert.Equal(t, "chunk_0_$Number$.m4s", rep.SegmentTemplate.Media)
+	assert.Equal(t, uint64(1), rep.SegmentTemplate.StartNumber)
+	assert.Equal(t, []mpdS{{T: 0, D: 90000}, {T: 90000, D: 90000}, {T: 180000, D: 45000}}, rep.SegmentTemplate.Timeline)
+
+	init, err := dashChan.GetSegment("init_0.mp4")
+	require.NoError(t, err)
+	assert.Equal(t, "ftyp", string(init[4:8]))
+
+	chunk, err := dashChan.GetSegment("chunk_0_2.m4s")
+	require.NoError(t, err)
+	assert.Equal(t, "moof", string(chunk[4:8]))
+
+	_, err = dashChan.GetSegment("chunk_0_9.m4s")
+	assert.Error(t, err)
+	_, err = dashChan.GetSegment("init_3.mp4")
+	assert.Error(t, err)
+}
+
+func TestDASHChannel_NewSourcePeriod(t *testing.T) {
+	common.SetupLogging(common.LLError, "/dev/null")
+
+	queue := newTestQueue(t, av.H264)
+	queue.SetMaxGopCount(100)
+	audio := testStreams(t, av.AAC)
+
+	dashChan, err := NewDASHChannel(queue)
+	require.NoError(t, err)
+	defer dashChan.Close()
+	dashChan.segmentDuration = time.Second
+
+	require.NoError(t, dashChan.Start())
+	time.Sleep(50 * time.Millisecond)
+
+	for i := 0; i < 20; i++ {
+		require.NoError(t, queue.WritePacket(av.Packet{
+			Time:       time.Duration(i) * 100 * time.Millisecond,
+			IsKeyFrame: i%10 == 0,
+			Data:       []byte{0x00, 0x00, 0x00, 0x02, 0x09, 0xf0},
+		}))
+	}
+
+	// A source with two streams where the old one had one
+	streams := append([]av.CodecData{audio[0]}, audio...)
+	dashChan.addDiscontinuity(2*time.Second, streams)
+	require.NoError(t, queue.WriteHeader(streams))
+	for i := 20; i < 40; i++ {
+		require.NoError(t, queue.WritePacket(av.Packet{
+			Idx:  int8(i % 2),
+			Time: time.Duration(i) * 100 * time.Millisecond,
+			Data: []byte{0x21, 0x00, 0x49, 0x90, 0x02, 0x19},
+		}))
+	}
+	queue.Close()
+	waitForDone(t, dashChan.Done())
+
+	require.Eventually(t, func() bool {
+		dashChan.mutex.RLock()
+		defer dashChan.mutex.RUnlock()
+		return len(dashChan.segments) == 4
+	}, 2*time.Second, 10*time.Millisecond, "segments should be generated")
+
+	manifest, err := dashChan.GetManifest()
+	require.NoError(t, err)
+
+	var parsed mpd
+	require.NoError(t, xml.Unmarshal([]byte(manifest), &parsed))
+	require.Len(t, parsed.Periods, 2, "the new codecs start a new period")
+	require.Len(t, parsed.Periods[1].AdaptationSets, 2)
+	assert.Equal(t, "PT2.000S", parsed.Periods[1].Start)
+
+	template := parsed.Periods[1].AdaptationSets[1].Representation.SegmentTemplate
+	assert.Equal(t, "init_2.mp4", template.Initialization)
+	assert.Equal(t, uint64(3), template.StartNumber)
+	assert.Equal(t, int64(2*44100), template.PresentationTimeOffset)
+
+	_, err = dashChan.GetSegment("init_0.mp4")
+	assert.NoError(t, err, "the old period is still in the window")
+	chunk, err := dashChan.GetSegment("chunk_2_3.m4s")
+	require.NoError(t, err)
+	assert.Equal(t, "moof", string(chunk[4:8]))
+	_, err = dashChan.GetSegment("chunk_0_3.m4s")
+	assert.Error(t, err)
+}
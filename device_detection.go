@@ -9,9 +9,11 @@ import (
 // DeviceCapabilities represents the streaming capabilities of a device
 type DeviceCapabilities struct {
 	SupportsHLS    bool
+	SupportsDASH   bool
 	IsMobile       bool
 	IsIOS          bool
 	IsAndroid      bool
+	IsSmartTV      bool
 	UserAgent      string
 	PreferredCodec string
 }
@@ -32,6 +34,20 @@ var androidPatterns = []*regexp.Regexp{
 	regexp.MustCompile(`(?i)android`),
 }
 
+// Smart TV and set-top box patterns.  Their players handle DASH better than
+// HLS or HTTP-FLV.
+var smartTVPatterns = []*regexp.Regexp{
+	regexp.MustCompile(`(?i)smart-?tv`),
+	regexp.MustCompile(`(?i)tizen`),
+	regexp.MustCompile(`(?i)web0s|webos`),
+	regexp.MustCompile(`(?i)hbbtv`),
+	regexp.MustCompile(`(?i)netcast`),
+	regexp.MustCompile(`(?i)bravia`),
+	regexp.MustCompile(`(?i)roku`),
+	regexp.MustCompile(`(?i)crkey`),
+	regexp.MustCompile(`(?i)android tv|\bAFT[A-Z]`),
+}
+
 // Mobile device patterns
 var mobilePatterns = []*regexp.Regexp{
 	regexp.MustCompile(`(?i)mobile`),
@@ -96,6 +112,17 @@ func DetectDeviceCapabilities(r *http.Request) DeviceCapabilities {
 		capabilities.PreferredCodec = "flv"
 	}
 
+	// Detect smart TVs and set-top boxes, which are routed to DASH.  Some of
+	// them run Android, so this overrides the platform detection above.
+	for _, pattern := range smartTVPatterns {
+		if pattern.MatchString(userAgent) {
+			capabilities.IsSmartTV = true
+			capabilities.SupportsDASH = true
+			capabilities.PreferredCodec = "dash"
+			break
+		}
+	}
+
 	// Detect mobile devices -- we'll adjust quality settings based on this
 	for _, pattern := range mobilePatterns {
 		if pattern.MatchString(userAgent) {
@@ -155,7 +182,10 @@ func IsHLSSegmentRequest(r *http.Request) bool {
 	}
 
 	path := strings.ToLower(r.URL.Path)
-	return strings.HasSuffix(path, ".ts") && strings.Contains(path, "segment")
+	if strings.HasSuffix(path, ".mp4") && strings.Contains(path, "init_") {
+		return true
+	}
+	return (strings.HasSuffix(path, ".ts") || strings.HasSuffix(path, ".m4s")) && strings.Contains(path, "segment")
 }
 
 // GetContentTypeForFormat returns the appropriate Content-Type header for the format
@@ -163,8 +193,14 @@ func GetContentTypeForFormat(format string) string {
 	switch format {
 	case "hls":
 		return "application/vnd.apple.mpegurl"
+	case "dash":
+		return "application/dash+xml"
 	case "ts":
 		return "video/mp2t"
+	case "m4s":
+		return "video/iso.segment"
+	case "mp4":
+		return "video/mp4"
 	default:
 		return "video/x-flv"
 	}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"time"
+
+	"github.com/Eyevinn/hls-m3u8/m3u8"
+	"github.com/zorchenhimer/MovieNight/common"
+)
+
+// dvrSegment is a segment in the DVR window.  Only the newest segments are
+// kept in memory, the rest is read back from disk when somebody rewinds.
+type dvrSegment struct {
+	HLSSegment // Data is nil once the segment is on disk
+	file       string
+}
+
+// dvrStore keeps the segments of the last window of a stream.  Its memory use
+// only depends on memSegments, not on the length of the window.  The caller is
+// expected to hold the mutex of the HLSChannel.
+type dvrStore struct {
+	dir         string
+	window      time.Duration
+	memSegments int
+
+	segments         []dvrSegment
+	duration         float64 // seconds in segments
+	discontinuitySeq uint64  // discontinuities that left the window
+}
+
+func newDVRStore(parent string, window time.Duration, memSegments int) (*dvrStore, error) {
+	err := os.MkdirAll(parent, 0755)
+	if err != nil {
+		return nil, fmt.Errorf("could not create DVR directory: %w", err)
+	}
+
+	dir, err := os.MkdirTemp(parent, "dvr-")
+	if err != nil {
+		return nil, fmt.Errorf("could not create DVR directory: %w", err)
+	}
+
+	return &dvrStore{dir: dir, window: window, memSegments: memSegments}, nil
+}
+
+// dvrWrites are the disk changes an add leaves to be done once the mutex of
+// the HLSChannel is released, so a slow disk doesn't hold up the viewers
+type dvrWrites struct {
+	spill  []dvrSegment // segments to move from memory to disk
+	remove []string     // files of segments that left the window
+}
+
+// add puts a new segment in the window and drops the ones that fell out of
+// it.  The older segments that go to disk are returned for write.
+func (d *dvrStore) add(segment HLSSegment) dvrWrites {
+	segment.Parts = nil
+	d.segments = append(d.segments, dvrSegment{HLSSegment: segment})
+	d.duration += segment.Duration
+
+	var writes dvrWrites
+	drop := 0
+	for drop < len(d.segments)-1 && d.duration-d.segments[drop].Duration >= d.window.Seconds() {
+		d.duration -= d.segments[drop].Duration
+		if d.segments[drop].Discontinuity {
+			d.discontinuitySeq++
+		}
+		if d.segments[drop].file != "" {
+			writes.remove = append(writes.remove, d.segments[drop].file)
+		}
+		drop++
+	}
+	if drop > 0 {
+		d.segments = append([]dvrSegment(nil), d.segments[drop:]...)
+	}
+
+	if spill := len(d.segments) - 1 - d.memSegments; spill >= 0 && d.segments[spill].Data != nil {
+		segment := d.segments[spill]
+		segment.file = filepath.Join(d.dir, path.Base(segment.URI))
+		writes.spill = append(writes.spill, segment)
+	}
+	return writes
+}
+
+// write does the disk changes of an add.  The caller must not hold the mutex
+// of the HLSChannel.  A segment that can't be written has its file cleared,
+// it is dropped from memory anyway.
+func (d *dvrStore) write(writes dvrWrites) {
+	for i, segment := range writes.spill {
+		err := os.WriteFile(segment.file, segment.Data, 0644)
+		if err != nil {
+			common.LogErrorf("[DVR] Could not write segment %s: %v\n", segment.URI, err)
+			writes.spill[i].file = ""
+		}
+	}
+
+	for _, file := range writes.remove {
+		d.remove(file)
+	}
+}
+
+// spilled drops the segments that were written from memory.  The files of
+// the ones that left the window in the meantime are returned to be removed.
+// The caller is expected to hold the mutex of the HLSChannel.
+func (d *dvrStore) spilled(writes dvrWrites) []string {
+	leftover := []string{}
+	for _, written := range writes.spill {
+		found := false
+		for i := range d.segments {
+			if d.segments[i].URI == written.URI {
+				d.segments[i].file = written.file
+				d.segments[i].Data = nil
+				found = true
+				break
+			}
+		}
+		if !found && written.file != "" {
+			leftover = append(leftover, written.file)
+		}
+	}
+	return leftover
+}
+
+func (d *dvrStore) remove(file string) {
+	err := os.Remove(file)
+	if err != nil {
+		common.LogErrorf("[DVR] Could not remove segment %s: %v\n", file, err)
+	}
+}
+
+// get returns the data of a segment in the window
+func (d *dvrStore) get(uri string) ([]byte, bool) {
+	for _, segment := range d.segments {
+		if segment.URI != uri {
+			continue
+		}
+		if segment.Data != nil {
+			return segment.Data, true
+		}
+		if segment.file == "" {
+			return nil, false
+		}
+
+		data, err := os.ReadFile(segment.file)
+		if err != nil {
+			common.LogErrorf("[DVR] Could not read segment %s: %v\n", segment.file, err)
+			return nil, false
+		}
+		return data, true
+	}
+	return nil, false
+}
+
+// playlist lists the whole window as a sliding window playlist.  initURI is
+// the EXT-X-MAP while the window is empty.
+func (d *dvrStore) playlist(version uint8, initURI string) (*m3u8.MediaPlaylist, error) {
+	size := uint(len(d.segments))
+	if size == 0 {
+		size = 1
+	}
+
+	playlist, err := m3u8.NewMediaPlaylist(size, size)
+	if err != nil {
+		return nil, err
+	}
+	playlist.SetVersion(version)
+	playlist.Closed = false
+	playlist.DiscontinuitySeq = d.discontinuitySeq
+	if len(d.segments) > 0 {
+		playlist.SeqNo = d.segments[0].Sequence
+		initURI = d.segments[0].InitURI
+	}
+	if initURI != "" {
+		playlist.SetDefaultMap(initURI, 0, 0)
+	}
+
+	for _, segment := range d.segments {
+		err = appendSegment(playlist, segment.HLSSegment)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return playlist, nil
+}
+
+// close removes the segments on disk
+func (d *dvrStore) close() {
+	err := os.RemoveAll(d.dir)
+	if err != nil {
+		common.LogErrorf("[DVR] Could not remove %s: %v\n", d.dir, err)
+	}
+	d.segments = nil
+}
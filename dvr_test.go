@@ -0,0 +1,95 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nareix/joy4/av"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/zorchenhimer/MovieNight/common"
+)
+
+func TestHLSChannel_DVR(t *testing.T) {
+	common.SetupLogging(common.LLError, "/dev/null")
+
+	config := DefaultHLSConfig()
+	config.EnableLowLatency = false
+	config.MaxSegments = 2
+	config.DVRWindow = 20 * time.Second
+	config.DVRDir = t.TempDir()
+	hlsChan, err := NewHLSChannelWithConfig(newTestQueue(t, av.AAC), config)
+	require.NoError(t, err)
+	dir := hlsChan.dvr.dir
+
+	uri := func(i int) string {
+		return fmt.Sprintf("/live/segment_%d.ts", i)
+	}
+	for i := 0; i < 10; i++ {
+		hlsChan.addGeneratedSegment(HLSSegment{URI: uri(i), Duration: 4, Data: []byte{byte(i)}, Sequence: uint64(i), Discontinuity: i == 2 || i == 7})
+	}
+
+	// The playlist has the whole window, not just MaxSegments
+	playlist := hlsChan.GetPlaylist()
+	assert.Contains(t, playlist, "#EXT-X-MEDIA-SEQUENCE:5")
+	assert.NotContains(t, playlist, "#EXT-X-PLAYLIST-TYPE", "old segments leave the window, so it can't be an EVENT playlist")
+	assert.Equal(t, 5, strings.Count(playlist, "#EXTINF"))
+	assert.Contains(t, playlist, uri(5))
+	assert.NotContains(t, playlist, uri(4))
+	assert.Contains(t, playlist, "#EXT-X-DISCONTINUITY-SEQUENCE:1", "one discontinuity left the window")
+	assert.Equal(t, 1, strings.Count(playlist, "#EXT-X-DISCONTINUITY\n"))
+
+	// Only the newest segments are in memory
+	files, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	assert.Len(t, files, 3)
+
+	data, err := hlsChan.GetSegmentByURI(uri(5))
+	require.NoError(t, err, "rewinding reads the segment from disk")
+	assert.Equal(t, []byte{5}, data)
+	data, err = hlsChan.GetSegmentByURI(uri(9))
+	require.NoError(t, err)
+	assert.Equal(t, []byte{9}, data)
+	_, err = hlsChan.GetSegmentByURI(uri(4))
+	assert.Error(t, err, "segments out of the window are gone")
+
+	hlsChan.Close()
+	_, err = os.Stat(dir)
+	assert.True(t, os.IsNotExist(err), "closing removes the segments on disk")
+}
+
+func TestDVRStore_WritesLater(t *testing.T) {
+	common.SetupLogging(common.LLError, "/dev/null")
+
+	d, err := newDVRStore(t.TempDir(), 8*time.Second, 1)
+	require.NoError(t, err)
+	defer d.close()
+
+	d.add(HLSSegment{URI: "/live/segment_0.ts", Duration: 4, Data: []byte{0}})
+	writes := d.add(HLSSegment{URI: "/live/segment_1.ts", Duration: 4, Data: []byte{1}})
+	require.Len(t, writes.spill, 1)
+
+	// Nothing is on disk until the writes are done
+	files, err := os.ReadDir(d.dir)
+	require.NoError(t, err)
+	assert.Empty(t, files)
+	data, ok := d.get("/live/segment_0.ts")
+	require.True(t, ok, "the segment is served from memory until it is written")
+	assert.Equal(t, []byte{0}, data)
+
+	d.write(writes)
+	assert.Empty(t, d.spilled(writes))
+	assert.Nil(t, d.segments[0].Data)
+	data, ok = d.get("/live/segment_0.ts")
+	require.True(t, ok)
+	assert.Equal(t, []byte{0}, data)
+
+	// A segment that left the window before it was written is removed again
+	writes = d.add(HLSSegment{URI: "/live/segment_2.ts", Duration: 4, Data: []byte{2}})
+	d.write(writes)
+	d.segments = d.segments[1:]
+	assert.Len(t, d.spilled(writes), 1)
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/nareix/joy4/av"
+	"github.com/zorchenhimer/MovieNight/common"
+)
+
+// fallbackPlayer loops a "be right back" file into a channel while the
+// channel is waiting for its publisher to come back
+type fallbackPlayer struct {
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// waitForPublisher keeps the channel alive after its publisher dropped.  The
+// fallback file is played until the same stream key publishes again or the
+// grace period runs out, at which point the channel is closed.  Caller must
+// hold the l lock.
+func (ch *Channel) waitForPublisher(streamName string, grace time.Duration) {
+	ch.waiting = true
+	ch.waitGen++
+	gen := ch.waitGen
+
+	if settings.FallbackFile != "" {
+		ch.startFallback(settings.FallbackFile)
+	}
+
+	common.LogInfof("Waiting %v for the publisher of %s to reconnect\n", grace, streamName)
+	groupModNotice(groupName(streamName), fmt.Sprintf("Publisher of %s disconnected, waiting %v for it to reconnect", streamName, grace))
+
+	time.AfterFunc(grace, func() {
+		l.Lock()
+		defer l.Unlock()
+
+		// The publisher came back, or the channel went away some other way
+		if !ch.waiting || ch.waitGen != gen || channels[streamName] != ch {
+			return
+		}
+
+		common.LogInfof("Publisher of %s did not reconnect, closing the stream\n", streamName)
+		groupModNotice(groupName(streamName), fmt.Sprintf("Publisher of %s did not reconnect, the stream has ended", streamName))
+
+		endChannel(streamName, ch)
+	})
+}
+
+// resumePublisher hands a waiting channel over to a reconnected publisher.
+// Viewers stay connected and continue with the new publisher's packets.
+// Caller must hold the l lock.
+func (ch *Channel) resumePublisher(streamName string, streams []av.CodecData) error {
+	ch.stopFallback()
+
+	// The channel keeps waiting for a publisher it can take
+	err := ch.checkCodecs(streams)
+	if err != nil {
+		if settings.FallbackFile != "" {
+			ch.startFallback(settings.FallbackFile)
+		}
+		return err
+	}
+	ch.waiting = false
+
+	groupModNotice(groupName(streamName), fmt.Sprintf("Publisher of %s reconnected, the stream has resumed", streamName))
+	return ch.writeHeader(streams)
+}
+
+// startFallback starts looping the given file into the channel
+func (ch *Channel) startFallback(path string) {
+	ctx, cancel := context.WithCancel(context.Background())
+	fp := &fallbackPlayer{
+		cancel: cancel,
+		done:   make(chan struct{}),
+	}
+	ch.fallback = fp
+
+	go func() {
+		defer close(fp.done)
+		for {
+			err := ch.playFallback(ctx, path)
+			if err != nil {
+				common.LogErrorf("[fallback] Could not play %s: %v\n", path, err)
+				return
+			}
+
+			select {
+			case <-ctx.Done():
+				return
+			default:
+			}
+		}
+	}()
+}
+
+// stopFallback stops the fallback file and waits for it to finish writing
+// to the channel.  It's safe to call when nothing is playing.
+func (ch *Channel) stopFallback() {
+	if ch.fallback == nil {
+		return
+	}
+
+	ch.fallback.cancel()
+	<-ch.fallback.done
+	ch.fallback = nil
+}
+
+// playFallback plays the file once into the channel in real time
+func (ch *Channel) playFallback(ctx context.Context, path string) error {
+	demuxer, err := openLibraryFile(path)
+	if err != nil {
+		return fmt.Errorf("could not open file: %w", err)
+	}
+	defer demuxer.Close()
+
+	streams, err := demuxer.Streams()
+	if err != nil {
+		return fmt.Errorf("could not read streams: %w", err)
+	}
+
+	err = ch.writeHeader(streams)
+	if err != nil {
+		return fmt.Errorf("could not write header: %w", err)
+	}
+
+	start := time.Now()
+	for count := 0; ; count++ {
+		packet, err := demuxer.ReadPacket()
+		if err != nil {
+			if err == io.EOF && count > 0 {
+				return nil
+			} else if err == io.EOF {
+				return fmt.Errorf("file has no packets")
+			}
+			return fmt.Errorf("could not read packet: %w", err)
+		}
+
+		if wait := packet.Time - time.Since(start); wait > 0 {
+			select {
+			case <-ctx.Done():
+				return nil
+			case <-time.After(wait):
+			}
+		}
+
+		err = ch.WritePacket(packet)
+		if err != nil {
+			return fmt.Errorf("could not write packet: %w", err)
+		}
+	}
+}
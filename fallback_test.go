@@ -0,0 +1,106 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/nareix/joy4/av"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/zorchenhimer/MovieNight/common"
+)
+
+func TestTimeline_Adjust(t *testing.T) {
+	tl := &timeline{restart: true}
+
+	// The first source starts at zero no matter where its timestamps begin
+	assert.Equal(t, time.Duration(0), tl.adjust(av.Packet{Time: 5 * time.Second}).Time)
+	assert.Equal(t, time.Second, tl.adjust(av.Packet{Time: 6 * time.Second}).Time)
+
+	// A new source continues right after the last packet
+	tl.restart = true
+	assert.Equal(t, time.Second+10*time.Millisecond, tl.adjust(av.Packet{Time: 0}).Time)
+	assert.Equal(t, 2*time.Second+10*time.Millisecond, tl.adjust(av.Packet{Time: time.Second}).Time)
+}
+
+func TestChannel_GracePeriodResume(t *testing.T) {
+	common.SetupLogging(common.LLError, "/dev/null")
+
+	fallback := filepath.Join(t.TempDir(), "brb.flv")
+	writeTestFLV(t, fallback, 10)
+	settings = &Settings{TitleLength: 50, FallbackFile: fallback}
+
+	streams := testStreams(t, av.AAC)
+
+	l.Lock()
+	ch := newChannel("grace-test", streams)
+	channels["grace-test"] = ch
+	require.NoError(t, ch.WritePacket(av.Packet{Time: 0, Data: []byte{0x21}}))
+	ch.waitForPublisher("grace-test", 100*time.Millisecond)
+	assert.NotNil(t, ch.fallback, "fallback file should be playing")
+	l.Unlock()
+
+	// The publisher comes back before the grace period is over
+	l.Lock()
+	require.NoError(t, ch.resumePublisher("grace-test", streams))
+	assert.False(t, ch.waiting)
+	assert.Nil(t, ch.fallback, "fallback should stop when the publisher returns")
+	l.Unlock()
+
+	time.Sleep(200 * time.Millisecond)
+
+	_, found, err := findChannel("grace-test")
+	require.NoError(t, err, "channel should survive the grace period after resuming")
+	assert.Equal(t, ch, found)
+
+	l.Lock()
+	delete(channels, "grace-test")
+	ch.close()
+	l.Unlock()
+	waitForDone(t, channelDone(ch)...)
+}
+
+func TestChannel_GracePeriodExpires(t *testing.T) {
+	common.SetupLogging(common.LLError, "/dev/null")
+	settings = &Settings{TitleLength: 50}
+
+	streams := testStreams(t, av.AAC)
+
+	l.Lock()
+	ch := newChannel("grace-test", streams)
+	channels["grace-test"] = ch
+	ch.waitForPublisher("grace-test", 50*time.Millisecond)
+	l.Unlock()
+
+	assert.Eventually(t, func() bool {
+		_, _, err := findChannel("grace-test")
+		return err != nil
+	}, time.Second, 10*time.Millisecond, "channel should be removed after the grace period")
+	waitForDone(t, channelDone(ch)...)
+}
+
+func TestChannel_ResumeOtherCodecs(t *testing.T) {
+	common.SetupLogging(common.LLError, "/dev/null")
+	settings = &Settings{TitleLength: 50}
+
+	streams := testStreams(t, av.AAC)
+	video := testStreams(t, av.H264)
+
+	l.Lock()
+	ch := newChannel("codecs-test", streams)
+	defer func() {
+		ch.close()
+		l.Unlock()
+		waitForDone(t, channelDone(ch)...)
+	}()
+	ch.waitForPublisher("codecs-test", time.Minute)
+
+	err := ch.resumePublisher("codecs-test", video)
+	assert.ErrorIs(t, err, errCodecsChanged)
+	assert.True(t, ch.waiting, "the channel keeps waiting for its publisher")
+	assert.ErrorIs(t, ch.writeHeader(append(streams, video...)), errCodecsChanged)
+
+	require.NoError(t, ch.resumePublisher("codecs-test", streams))
+	assert.False(t, ch.waiting)
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/nareix/joy4/av"
+	"github.com/nareix/joy4/av/pubsub"
+	"github.com/nareix/joy4/codec/aacparser"
+	"github.com/nareix/joy4/codec/h264parser"
+	"github.com/stretchr/testify/require"
+)
+
+// testStreams returns codec data for streams of the given types, 320x240
+// H264 and 44.1kHz stereo AAC
+func testStreams(t *testing.T, types ...av.CodecType) []av.CodecData {
+	t.Helper()
+
+	var streams []av.CodecData
+	for _, typ := range types {
+		switch typ {
+		case av.H264:
+			sps := []byte{0x67, 0x42, 0xc0, 0x1e, 0xda, 0x02, 0x80, 0xbf, 0xe5, 0x84, 0x00, 0x00, 0x03, 0x00,
+				0x04, 0x00, 0x00, 0x03, 0x00, 0xf0, 0x3c, 0x58, 0xba, 0x80}
+			pps := []byte{0x68, 0xce, 0x3c, 0x80}
+			codec, err := h264parser.NewCodecDataFromSPSAndPPS(sps, pps)
+			require.NoError(t, err)
+			streams = append(streams, codec)
+		case av.AAC:
+			codec, err := aacparser.NewCodecDataFromMPEG4AudioConfigBytes([]byte{0x12, 0x10})
+			require.NoError(t, err)
+			streams = append(streams, codec)
+		default:
+			t.Fatalf("no test stream for %s", typ)
+		}
+	}
+	return streams
+}
+
+// newTestQueue creates a queue with the header of streams of the given types
+func newTestQueue(t *testing.T, types ...av.CodecType) *pubsub.Queue {
+	t.Helper()
+
+	queue := pubsub.NewQueue()
+	require.NoError(t, queue.WriteHeader(testStreams(t, types...)))
+	return queue
+}
+
+// waitForDone waits for goroutines a test started to finish, so they don't
+// write logs or read settings while the next test sets them up.  nil channels
+// are skipped.
+func waitForDone(t *testing.T, done ...<-chan struct{}) {
+	t.Helper()
+
+	for _, d := range done {
+		if d == nil {
+			continue
+		}
+		select {
+		case <-d:
+		case <-time.After(2 * time.Second):
+			t.Fatal("goroutine did not finish in time")
+		}
+	}
+}
+
+// channelDone returns the Done channels of the segmenters of a channel
+func channelDone(ch *Channel) []<-chan struct{} {
+	return []<-chan struct{}{ch.hlsChan.Done(), ch.audioHLS.Done(), ch.dashChan.Done()}
+}
@@ -0,0 +1,336 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/nareix/joy4/av"
+	"github.com/nareix/joy4/codec/aacparser"
+	"github.com/nareix/joy4/codec/h264parser"
+	"github.com/nareix/joy4/format/mp4/mp4io"
+)
+
+// Sample flags for the trun box
+const (
+	fmp4SyncSampleFlags    = 0x02000000 // depends on no other sample
+	fmp4NonSyncSampleFlags = 0x01010000 // depends on other samples, not a sync sample
+)
+
+// fmp4Muxer writes fragmented MP4 (CMAF) media.  The init segment holds the
+// codec setup and every flush writes the buffered packets as a moof+mdat
+// fragment.  joy4's mp4 muxer can only write whole files, so the fragments
+// are built here.
+type fmp4Muxer struct {
+	streams []av.CodecData
+	tracks  []*fmp4Track
+	seqNum  uint32
+}
+
+type fmp4Track struct {
+	id           uint32
+	timeScale    int64
+	samples      []fmp4Sample
+	lastDuration uint32
+}
+
+type fmp4Sample struct {
+	dts      int64
+	duration uint32
+	cts      int32
+	keyFrame bool
+	data     []byte
+}
+
+// newFMP4Muxer creates a muxer for the given streams.  Only H.264 and AAC are
+// supported.
+func newFMP4Muxer(streams []av.CodecData) (*fmp4Muxer, error) {
+	m := &fmp4Muxer{streams: streams}
+	for i, stream := range streams {
+		track := &fmp4Track{id: uint32(i + 1)}
+
+		switch stream.Type() {
+		case av.H264:
+			track.timeScale = 90000
+		case av.AAC:
+			track.timeScale = int64(stream.(aacparser.CodecData).SampleRate())
+			track.lastDuration = 1024 // samples per AAC frame
+		default:
+			return nil, fmt.Errorf("codec %v is not supported in fMP4", stream.Type())
+		}
+
+		m.tracks = append(m.tracks, track)
+	}
+	return m, nil
+}
+
+// InitSegment returns the ftyp and moov boxes that go in the EXT-X-MAP
+func (m *fmp4Muxer) InitSegment() []byte {
+	moov := &mp4io.Movie{
+		Header: &mp4io.MovieHeader{
+			TimeScale:       1000,
+			PreferredRate:   1,
+			PreferredVolume: 1,
+			Matrix:          [9]int32{0x10000, 0, 0, 0, 0x10000, 0, 0, 0, 0x40000000},
+			NextTrackId:     int32(len(m.tracks) + 1),
+		},
+		MovieExtend: &mp4io.MovieExtend{},
+	}
+
+	for i, stream := range m.streams {
+		track := m.tracks[i]
+		moov.Tracks = append(moov.Tracks, fmp4TrackAtom(stream, track))
+		moov.MovieExtend.Tracks = append(moov.MovieExtend.Tracks, &mp4io.TrackExtend{
+			TrackId:              track.id,
+			DefaultSampleDescIdx: 1,
+		})
+	}
+
+	buf := &bytes.Buffer{}
+	writeBox(buf, "ftyp", []byte("iso6"), be32(0), []byte("iso6cmfcmp41"))
+
+	b := make([]byte, moov.Len())
+	moov.Marshal(b)
+	buf.Write(b)
+
+	return buf.Bytes()
+}
+
+// fmp4TrackAtom builds the trak box for a stream.  The sample tables are
+// empty since the samples are described in the fragments.
+func fmp4TrackAtom(stream av.CodecData, track *fmp4Track) *mp4io.Track {
+	sample := &mp4io.SampleTable{
+		SampleDesc:    &mp4io.SampleDesc{},
+		TimeToSample:  &mp4io.TimeToSample{},
+		SampleToChunk: &mp4io.SampleToChunk{},
+		SampleSize:    &mp4io.SampleSize{},
+		ChunkOffset:   &mp4io.ChunkOffset{},
+	}
+
+	atom := &mp4io.Track{
+		Header: &mp4io.TrackHeader{
+			TrackId: int32(track.id),
+			Flags:   0x0003, // Track enabled | Track in movie
+			Matrix:  [9]int32{0x10000, 0, 0, 0, 0x10000, 0, 0, 0, 0x40000000},
+		},
+		Media: &mp4io.Media{
+			Header: &mp4io.MediaHeader{
+				TimeScale: int32(track.timeScale),
+				Language:  21956,
+			},
+			Info: &mp4io.MediaInfo{
+				Sample: sample,
+				Data: &mp4io.DataInfo{
+					Refer: &mp4io.DataRefer{
+						Url: &mp4io.DataReferUrl{
+							Flags: 0x000001, // Self reference
+						},
+					},
+				},
+			},
+		},
+	}
+
+	switch codec := stream.(type) {
+	case h264parser.CodecData:
+		width, height := codec.Width(), codec.Height()
+		sample.SampleDesc.AVC1Desc = &mp4io.AVC1Desc{
+			DataRefIdx:           1,
+			HorizontalResolution: 72,
+			VorizontalResolution: 72,
+			Width:                int16(width),
+			Height:               int16(height),
+			FrameCount:           1,
+			Depth:                24,
+			ColorTableId:         -1,
+			Conf:                 &mp4io.AVC1Conf{Data: codec.AVCDecoderConfRecordBytes()},
+		}
+		atom.Media.Handler = &mp4io.HandlerRefer{
+			SubType: [4]byte{'v', 'i', 'd', 'e'},
+			Name:    []byte("Video Media Handler"),
+		}
+		atom.Media.Info.Video = &mp4io.VideoMediaInfo{
+			Flags: 0x000001,
+		}
+		atom.Header.TrackWidth = float64(width)
+		atom.Header.TrackHeight = float64(height)
+
+	case aacparser.CodecData:
+		sample.SampleDesc.MP4ADesc = &mp4io.MP4ADesc{
+			DataRefIdx:       1,
+			NumberOfChannels: int16(codec.ChannelLayout().Count()),
+			SampleSize:       16,
+			SampleRate:       float64(codec.SampleRate()),
+			Conf: &mp4io.ElemStreamDesc{
+				DecConfig: codec.MPEG4AudioConfigBytes(),
+			},
+		}
+		atom.Header.Volume = 1
+		atom.Header.AlternateGroup = 1
+		atom.Media.Handler = &mp4io.HandlerRefer{
+			SubType: [4]byte{'s', 'o', 'u', 'n'},
+			Name:    []byte("Sound Handler"),
+		}
+		atom.Media.Info.Sound = &mp4io.SoundMediaInfo{}
+	}
+
+	return atom
+}
+
+// WritePacket buffers a packet until the next flush
+func (m *fmp4Muxer) WritePacket(pkt av.Packet) error {
+	if int(pkt.Idx) >= len(m.tracks) {
+		return fmt.Errorf("invalid stream index %d", pkt.Idx)
+	}
+
+	track := m.tracks[pkt.Idx]
+	dts := int64(pkt.Time) * track.timeScale / int64(time.Second)
+
+	// The duration of a sample is only known once the next one arrives
+	if n := len(track.samples); n > 0 {
+		prev := &track.samples[n-1]
+		if dts > prev.dts {
+			prev.duration = uint32(dts - prev.dts)
+			track.lastDuration = prev.duration
+		}
+	}
+
+	track.samples = append(track.samples, fmp4Sample{
+		dts:      dts,
+		cts:      int32(int64(pkt.CompositionTime) * track.timeScale / int64(time.Second)),
+		keyFrame: pkt.IsKeyFrame || !m.streams[pkt.Idx].Type().IsVideo(),
+		data:     pkt.Data,
+	})
+	return nil
+}
+
+// Flush writes the buffered packets to w as a single fragment
+func (m *fmp4Muxer) Flush(w io.Writer) error {
+	mdatSize := 0
+	for _, track := range m.tracks {
+		for _, sample := range track.samples {
+			mdatSize += len(sample.data)
+		}
+	}
+	if mdatSize == 0 {
+		return nil
+	}
+
+	m.seqNum++
+
+	// The trun data offsets depend on the size of the moof, which doesn't
+	// depend on the offsets, so build it once to measure it.
+	offsets := make([]uint32, len(m.tracks))
+	moofSize := len(m.moof(offsets))
+
+	offset := uint32(moofSize + 8)
+	for i, track := range m.tracks {
+		offsets[i] = offset
+		for _, sample := range track.samples {
+			offset += uint32(len(sample.data))
+		}
+	}
+
+	buf := &bytes.Buffer{}
+	buf.Write(m.moof(offsets))
+
+	buf.Write(be32(uint32(mdatSize + 8)))
+	buf.WriteString("mdat")
+	for _, track := range m.tracks {
+		for _, sample := range track.samples {
+			buf.Write(sample.data)
+		}
+		track.samples = track.samples[:0]
+	}
+
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+// moof builds the moof box for the buffered samples
+func (m *fmp4Muxer) moof(offsets []uint32) []byte {
+	moof := &bytes.Buffer{}
+	writeBox(moof, "mfhd", be32(0), be32(m.seqNum))
+
+	for i, track := range m.tracks {
+		if len(track.samples) == 0 {
+			continue
+		}
+
+		trun := &bytes.Buffer{}
+		trun.Write(be32(0x000f01)) // version 0, data offset and all sample fields present
+		trun.Write(be32(uint32(len(track.samples))))
+		trun.Write(be32(offsets[i]))
+		for _, sample := range track.samples {
+			duration := sample.duration
+			if duration == 0 {
+				duration = track.lastDuration
+			}
+
+			flags := uint32(fmp4NonSyncSampleFlags)
+			if sample.keyFrame {
+				flags = fmp4SyncSampleFlags
+			}
+
+			trun.Write(be32(duration))
+			trun.Write(be32(uint32(len(sample.data))))
+			trun.Write(be32(flags))
+			trun.Write(be32(uint32(sample.cts)))
+		}
+
+		baseTime := make([]byte, 8)
+		binary.BigEndian.PutUint64(baseTime, uint64(track.samples[0].dts))
+
+		traf := &bytes.Buffer{}
+		writeBox(traf, "tfhd", be32(0x020000), be32(track.id)) // default-base-is-moof
+		writeBox(traf, "tfdt", be32(0x01000000), baseTime)     // version 1, 64 bit decode time
+		writeBox(traf, "trun", trun.Bytes())
+		writeBox(moof, "traf", traf.Bytes())
+	}
+
+	buf := &bytes.Buffer{}
+	writeBox(buf, "moof", moof.Bytes())
+	return buf.Bytes()
+}
+
+// writeBox writes an MP4 box with the given payload
+func writeBox(buf *bytes.Buffer, boxType string, payload ...[]byte) {
+	size := 8
+	for _, p := range payload {
+		size += len(p)
+	}
+
+	buf.Write(be32(uint32(size)))
+	buf.WriteString(boxType)
+	for _, p := range payload {
+		buf.Write(p)
+	}
+}
+
+func be32(v uint32) []byte {
+	b := make([]byte, 4)
+	binary.BigEndian.PutUint32(b, v)
+	return b
+}
+
+// fmp4SegmentWriter writes the packets of a segment as fragments of the
+// stream's fMP4 muxer
+type fmp4SegmentWriter struct {
+	muxer *fmp4Muxer
+	w     io.Writer
+}
+
+func (w fmp4SegmentWriter) WritePacket(pkt av.Packet) error {
+	return w.muxer.WritePacket(pkt)
+}
+
+func (w fmp4SegmentWriter) Flush() error {
+	return w.muxer.Flush(w.w)
+}
+
+// WriteMetadata drops the tag, fMP4 segments don't carry timed ID3 metadata
+func (w fmp4SegmentWriter) WriteMetadata(tag []byte, t time.Duration) error {
+	return nil
+}
@@ -3,6 +3,7 @@ package main
 import (
 	"encoding/json"
 	"errors"
+	"fmt"
 	"io"
 	"io/fs"
 	"net/http"
@@ -11,14 +12,16 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"time"
 
+	"github.com/nareix/joy4/format/rtmp"
 	"github.com/zorchenhimer/MovieNight/common"
 
 	"github.com/gorilla/websocket"
+	"github.com/nareix/joy4/av"
 	"github.com/nareix/joy4/av/avutil"
 	"github.com/nareix/joy4/av/pubsub"
 	"github.com/nareix/joy4/format/flv"
-	"github.com/nareix/joy4/format/rtmp"
 )
 
 var (
@@ -33,8 +36,152 @@ var (
 )
 
 type Channel struct {
-	que     *pubsub.Queue
-	hlsChan *HLSChannel
+	que      *pubsub.Queue
+	hlsChan  *HLSChannel
+	audioHLS *HLSChannel // audio only rendition
+	dashChan *DASHChannel
+	recorder *Recorder
+	relays   []*Relay
+	ingest   *IngestMonitor
+	metadata *StreamMetadata // codecs of the publisher
+	vod      *vodWriter      // nil unless the stream is kept as a VOD
+	timeline timeline
+
+	publisher *publisher // nil while the channel isn't fed by an RTMP publisher
+	backstage bool       // only mods and admins can watch the channel
+
+	flvViewers int32 // updated atomically
+
+	// Reconnect grace period stuff
+	waiting  bool // true while the publisher is gone and the channel is kept alive
+	waitGen  int  // incremented each time the channel starts waiting for a publisher
+	fallback *fallbackPlayer
+}
+
+// timeline shifts packet times so they keep increasing when the source of a
+// channel changes, eg. when a publisher reconnects or a new file starts.
+type timeline struct {
+	last    time.Duration
+	offset  time.Duration
+	restart bool
+	streams []av.CodecData // of the current source
+}
+
+// adjust moves the packet onto the channel's timeline
+func (t *timeline) adjust(pkt av.Packet) av.Packet {
+	if t.restart {
+		t.offset = t.last - pkt.Time
+		if t.last > 0 {
+			// Leave a small gap so the first packet doesn't share a timestamp with the last one.
+			t.offset += 10 * time.Millisecond
+		}
+		t.restart = false
+	}
+
+	pkt.Time += t.offset
+	if pkt.Time > t.last {
+		t.last = pkt.Time
+	}
+	return pkt
+}
+
+// errCodecsChanged is returned for a new source that doesn't have the codecs
+// of the channel.  FLV viewers, recordings and relays keep the streams they
+// started with, so they would get the new packets mislabelled.
+var errCodecsChanged = errors.New("the codecs of the source don't match the stream")
+
+// writeHeader sets the streams of a new source for the channel and restarts
+// the timeline so the source's packets continue where the last one stopped.
+// Only one source may write to a channel at a time, and it has to have the
+// same codecs in the same order as the first one.
+func (ch *Channel) writeHeader(streams []av.CodecData) error {
+	err := ch.checkCodecs(streams)
+	if err != nil {
+		return err
+	}
+
+	ch.timeline.restart = true
+	ch.timeline.streams = streams
+	ch.ingest.reset(streams)
+	return ch.que.WriteHeader(streams)
+}
+
+// checkCodecs returns errCodecsChanged if a new source can't write to the
+// channel
+func (ch *Channel) checkCodecs(streams []av.CodecData) error {
+	if ch.timeline.streams != nil && !sameCodecs(ch.timeline.streams, streams) {
+		return fmt.Errorf("%w: %s instead of %s", errCodecsChanged, codecTypes(streams), codecTypes(ch.timeline.streams))
+	}
+	return nil
+}
+
+// sameCodecs checks that both sources have streams of the same codec types in
+// the same order.  Codec parameters like the resolution may differ.
+func sameCodecs(a, b []av.CodecData) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i].Type() != b[i].Type() {
+			return false
+		}
+	}
+	return true
+}
+
+// codecTypes lists the codec types of the streams for log messages
+func codecTypes(streams []av.CodecData) string {
+	types := make([]string, len(streams))
+	for i, stream := range streams {
+		types[i] = stream.Type().String()
+	}
+	return "[" + strings.Join(types, ", ") + "]"
+}
+
+// WritePacket writes a packet from the current source to the channel's queue
+func (ch *Channel) WritePacket(pkt av.Packet) error {
+	newSource := ch.timeline.restart && ch.timeline.last > 0
+	pkt = ch.timeline.adjust(pkt)
+	if newSource {
+		// HLS players need a discontinuity, the encoder settings may have changed
+		ch.hlsChan.addDiscontinuity(pkt.Time, ch.timeline.streams)
+		ch.audioHLS.addDiscontinuity(pkt.Time, ch.timeline.streams)
+		ch.dashChan.addDiscontinuity(pkt.Time, ch.timeline.streams)
+	}
+	ch.ingest.observe(pkt)
+	return ch.que.WritePacket(pkt)
+}
+
+// findChannel returns the channel for the given stream name.  If the name is
+// empty and exactly one stream is live, that stream is returned.
+func findChannel(name string) (string, *Channel, error) {
+	l.RLock()
+	defer l.RUnlock()
+	return lookupChannel(name)
+}
+
+// lookupChannel is findChannel for callers that hold the channel lock
+func lookupChannel(name string) (string, *Channel, error) {
+	if name != "" {
+		ch, ok := channels[name]
+		if !ok {
+			return "", nil, fmt.Errorf("stream %q is not live", name)
+		}
+		return name, ch, nil
+	}
+
+	if len(channels) == 0 {
+		return "", nil, fmt.Errorf("no stream is live")
+	}
+
+	if len(channels) > 1 {
+		return "", nil, fmt.Errorf("more than one stream is live, a stream name is required")
+	}
+
+	for streamName, ch := range channels {
+		return streamName, ch, nil
+	}
+	return "", nil, fmt.Errorf("no stream is live")
 }
 
 type writeFlusher struct {
@@ -99,6 +246,16 @@ var upgrader = websocket.Upgrader{
 
 // this is also the handler for joining to the chat
 func wsHandler(w http.ResponseWriter, r *http.Request) {
+	channel := r.URL.Query().Get("channel")
+	room, err := openChatRoom(channel)
+	if errors.Is(err, errUnknownChannel) {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	} else if err != nil {
+		common.LogInfof("[handler] %v\n", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
 
 	conn, err := upgrader.Upgrade(w, r, nil)
 	if err != nil {
@@ -113,6 +270,7 @@ func wsHandler(w http.ResponseWriter, r *http.Request) {
 		// If the server is behind a reverse proxy (eg, Nginx), look
 		// for this header to get the real IP address of the client.
 		forwardedFor: common.ExtractForwarded(r),
+		viewerID:     requestViewerID(r),
 	}
 
 	go func() {
@@ -140,8 +298,17 @@ func wsHandler(w http.ResponseWriter, r *http.Request) {
 				continue
 			}
 
-			client, err = chat.Join(chatConn, joinData)
-			if err != nil {
+			client, err = room.Join(chatConn, joinData)
+			if errors.Is(err, errRoomClosed) {
+				// The room went away while the client was connecting
+				room, err = openChatRoom(channel)
+				if err != nil {
+					common.LogInfof("[handler] %v\n", err)
+					conn.Close()
+					return
+				}
+				continue
+			} else if err != nil {
 				switch err.(type) { //nolint:errorlint
 				case UserFormatError, UserTakenError:
 					common.LogInfof("[handler|%s] %v\n", errorName(err), err)
@@ -163,6 +330,8 @@ func wsHandler(w http.ResponseWriter, r *http.Request) {
 			err := conn.ReadJSON(&data)
 			if err != nil { //if error then assuming that the connection is closed
 				client.Exit()
+				// Rooms of channels that have ended go away with their last chatter
+				dropEmptyChatRoom(roomStreamName(client.belongsTo))
 				return
 			}
 			client.NewMsg(data)
@@ -321,10 +490,19 @@ func handleEmoteTemplate(w http.ResponseWriter, r *http.Request) {
 }
 
 func handleIndexTemplate(w http.ResponseWriter, r *http.Request) {
+	renderIndex(w, r, defaultStream, nil)
+}
+
+// renderIndex renders the player and chat of the given stream, or the replay
+// of a VOD of it
+func renderIndex(w http.ResponseWriter, r *http.Request, stream string, vod *VOD) {
 	type Data struct {
 		Video, Chat         bool
 		MessageHistoryCount int
 		Title               string
+		Stream              string
+		DVR                 bool   // the stream can be rewound
+		VOD                 string // ID of the VOD that is replayed
 	}
 
 	data := Data{
@@ -332,8 +510,25 @@ func handleIndexTemplate(w http.ResponseWriter, r *http.Request) {
 		Chat:                true,
 		MessageHistoryCount: settings.MaxMessageCount,
 		Title:               settings.PageTitle,
+		Stream:              stream,
+		DVR:                 settings.DVRWindow > 0,
 	}
 
+	if vod != nil {
+		data.VOD = vod.ID
+		data.DVR = false
+		if vod.Title != "" {
+			data.Title += " - " + vod.Title
+		} else {
+			data.Title += " - " + stream + " " + vod.Started.Format("2006-01-02")
+		}
+	} else if stream != defaultStream {
+		data.Title += " - " + stream
+	}
+
+	// Lets backstage streams be shown to the mods in chat
+	viewerID(w, r)
+
 	path := strings.Split(strings.TrimLeft(r.URL.Path, "/"), "/")
 	if path[0] == "chat" {
 		data.Video = false
@@ -357,51 +552,145 @@ func handleIndexTemplate(w http.ResponseWriter, r *http.Request) {
 func handlePublish(conn *rtmp.Conn) {
 	streams, _ := conn.Streams()
 
-	l.Lock()
 	common.LogDebugln("request string->", conn.URL.RequestURI())
 	urlParts := strings.Split(strings.Trim(conn.URL.RequestURI(), "/"), "/")
 	common.LogDebugln("urlParts->", urlParts)
 
 	if len(urlParts) > 2 {
 		common.LogErrorln("Extra garbage after stream key")
-		l.Unlock()
 		conn.Close()
 		return
 	}
 
 	if len(urlParts) != 2 {
 		common.LogErrorln("Missing stream key")
-		l.Unlock()
 		conn.Close()
 		return
 	}
 
-	if urlParts[1] != settings.GetStreamKey() {
-		common.LogErrorln("Stream key is incorrect.  Denying stream.")
-		l.Unlock()
+	// The webhook can take a while, so it is asked before taking the lock
+	streamPath := urlParts[0]
+	event := PublishEvent{
+		Stream:     streamPath,
+		Key:        urlParts[1],
+		RemoteAddr: conn.NetConn().RemoteAddr().String(),
+		Streams:    describeStreams(streams),
+	}
+	owner, err := authorizePublish(event)
+	if err != nil {
+		common.LogErrorf("Denying stream: %v\n", err)
 		conn.Close()
 		return //If key not match, deny stream
 	}
+	event.Owner = owner
 
-	streamPath := urlParts[0]
-	_, exists := channels[streamPath]
-	if exists {
-		common.LogErrorln("Stream already running.  Denying publish.")
+	if settings.AutoRecord {
+		err = createRecordingsDir()
+		if err != nil {
+			common.LogErrorf("%v\n", err)
+		}
+	}
+
+	l.Lock()
+	pub := &publisher{owner: owner, conn: conn, done: make(chan struct{})}
+	ch, err := startPublishing(streamPath, streams)
+	if err == nil {
+		ch.publisher = pub
+	}
+	l.Unlock()
+
+	// Somebody else is live, the admins decide if the new publisher takes over
+	if errors.Is(err, errStreamRunning) {
+		err = requestHandoff(streamPath, owner)
+		if err == nil {
+			ch, err = takeOver(streamPath, streams, pub)
+		}
+	}
+
+	if err != nil {
+		common.LogErrorf("Denying publish: %v\n", err)
 		conn.Close()
-		l.Unlock()
 		return
 	}
 
-	ch := &Channel{}
+	ch.setMetadata(newStreamMetadata(streams))
+
+	common.LogInfof("Stream started by %s\n", owner)
+	start := time.Now()
+	err = avutil.CopyPackets(ch, conn)
+	if err != nil {
+		common.LogErrorf("Could not copy packets to connections: %v\n", err)
+	}
+	close(pub.done)
+	common.LogInfoln("Stream finished")
+	publishDone(event, time.Since(start))
+
+	l.Lock()
+	// A publisher that was handed off doesn't end the stream
+	if ch.publisher == pub {
+		ch.publisher = nil
+		stopPublishing(streamPath, ch, time.Second*settings.ReconnectGracePeriod)
+	}
+	l.Unlock()
+}
+
+// startPublishing registers a channel for a new publisher of streamPath, or
+// hands a channel that is waiting for its publisher over to it.  The caller is
+// expected to hold the channel lock.
+func startPublishing(streamPath string, streams []av.CodecData) (*Channel, error) {
+	ch, exists := channels[streamPath]
+	if !exists {
+		ch = newChannel(streamPath, streams)
+		channels[streamPath] = ch
+		stats.startStream()
+		return ch, nil
+	}
+
+	if !ch.waiting {
+		return nil, fmt.Errorf("could not publish %s: %w", streamPath, errStreamRunning)
+	}
+
+	err := ch.resumePublisher(streamPath, streams)
+	if err != nil {
+		return nil, fmt.Errorf("could not resume stream %s: %w", streamPath, err)
+	}
+	common.LogInfof("Publisher reconnected to %s\n", streamPath)
+	return ch, nil
+}
+
+// stopPublishing is called when the publisher of a channel goes away.  The
+// channel is kept alive for the grace period in case the publisher comes
+// back, or closed right away if grace is zero.  The caller is expected to hold
+// the channel lock.
+func stopPublishing(streamPath string, ch *Channel, grace time.Duration) {
+	if grace > 0 {
+		ch.waitForPublisher(streamPath, grace)
+		return
+	}
+
+	endChannel(streamPath, ch)
+}
+
+// newChannel creates a channel for the given streams and starts the HLS
+// segmenter for it.  The caller is expected to hold the channel lock.
+func newChannel(streamPath string, streams []av.CodecData) *Channel {
+	ch := &Channel{ingest: newIngestMonitor(streamPath), backstage: settings.BackstagePreview}
 	ch.que = pubsub.NewQueue()
-	err := ch.que.WriteHeader(streams)
+	err := ch.writeHeader(streams)
 	if err != nil {
 		common.LogErrorf("Could not write header to streams: %v\n", err)
 	}
 
 	// Initialize HLS channel for this stream immediately
 	common.LogInfof("Creating HLS channel for stream: %s\n", streamPath)
-	hlsChan, err := NewHLSChannel(ch.que)
+	config := settings.GetHLSConfig()
+	if _, rendition := splitRenditionName(streamPath); rendition != "" {
+		// Renditions are served next to their media playlist instead of /live
+		config.BaseURI = "/hls/" + streamPath
+	} else if streamPath != defaultStream {
+		config.BaseURI = "/live/" + streamPath
+	}
+	hlsChan, err := NewHLSChannelWithConfig(ch.que, config)
 	if err != nil {
 		common.LogErrorf("Failed to create HLS channel: %v\n", err)
 	} else {
@@ -415,48 +704,114 @@ func handlePublish(conn *rtmp.Conn) {
 		}
 	}
 
-	channels[streamPath] = ch
-	l.Unlock()
-
-	stats.startStream()
+	// Audio only rendition for listeners on slow connections
+	if hasAudioStream(streams) {
+		audioConfig := settings.GetHLSConfig()
+		audioConfig.AudioOnly = true
+		audioConfig.ClipBuffer = 0
+		audioConfig.DVRWindow = 0
+		audioConfig.BaseURI = "/hls/" + streamPath + "/audio"
+		audioHLS, err := NewHLSChannelWithConfig(ch.que, audioConfig)
+		if err != nil {
+			common.LogErrorf("Failed to create audio only HLS channel: %v\n", err)
+		} else if err = audioHLS.Start(); err != nil {
+			common.LogErrorf("Failed to start audio only HLS channel: %v\n", err)
+		} else {
+			ch.audioHLS = audioHLS
+		}
+	}
 
-	common.LogInfoln("Stream started")
-	err = avutil.CopyPackets(ch.que, conn)
+	// DASH is generated from the same queue for players that prefer it
+	dashChan, err := NewDASHChannelWithConfig(ch.que, config)
 	if err != nil {
-		common.LogErrorf("Could not copy packets to connections: %v\n", err)
+		common.LogErrorf("Failed to create DASH channel: %v\n", err)
+	} else if err = dashChan.Start(); err != nil {
+		common.LogErrorf("Failed to start DASH channel: %v\n", err)
+	} else {
+		ch.dashChan = dashChan
 	}
-	common.LogInfoln("Stream finished")
 
-	stats.endStream()
+	if settings.AutoRecord {
+		err = ch.startRecording(streamPath)
+		if err != nil {
+			common.LogErrorf("Failed to start recording: %v\n", err)
+		}
+	}
+
+	ch.startRelays(streamPath)
+
+	// Backstage streams are kept once they go live
+	if ch.backstage {
+		announceBackstage(streamPath)
+	} else {
+		ch.startVOD(streamPath)
+	}
+
+	return ch
+}
+
+// close stops everything attached to the channel and closes its queue.  The
+// caller is expected to hold the channel lock.
+func (ch *Channel) close() {
+	ch.stopFallback()
+
+	ch.finishVOD()
 
-	l.Lock()
 	// Clean up HLS channel if it exists
 	if ch.hlsChan != nil {
 		ch.hlsChan.Stop()
 	}
-	delete(channels, streamPath)
-	l.Unlock()
+	ch.audioHLS.Stop()
+	ch.dashChan.Close()
+	ch.stopRecording()
+	ch.stopRelays()
 	ch.que.Close()
 }
 
 func handlePlay(conn *rtmp.Conn) {
+	defer conn.Close()
+
+	streamPath, query := rtmpPlayRequest(conn.URL)
+	host := rtmpHost(conn)
+	if err := authorizePlay(host, query); err != nil {
+		common.LogInfof("[rtmp] Denied playing %s to %s: %v\n", streamPath, host, err)
+		return
+	}
+
 	l.RLock()
-	ch := channels[conn.URL.Path]
+	ch := channels[streamPath]
+	if ch != nil && ch.backstage {
+		// There is no way to tell if an RTMP player is a mod
+		ch = nil
+	}
 	l.RUnlock()
 
-	if ch != nil {
-		cursor := ch.que.Latest()
-		err := avutil.CopyFile(conn, cursor)
-		if err != nil {
-			common.LogErrorf("Could not copy video to connection: %v\n", err)
-		}
+	if ch == nil {
+		common.LogDebugf("[rtmp] %s tried to play %s, which isn't live\n", host, streamPath)
+		return
+	}
+
+	ch.addViewer()
+	defer ch.removeViewer()
+
+	cursor := ch.que.Latest()
+	err := avutil.CopyFile(conn, cursor)
+	if err != nil {
+		common.LogErrorf("Could not copy video to connection: %v\n", err)
 	}
 }
 
 func handleLive(w http.ResponseWriter, r *http.Request) {
-	l.RLock()
-	ch := channels[strings.Trim(r.URL.Path, "/")]
-	l.RUnlock()
+	// /live is the default stream, /live/<name> any other channel
+	streamName := strings.Trim(strings.TrimPrefix(strings.Trim(r.URL.Path, "/"), defaultStream), "/")
+	if streamName == "" {
+		streamName = defaultStream
+	}
+	ch, _ := groupChannel(streamName)
+	if ch != nil && !ch.visibleTo(r) {
+		// Backstage streams look like they haven't started yet
+		ch = nil
+	}
 
 	// Debug logging for HLS troubleshooting
 	userAgent := r.Header.Get("User-Agent")
@@ -476,17 +831,46 @@ func handleLive(w http.ResponseWriter, r *http.Request) {
 		streamingFormat := capabilities.PreferredCodec
 		common.LogDebugf("Detected streaming format: %s\n", streamingFormat)
 
+		// Audio only listeners.  iOS can't play FLV so it gets the audio HLS rendition.
+		if format == "audio" {
+			if capabilities.IsIOS {
+				http.Redirect(w, r, withStreamToken(r, "/hls/"+streamName+"/audio/playlist.m3u8"), http.StatusFound)
+			} else {
+				handleFLVStream(w, r, ch, true)
+			}
+			return
+		}
+
+		// Smart TVs and set-top boxes get the DASH manifest.  Signed URLs
+		// stay on HLS, the token can't be passed down to DASH segments.
+		signed := r.URL.Query().Get("token") != ""
+		if (capabilities.SupportsDASH && !signed) || format == "dash" {
+			common.LogDebugf("Redirecting to DASH manifest\n")
+			http.Redirect(w, r, "/dash/"+streamName+"/manifest.mpd", http.StatusFound)
+			return
+		}
+
 		// Also check if this is an HLS playlist request (for native iOS)
 		if capabilities.SupportsHLS || strings.HasSuffix(r.URL.Path, ".m3u8") || r.URL.Query().Get("format") == "hls" {
+			// Players pick a rendition themselves from the master playlist
+			if hasRenditions(streamName) {
+				common.LogDebugf("Redirecting to HLS master playlist\n")
+				http.Redirect(w, r, withStreamToken(r, "/hls/"+streamName+"/master.m3u8"), http.StatusFound)
+				return
+			}
+
 			common.LogDebugf("Routing to HLS handler\n")
 			handleHLSStream(w, r, ch)
 		} else {
 			common.LogDebugf("Routing to FLV handler\n")
-			handleFLVStream(w, r, ch)
+			handleFLVStream(w, r, ch, false)
 		}
 	} else {
 		// When no stream is active, return appropriate response based on request type
-		if capabilities.SupportsHLS || strings.HasSuffix(r.URL.Path, ".m3u8") || r.URL.Query().Get("format") == "hls" {
+		if capabilities.SupportsDASH || format == "dash" {
+			common.LogInfof("DASH request for inactive stream: %s\n", r.URL.Path)
+			w.WriteHeader(http.StatusServiceUnavailable)
+		} else if capabilities.SupportsHLS || strings.HasSuffix(r.URL.Path, ".m3u8") || r.URL.Query().Get("format") == "hls" {
 			// For HLS requests, return a proper HTTP status
 			common.LogInfof("HLS request for inactive stream: %s\n", r.URL.Path)
 			w.Header().Set("Content-Type", GetContentTypeForFormat("hls"))
@@ -501,12 +885,24 @@ func handleLive(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-func handleFLVStream(w http.ResponseWriter, r *http.Request, ch *Channel) {
+// handleFLVStream sends the stream as HTTP-FLV.  With audioOnly only the
+// audio streams are sent.
+func handleFLVStream(w http.ResponseWriter, r *http.Request, ch *Channel, audioOnly bool) {
 	if ch == nil {
 		w.WriteHeader(http.StatusNoContent)
 		return
 	}
 
+	var cursor av.Demuxer = ch.que.Latest()
+	if audioOnly {
+		cursor = newAudioOnlyDemuxer(cursor)
+		if _, err := cursor.Streams(); err != nil {
+			common.LogDebugf("Cannot send audio only stream: %v\n", err)
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+	}
+
 	w.Header().Set("Content-Type", "video/x-flv")
 	w.Header().Set("Transfer-Encoding", "chunked")
 	w.Header().Set("Access-Control-Allow-Origin", "*")
@@ -515,14 +911,15 @@ func handleFLVStream(w http.ResponseWriter, r *http.Request, ch *Channel) {
 	flusher.Flush()
 
 	muxer := flv.NewMuxerWriteFlusher(writeFlusher{httpflusher: flusher, Writer: w})
-	cursor := ch.que.Latest()
 
 	session, _ := sstore.Get(r, "moviesession")
 	stats.addViewer(session.ID)
+	ch.addViewer()
 	err := avutil.CopyFile(muxer, cursor)
 	if err != nil {
 		common.LogErrorf("Could not copy video to connection: %v\n", err)
 	}
+	ch.removeViewer()
 	stats.removeViewer(session.ID)
 }
 
@@ -590,6 +987,36 @@ func handleHLSPlaylist(w http.ResponseWriter, r *http.Request, hlsChan *HLSChann
 	w.Header().Set("Pragma", "no-cache")
 	w.Header().Set("Expires", "0")
 
+	// LL-HLS blocking playlist reload.  Hold the request until the segment
+	// or part the player asked for is in the playlist.
+	query := r.URL.Query()
+	if hlsChan.config.EnableLowLatency && query.Has("_HLS_msn") {
+		msn, err := strconv.ParseUint(query.Get("_HLS_msn"), 10, 64)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		part := -1
+		if query.Has("_HLS_part") {
+			part, err = strconv.Atoi(query.Get("_HLS_part"))
+			if err != nil || part < 0 {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+		}
+
+		err = hlsChan.WaitForPart(r.Context(), msn, part)
+		if errors.Is(err, errPartTooFarAhead) {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		} else if err != nil {
+			common.LogDebugf("handleHLSPlaylist: blocking reload for %d.%d failed: %v\n", msn, part, err)
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+	}
+
 	playlist := hlsChan.GetPlaylist()
 	common.LogDebugf("handleHLSPlaylist: playlist length = %d\n", len(playlist))
 
@@ -617,7 +1044,7 @@ func handleHLSPlaylist(w http.ResponseWriter, r *http.Request, hlsChan *HLSChann
 	}
 
 	w.WriteHeader(http.StatusOK)
-	w.Write([]byte(playlist))
+	w.Write([]byte(signPlaylist(r, playlist)))
 	common.LogDebugf("handleHLSPlaylist: playlist sent successfully\n")
 }
 
@@ -631,7 +1058,8 @@ func handleHLSSegment(w http.ResponseWriter, r *http.Request, hlsChan *HLSChanne
 	pathParts := strings.Split(r.URL.Path, "/")
 	segmentFilename := pathParts[len(pathParts)-1]
 
-	if !IsValidSegmentURI(segmentFilename) {
+	isPart := IsValidPartURI(segmentFilename)
+	if !isPart && !IsValidSegmentURI(segmentFilename) && !IsValidInitURI(segmentFilename) {
 		w.WriteHeader(http.StatusBadRequest)
 		return
 	}
@@ -640,14 +1068,21 @@ func handleHLSSegment(w http.ResponseWriter, r *http.Request, hlsChan *HLSChanne
 	// The segment was stored with the full absolute path like "/live/segment_N.ts"
 	segmentURI := r.URL.Path
 
-	segmentData, err := hlsChan.GetSegmentByURI(segmentURI)
+	var segmentData []byte
+	var err error
+	if isPart {
+		// Players request the part from the preload hint before it's done
+		segmentData, err = hlsChan.WaitForSegmentByURI(r.Context(), segmentURI)
+	} else {
+		segmentData, err = hlsChan.GetSegmentByURI(segmentURI)
+	}
 	if err != nil {
 		common.LogErrorf("Failed to get HLS segment %s: %v\n", segmentURI, err)
 		w.WriteHeader(http.StatusNotFound)
 		return
 	}
 
-	w.Header().Set("Content-Type", GetContentTypeForFormat("ts"))
+	w.Header().Set("Content-Type", hlsSegmentContentType(segmentFilename))
 	w.Header().Set("Access-Control-Allow-Origin", "*")
 	// Use shorter cache time for live segments to prevent stale content issues
 	// Long cache (1 year) can cause problems when service restarts with different content
@@ -659,25 +1094,41 @@ func handleHLSSegment(w http.ResponseWriter, r *http.Request, hlsChan *HLSChanne
 }
 
 func handleHLS(w http.ResponseWriter, r *http.Request) {
-	// Extract stream path from URL like /hls/streamname/playlist.m3u8 or /hls/streamname/segment_N.ts
+	// Extract stream path from URL like /hls/streamname/playlist.m3u8 or /hls/streamname/segment_N.ts.
+	// The audio only rendition is under /hls/streamname/audio/.
 	pathParts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
-	if len(pathParts) < 3 {
-		common.LogErrorf("handleHLS: invalid path, not enough parts")
+	audioOnly := len(pathParts) == 4 && pathParts[2] == "audio"
+	if len(pathParts) < 3 || (len(pathParts) > 3 && !audioOnly) {
+		common.LogErrorf("handleHLS: invalid path %q\n", r.URL.Path)
 		w.WriteHeader(http.StatusBadRequest)
 		return
 	}
 
 	streamName := pathParts[1]
+	fileName := pathParts[len(pathParts)-1]
 
-	l.RLock()
-	ch := channels[streamName]
-	l.RUnlock()
-
-	if ch == nil {
+	ch, ok := groupChannel(streamName)
+	if !ok || !ch.visibleTo(r) {
 		w.WriteHeader(http.StatusNotFound)
 		return
 	}
 
+	if fileName == "master.m3u8" && !audioOnly {
+		handleHLSMaster(w, r, streamName)
+		return
+	}
+
+	if audioOnly {
+		if strings.HasSuffix(fileName, ".m3u8") {
+			handleHLSPlaylist(w, r, ch.audioHLS)
+		} else if IsHLSSegmentRequest(r) {
+			handleHLSSegment(w, r, ch.audioHLS)
+		} else {
+			w.WriteHeader(http.StatusNotFound)
+		}
+		return
+	}
+
 	// Initialize HLS channel if not already done
 	if ch.hlsChan == nil {
 		hlsChan, err := NewHLSChannelWithDeviceOptimization(ch.que, r)
@@ -696,45 +1147,131 @@ func handleHLS(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Handle different HLS requests
-	fileName := pathParts[2]
 	if strings.HasSuffix(fileName, ".m3u8") {
 		handleHLSPlaylist(w, r, ch.hlsChan)
-	} else if strings.HasSuffix(fileName, ".ts") {
+	} else if IsHLSSegmentRequest(r) {
 		handleHLSSegment(w, r, ch.hlsChan)
 	} else {
 		w.WriteHeader(http.StatusNotFound)
 	}
 }
 
+// handleHLSMaster serves the master playlist of the renditions published as
+// <group>_<rendition>
+func handleHLSMaster(w http.ResponseWriter, r *http.Request, group string) {
+	w.Header().Set("Content-Type", GetContentTypeForFormat("hls"))
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Cache-Control", "no-cache, no-store, must-revalidate")
+
+	playlist, err := MasterPlaylist(group, requesterLevel(r))
+	if err != nil {
+		common.LogDebugf("handleHLSMaster: %s: %v\n", group, err)
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte(signPlaylist(r, playlist)))
+}
+
+// handleDASH serves the manifest and segments of /dash/<stream>/manifest.mpd
+func handleDASH(w http.ResponseWriter, r *http.Request) {
+	pathParts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	if len(pathParts) != 3 {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	streamName, fileName := pathParts[1], pathParts[2]
+
+	// Renditions aren't listed in the MPD, so groups get their best one
+	var dashChan *DASHChannel
+	if ch, ok := groupChannel(streamName); ok && ch.visibleTo(r) {
+		dashChan = ch.dashChan
+	}
+
+	if dashChan == nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+
+	if fileName == "manifest.mpd" {
+		manifest, err := dashChan.GetManifest()
+		if errors.Is(err, errNoDASHSegments) {
+			// The first segment is still being generated
+			w.Header().Set("Retry-After", "2")
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		} else if err != nil {
+			common.LogErrorf("Failed to generate DASH manifest: %v\n", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", GetContentTypeForFormat("dash"))
+		w.Header().Set("Cache-Control", "no-cache, no-store, must-revalidate")
+		w.Write([]byte(manifest))
+		return
+	}
+
+	if !IsValidDASHSegmentName(fileName) {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	data, err := dashChan.GetSegment(fileName)
+	if err != nil {
+		common.LogDebugf("Failed to get DASH segment %s: %v\n", fileName, err)
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", hlsSegmentContentType(fileName))
+	w.Header().Set("Cache-Control", "public, max-age=3600")
+	w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+	w.Write(data)
+}
+
 // handleLiveSegments handles HLS segment requests from /live/ path
 func handleLiveSegments(w http.ResponseWriter, r *http.Request) {
-	// Extract segment name from URL like /live/segment_N.ts
+	// Extract segment name from URL like /live/segment_N.ts for the default
+	// stream or /live/<name>/segment_N.ts for other channels
 	path := strings.Trim(r.URL.Path, "/")
 	pathParts := strings.Split(path, "/")
 
 	common.LogDebugf("handleLiveSegments: path=%s, pathParts=%v", path, pathParts)
 
-	if len(pathParts) < 2 {
-		common.LogDebugf("handleLiveSegments: invalid path, not enough parts")
+	if len(pathParts) < 2 || len(pathParts) > 3 {
+		common.LogDebugf("handleLiveSegments: invalid path, wrong number of parts")
 		w.WriteHeader(http.StatusBadRequest)
 		return
 	}
 
-	segmentName := pathParts[1]
-	if !strings.HasSuffix(segmentName, ".ts") {
-		common.LogDebugf("handleLiveSegments: not a .ts file: %s", segmentName)
+	// /live/<name> is the stream itself
+	if len(pathParts) == 2 && !IsHLSSegmentRequest(r) {
+		handleLive(w, r)
+		return
+	}
+
+	segmentName := pathParts[len(pathParts)-1]
+	if !IsHLSSegmentRequest(r) {
+		common.LogDebugf("handleLiveSegments: not a segment file: %s", segmentName)
 		w.WriteHeader(http.StatusNotFound)
 		return
 	}
 
-	// Use "live" as the default stream name for /live/ requests
-	streamName := "live"
+	streamName := defaultStream
+	if len(pathParts) == 3 {
+		streamName = pathParts[1]
+	}
 
 	l.RLock()
 	ch := channels[streamName]
 	l.RUnlock()
 
-	if ch == nil {
+	if ch == nil || !ch.visibleTo(r) {
 		common.LogDebugf("handleLiveSegments: no channel found for stream: %s", streamName)
 		w.WriteHeader(http.StatusNotFound)
 		return
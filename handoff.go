@@ -0,0 +1,140 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/nareix/joy4/av"
+	"github.com/zorchenhimer/MovieNight/common"
+)
+
+// handoffTimeout is how long a publisher waits for an admin to approve the
+// handoff before it is turned away
+const handoffTimeout = 2 * time.Minute
+
+var (
+	errStreamRunning  = errors.New("stream is already running")
+	errHandoffDenied  = errors.New("handoff was denied")
+	errHandoffTimeout = errors.New("handoff was not approved in time")
+)
+
+// publisher is the RTMP connection that is currently publishing to a channel
+type publisher struct {
+	owner string
+	conn  io.Closer
+	done  chan struct{} // closed once the publisher stopped writing packets
+}
+
+// handoff is a publisher waiting for an admin to let it replace the current
+// publisher of a stream
+type handoff struct {
+	owner    string
+	since    time.Time
+	decision chan bool
+}
+
+// pending handoffs by stream, guarded by l
+var handoffs = map[string]*handoff{}
+
+// requestHandoff asks the admins to approve owner taking over streamPath and
+// waits for their decision
+func requestHandoff(streamPath, owner string) error {
+	l.Lock()
+	if _, exists := handoffs[streamPath]; exists {
+		l.Unlock()
+		return fmt.Errorf("a handoff of %s is already waiting for approval", streamPath)
+	}
+
+	ch, ok := channels[streamPath]
+	if !ok || ch.publisher == nil {
+		l.Unlock()
+		return fmt.Errorf("stream %s is not published by anybody that can be replaced", streamPath)
+	}
+	current := ch.publisher.owner
+
+	h := &handoff{owner: owner, since: time.Now(), decision: make(chan bool, 1)}
+	handoffs[streamPath] = h
+	l.Unlock()
+
+	defer func() {
+		l.Lock()
+		if handoffs[streamPath] == h {
+			delete(handoffs, streamPath)
+		}
+		l.Unlock()
+	}()
+
+	common.LogInfof("[handoff] %s wants to take %s over from %s\n", owner, streamPath, current)
+	streamModNotice(streamPath, fmt.Sprintf("%s wants to take over %s from %s.  Use /handoff approve %s or /handoff deny %s",
+		owner, streamPath, current, streamPath, streamPath))
+
+	select {
+	case approved := <-h.decision:
+		if !approved {
+			return errHandoffDenied
+		}
+		return nil
+	case <-time.After(handoffTimeout):
+		return errHandoffTimeout
+	}
+}
+
+// decideHandoff approves or denies the pending handoff of streamPath
+func decideHandoff(streamPath string, approve bool) (string, error) {
+	l.Lock()
+	defer l.Unlock()
+
+	h, ok := handoffs[streamPath]
+	if !ok {
+		return "", fmt.Errorf("no handoff of %s is waiting for approval", streamPath)
+	}
+	delete(handoffs, streamPath)
+	h.decision <- approve
+	return h.owner, nil
+}
+
+// takeOver replaces the publisher of a running channel with pub.  The old
+// publisher is disconnected and the channel continues with the new streams.
+func takeOver(streamPath string, streams []av.CodecData, pub *publisher) (*Channel, error) {
+	l.Lock()
+	ch, ok := channels[streamPath]
+	if !ok || ch.waiting {
+		// The old publisher went away on its own while waiting for approval
+		ch, err := startPublishing(streamPath, streams)
+		if err == nil {
+			ch.publisher = pub
+		}
+		l.Unlock()
+		return ch, err
+	}
+
+	old := ch.publisher
+	if old == nil {
+		l.Unlock()
+		return nil, fmt.Errorf("stream %s is not published by anybody that can be replaced", streamPath)
+	}
+	err := ch.checkCodecs(streams)
+	if err != nil {
+		l.Unlock()
+		return nil, fmt.Errorf("could not take over %s: %w", streamPath, err)
+	}
+	ch.publisher = pub
+	l.Unlock()
+
+	// Wait for the old publisher to stop writing before the timeline restarts
+	old.conn.Close()
+	<-old.done
+
+	l.Lock()
+	defer l.Unlock()
+	err = ch.writeHeader(streams)
+	if err != nil {
+		return nil, fmt.Errorf("could not write header: %w", err)
+	}
+
+	common.LogInfof("[handoff] %s took %s over from %s\n", pub.owner, streamPath, old.owner)
+	groupModNotice(groupName(streamPath), fmt.Sprintf("%s took over %s from %s", pub.owner, streamPath, old.owner))
+	return ch, nil
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/nareix/joy4/av"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/zorchenhimer/MovieNight/common"
+)
+
+func TestStreamKeyInfo_Allows(t *testing.T) {
+	now := time.Now()
+	key := StreamKeyInfo{Name: "alice", Channel: "movies", Expires: now.Add(time.Hour)}
+
+	assert.NoError(t, key.allows("movies", now))
+	assert.NoError(t, key.allows("movies_720p", now), "renditions of the channel are allowed")
+	assert.Error(t, key.allows("live", now))
+	assert.Error(t, key.allows("movies", now.Add(2*time.Hour)), "expired keys don't work")
+
+	assert.NoError(t, StreamKeyInfo{Name: "bob"}.allows("anything", now))
+}
+
+func TestSettings_StreamKeys(t *testing.T) {
+	common.SetupLogging(common.LLError, "/dev/null")
+	settings = &Settings{
+		filename:    filepath.Join(t.TempDir(), "settings.json"),
+		TitleLength: 50,
+		StreamKey:   "mainkey",
+	}
+
+	owner, err := settings.CheckStreamKey("mainkey", "live")
+	require.NoError(t, err)
+	assert.Equal(t, "host", owner)
+
+	key, err := settings.AddStreamKey("alice", "Alice", "movies", time.Time{})
+	require.NoError(t, err)
+	assert.Len(t, key.Key, 20)
+
+	_, err = settings.AddStreamKey("Alice", "Someone", "", time.Time{})
+	assert.Error(t, err, "key names are unique")
+
+	owner, err = settings.CheckStreamKey(key.Key, "movies")
+	require.NoError(t, err)
+	assert.Equal(t, "Alice", owner)
+
+	_, err = settings.CheckStreamKey(key.Key, "live")
+	assert.Error(t, err)
+	_, err = settings.CheckStreamKey("wrong", "live")
+	assert.Error(t, err)
+	_, err = settings.CheckStreamKey("", "live")
+	assert.Error(t, err)
+
+	require.NoError(t, settings.RevokeStreamKey("alice"))
+	_, err = settings.CheckStreamKey(key.Key, "movies")
+	assert.Error(t, err, "revoked keys don't work")
+	assert.Error(t, settings.RevokeStreamKey("alice"))
+}
+
+// fakePublisherConn records being closed
+type fakePublisherConn struct {
+	mutex  sync.Mutex
+	closed bool
+}
+
+func (c *fakePublisherConn) Close() error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.closed = true
+	return nil
+}
+
+func TestHandoff(t *testing.T) {
+	common.SetupLogging(common.LLError, "/dev/null")
+	settings = &Settings{TitleLength: 50}
+
+	streams := testStreams(t, av.AAC)
+
+	oldConn := &fakePublisherConn{}
+	old := &publisher{owner: "Alice", conn: oldConn, done: make(chan struct{})}
+
+	l.Lock()
+	ch, err := startPublishing("handoff-test", streams)
+	require.NoError(t, err)
+	ch.publisher = old
+	_, err = startPublishing("handoff-test", streams)
+	assert.ErrorIs(t, err, errStreamRunning)
+	l.Unlock()
+	defer func() {
+		l.Lock()
+		delete(channels, "handoff-test")
+		ch.close()
+		l.Unlock()
+		waitForDone(t, channelDone(ch)...)
+	}()
+
+	// Denied
+	result := make(chan error, 1)
+	go func() { result <- requestHandoff("handoff-test", "Bob") }()
+	assert.Eventually(t, func() bool {
+		_, err := decideHandoff("handoff-test", false)
+		return err == nil
+	}, time.Second, 5*time.Millisecond)
+	assert.ErrorIs(t, <-result, errHandoffDenied)
+
+	// Approved
+	go func() { result <- requestHandoff("handoff-test", "Bob") }()
+	assert.Eventually(t, func() bool {
+		owner, err := decideHandoff("handoff-test", true)
+		return err == nil && owner == "Bob"
+	}, time.Second, 5*time.Millisecond)
+	require.NoError(t, <-result)
+
+	// The old publisher stops once its connection is closed
+	go func() {
+		assert.Eventually(t, func() bool {
+			oldConn.mutex.Lock()
+			defer oldConn.mutex.Unlock()
+			return oldConn.closed
+		}, time.Second, 5*time.Millisecond)
+		close(old.done)
+	}()
+
+	pub := &publisher{owner: "Bob", conn: &fakePublisherConn{}, done: make(chan struct{})}
+	got, err := takeOver("handoff-test", streams, pub)
+	require.NoError(t, err)
+	assert.Same(t, ch, got, "viewers stay on the same channel")
+
+	l.RLock()
+	assert.Same(t, pub, ch.publisher)
+	l.RUnlock()
+
+	_, err = decideHandoff("handoff-test", true)
+	assert.Error(t, err, "nothing is waiting anymore")
+}
@@ -7,15 +7,20 @@ import (
 	"encoding/hex"
 	"fmt"
 	"io"
+	"math"
 	"net/http"
+	"path"
+	"reflect"
 	"strconv"
 	"strings"
 	"sync"
 	"time"
 
 	"github.com/Eyevinn/hls-m3u8/m3u8"
+	"github.com/nareix/joy4/av"
 	"github.com/nareix/joy4/av/pubsub"
 	"github.com/nareix/joy4/format/ts"
+	"github.com/nareix/joy4/format/ts/tsio"
 	"github.com/zorchenhimer/MovieNight/common"
 )
 
@@ -24,14 +29,27 @@ type HLSConfig struct {
 	HLSVersion            uint8         // HLS version to use
 	SegmentDuration       time.Duration // Duration of each segment
 	MaxSegments           int           // Maximum number of segments to keep in memory
-	TargetDuration        time.Duration // Target duration for playlist
+	TargetDuration        time.Duration // Target duration for playlist, no segment is longer
 	BitrateReduction      float64       // Bitrate reduction factor for HLS (0.0-1.0)
 	EnableLowLatency      bool          // Enable low latency optimizations
+	PartDuration          time.Duration // Duration of LL-HLS partial segments
+	SegmentFormat         string        // Container of the segments, HLSFormatTS or HLSFormatFMP4
+	BaseURI               string        // Path the segments are served under
+	AudioOnly             bool          // Leave the video out of the segments
 	MaxConcurrentSegments int           // Maximum number of segments to generate concurrently
 	SegmentBufferSize     int           // Buffer size for segment data
 	QualityAdaptation     bool          // Enable adaptive quality based on device capabilities
+	ClipBuffer            time.Duration // Finished segments kept for clips, on top of the playlist window
+	DVRWindow             time.Duration // How far back viewers can rewind.  0 disables
+	DVRDir                string        // Directory segments that fell out of memory are written to
 }
 
+// Segment formats for HLSConfig.SegmentFormat
+const (
+	HLSFormatTS   = "ts"   // MPEG-TS segments
+	HLSFormatFMP4 = "fmp4" // fragmented MP4 (CMAF) segments with an init segment
+)
+
 // DefaultHLSConfig returns the default HLS configuration
 func DefaultHLSConfig() HLSConfig {
 	return HLSConfig{
@@ -41,9 +59,12 @@ func DefaultHLSConfig() HLSConfig {
 		TargetDuration:        4 * time.Second, // Match segment duration
 		BitrateReduction:      0.7,             // 30% reduction for HLS efficiency
 		EnableLowLatency:      true,
-		MaxConcurrentSegments: 4,          // More concurrent processing
-		SegmentBufferSize:     512 * 1024, // Smaller buffer for faster processing
+		PartDuration:          500 * time.Millisecond, // Parts for ~2s latency with low latency enabled
+		MaxConcurrentSegments: 4,                      // More concurrent processing
+		SegmentBufferSize:     512 * 1024,             // Smaller buffer for faster processing
 		QualityAdaptation:     true,
+		SegmentFormat:         HLSFormatTS,
+		BaseURI:               "/live",
 	}
 }
 
@@ -117,31 +138,92 @@ type HLSChannel struct {
 	mutex           sync.RWMutex
 	ctx             context.Context
 	cancel          context.CancelFunc
+	done            chan struct{} // Closed once the segmenter has finished
 	segmentDuration time.Duration
 	maxSegments     int
 	viewers         map[string]*HLSViewerInfo // Track HLS viewers with timestamps
 	viewersMutex    sync.RWMutex
 	config          HLSConfig
-	cleanupTicker   *time.Ticker // Background cleanup ticker
+	cleanupTicker   *time.Ticker   // Background cleanup ticker
+	streams         []av.CodecData // Codecs of the stream, set once segmenting starts
+
+	// Low latency stuff
+	segmentID       string        // ID of the segment that is being generated
+	partDuration    time.Duration // Longest a part gets, the PART-TARGET
+	pendingParts    []HLSPart     // Parts of the segment that is being generated
+	pendingSequence uint64        // Sequence number of the segment that is being generated
+	updated         chan struct{} // Closed and replaced whenever a part or segment is added
+
+	// fMP4 stuff
+	initURI      string            // URI of the EXT-X-MAP init segment
+	initSegments map[string][]byte // init segments that segments still in a window need
+
+	// Discontinuity stuff
+	discontinuities  []hlsDiscontinuity // source changes the segmenter hasn't reached yet
+	discontinuitySeq uint64             // discontinuities that left the playlist window
+
+	chapters      []Chapter    // chapters that are still in the playlist window
+	timedMetadata [][]byte     // ID3 tags the segmenter hasn't written yet
+	clipSegments  []HLSSegment // the last ClipBuffer of segments
+	dvr           *dvrStore    // nil without a DVR window
+	vod           *vodWriter   // nil unless the stream is kept as a VOD
 }
 
 // HLSSegment represents a single HLS segment
 type HLSSegment struct {
-	URI      string
-	Duration float64
-	Data     []byte
-	Sequence uint64
+	URI             string
+	Duration        float64
+	Data            []byte
+	Sequence        uint64
+	Parts           []HLSPart // LL-HLS partial segments that make up this segment
+	ProgramDateTime time.Time // wall clock time of the first packet
+	Discontinuity   bool      // the source of the stream changed before this segment
+	InitURI         string    // fMP4 init segment the segment needs
+}
+
+// hlsDiscontinuity is a change of the source of a stream, eg. when the
+// publisher reconnects.  The timestamps jump and the codecs may be different.
+type hlsDiscontinuity struct {
+	at      time.Duration // time of the first packet of the new source
+	streams []av.CodecData
+}
+
+// HLSPart represents an LL-HLS partial segment
+type HLSPart struct {
+	URI         string
+	Duration    float64
+	Independent bool // Starts with a keyframe
+	Data        []byte
 }
 
 // NewHLSChannel creates a new HLS channel
 func NewHLSChannel(que *pubsub.Queue) (*HLSChannel, error) {
+	return NewHLSChannelWithConfig(que, DefaultHLSConfig())
+}
+
+// NewHLSChannelWithConfig creates a new HLS channel with the given configuration
+func NewHLSChannelWithConfig(que *pubsub.Queue, config HLSConfig) (*HLSChannel, error) {
 	if que == nil {
 		return nil, fmt.Errorf("queue cannot be nil")
 	}
 
-	ctx, cancel := context.WithCancel(context.Background())
+	switch config.SegmentFormat {
+	case HLSFormatTS:
+	case HLSFormatFMP4:
+		// fMP4 segments need EXT-X-MAP in media playlists without I-frames, which is version 7
+		if config.HLSVersion < 7 {
+			config.HLSVersion = 7
+		}
+	default:
+		return nil, fmt.Errorf("unknown segment format %q", config.SegmentFormat)
+	}
+
+	// Segments wait for a keyframe until they are this long
+	if config.TargetDuration < config.SegmentDuration {
+		config.TargetDuration = config.SegmentDuration
+	}
 
-	config := DefaultHLSConfig()
+	ctx, cancel := context.WithCancel(context.Background())
 
 	// Create playlist with sliding window for live streaming
 	// Important: Use the proper pattern for sliding window
@@ -164,11 +246,24 @@ func NewHLSChannel(que *pubsub.Queue) (*HLSChannel, error) {
 		sequenceNumber:  0,
 		ctx:             ctx,
 		cancel:          cancel,
+		done:            make(chan struct{}),
 		segmentDuration: config.SegmentDuration,
 		maxSegments:     config.MaxSegments,
 		viewers:         make(map[string]*HLSViewerInfo),
 		config:          config,
 		cleanupTicker:   time.NewTicker(10 * time.Second), // Run cleanup every 10 seconds
+		segmentID:       generateSegmentID(),
+		partDuration:    config.PartDuration,
+		updated:         make(chan struct{}),
+		initSegments:    make(map[string][]byte),
+	}
+
+	if config.DVRWindow > 0 {
+		hls.dvr, err = newDVRStore(config.DVRDir, config.DVRWindow, config.MaxSegments)
+		if err != nil {
+			cancel()
+			return nil, err
+		}
 	}
 
 	// Start background cleanup routine
@@ -191,9 +286,7 @@ func NewHLSChannelWithDeviceOptimization(que *pubsub.Queue, r *http.Request) (*H
 
 	qualitySettings := GetQualitySettings(capabilities)
 
-	ctx, cancel := context.WithCancel(context.Background())
-
-	config := DefaultHLSConfig()
+	config := settings.GetHLSConfig()
 
 	// Apply device-specific optimizations
 	config.BitrateReduction = qualitySettings.BitrateMultiplier
@@ -218,34 +311,11 @@ func NewHLSChannelWithDeviceOptimization(que *pubsub.Queue, r *http.Request) (*H
 		config.MaxConcurrentSegments = 3
 	}
 
-	// Create playlist with device-optimized settings for proper sliding window
-	windowSize := uint(config.MaxSegments)
-	playlist, err := m3u8.NewMediaPlaylist(windowSize, windowSize)
+	hls, err := NewHLSChannelWithConfig(que, config)
 	if err != nil {
-		cancel()
-		return nil, fmt.Errorf("failed to create optimized playlist: %w", err)
-	}
-	playlist.SetVersion(config.HLSVersion)
-	playlist.Closed = false // Keep playlist open for live streaming (sliding window)
-
-	hls := &HLSChannel{
-		que:             que,
-		playlist:        playlist,
-		segments:        make([]HLSSegment, 0),
-		targetDuration:  config.TargetDuration,
-		sequenceNumber:  0,
-		ctx:             ctx,
-		cancel:          cancel,
-		segmentDuration: config.SegmentDuration,
-		maxSegments:     config.MaxSegments,
-		viewers:         make(map[string]*HLSViewerInfo),
-		config:          config,
-		cleanupTicker:   time.NewTicker(10 * time.Second), // Run cleanup every 10 seconds
+		return nil, fmt.Errorf("failed to create optimized HLS channel: %w", err)
 	}
 
-	// Start background cleanup routine
-	go hls.startViewerCleanup()
-
 	common.LogDebugf("Created HLS channel optimized for device: %+v, BitrateReduction=%.2f\n",
 		capabilities, config.BitrateReduction)
 
@@ -267,113 +337,302 @@ func (h *HLSChannel) Stop() {
 	h.Close()
 }
 
-// generateSegments continuously generates HLS segments from the stream using proper TS muxing
+// Done returns a channel that is closed once segment generation has finished.
+// The segmenter only notices Stop with the next packet, closing the queue
+// ends it right away.
+func (h *HLSChannel) Done() <-chan struct{} {
+	if h == nil {
+		return nil
+	}
+	return h.done
+}
+
+// generateSegments continuously generates HLS segments from the stream using proper TS muxing.
+// Segments are cut on video keyframes once the segment duration has been reached, and
+// their durations are taken from the packet timestamps rather than the wall clock.  A
+// segment that would get longer than the target duration is cut without a keyframe.
 func (h *HLSChannel) generateSegments() {
 	if h == nil || h.que == nil {
 		common.LogErrorln("Cannot generate segments: HLS channel or queue is nil")
 		return
 	}
+	defer close(h.done)
+
+	var cursor av.Demuxer = h.que.Latest()
+	var audioOnly *audioOnlyDemuxer
+	if h.config.AudioOnly {
+		audioOnly = newAudioOnlyDemuxer(cursor)
+		cursor = audioOnly
+	}
 
-	cursor := h.que.Latest()
-	if cursor == nil {
-		common.LogErrorln("Cannot get latest cursor from queue")
+	streams, err := cursor.Streams()
+	if err != nil {
+		common.LogErrorf("Cannot read streams for HLS segments: %v\n", err)
 		return
 	}
 
-	// Create segments at regular intervals using TS muxer
-	segmentTimer := time.NewTicker(h.segmentDuration)
-	defer segmentTimer.Stop()
+	h.mutex.Lock()
+	h.streams = streams
+	h.mutex.Unlock()
 
-	var currentSegmentBuffer bytes.Buffer
-	var segmentStartTime time.Time
-	var tsMuxer *ts.Muxer
+	// Audio only streams have no keyframes to wait for and can be cut on any packet
+	videoIdx := videoStreamIndex(streams)
+	maxDuration := maxSegmentDuration(h.targetDuration, h.config.HLSVersion)
+
+	// fMP4 segments share one muxer so the fragment sequence numbers keep counting up
+	var fragmenter *fmp4Muxer
+	if h.config.SegmentFormat == HLSFormatFMP4 {
+		fragmenter, err = newFMP4Muxer(streams)
+		if err != nil {
+			common.LogErrorf("Cannot create fMP4 muxer for HLS segments: %v\n", err)
+			return
+		}
+		h.setInitSegment(fragmenter.InitSegment())
+	}
 
-	// Initialize first segment
-	h.startNewSegment(&currentSegmentBuffer, &tsMuxer, &segmentStartTime)
+	var currentSegmentBuffer bytes.Buffer
+	var writer segmentWriter
+	var segmentStart, lastPacketTime time.Duration
+
+	// The wall clock of the stream is started over at every discontinuity
+	var clockStart time.Time
+	var clockMedia time.Duration
+	var segmentDate time.Time
+	discontinuity := false
+
+	// Low latency parts are cut from the segment buffer as it grows
+	var partStart time.Duration
+	var partOffset int
+	var partIndependent bool
+
+	// endSegment publishes the last part of the segment and the segment itself
+	endSegment := func(end time.Duration) {
+		err := writer.Flush()
+		if err != nil {
+			common.LogErrorf("Error flushing HLS segment: %v\n", err)
+		}
+		h.finalizePart(currentSegmentBuffer.Bytes()[partOffset:], end-partStart, partIndependent)
+		h.finalizeSegment(&currentSegmentBuffer, end-segmentStart, segmentDate, discontinuity)
+		writer = nil
+		discontinuity = false
+	}
 
 	for {
+		packet, err := cursor.ReadPacket()
+		if err != nil {
+			if err != io.EOF {
+				common.LogErrorf("Error reading from stream cursor: %v\n", err)
+			}
+
+			// Finalize any pending segment before exiting
+			if writer != nil {
+				endSegment(lastPacketTime)
+			}
+			return
+		}
+
 		select {
 		case <-h.ctx.Done():
-			// Finalize any pending segment before exiting
-			if currentSegmentBuffer.Len() > 0 {
-				h.finalizeSegment(&currentSegmentBuffer, time.Since(segmentStartTime))
+			if writer != nil {
+				endSegment(lastPacketTime)
 			}
 			return
+		default:
+		}
 
-		case <-segmentTimer.C:
-			// Time-based segmentation - create segment every interval
-			if currentSegmentBuffer.Len() > 0 {
-				h.finalizeSegment(&currentSegmentBuffer, time.Since(segmentStartTime))
-				h.startNewSegment(&currentSegmentBuffer, &tsMuxer, &segmentStartTime)
+		if change, ok := h.nextDiscontinuity(packet.Time); ok {
+			// The new source starts a new segment, with new muxers if the codecs changed
+			if writer != nil {
+				endSegment(packet.Time)
 			}
+			discontinuity = true
 
-		default:
-			// Read and process stream data
-			packet, err := cursor.ReadPacket()
-			if err != nil {
-				if err != io.EOF {
-					common.LogErrorf("Error reading from stream cursor: %v\n", err)
+			// Dates never go back, even if the new source is ahead of the wall clock
+			clockEnd := clockStart.Add(packet.Time - clockMedia)
+			clockStart, clockMedia = time.Now(), packet.Time
+			if clockStart.Before(clockEnd) {
+				clockStart = clockEnd
+			}
+
+			if audioOnly != nil {
+				change.streams = audioOnly.setSource(change.streams)
+			}
+			if len(change.streams) > 0 && !reflect.DeepEqual(change.streams, streams) {
+				common.LogInfof("[HLS] The codecs of %s changed\n", h.config.BaseURI)
+				streams = change.streams
+				videoIdx = videoStreamIndex(streams)
+				h.mutex.Lock()
+				h.streams = streams
+				h.mutex.Unlock()
+
+				if fragmenter != nil {
+					fragmenter, err = newFMP4Muxer(streams)
+					if err != nil {
+						common.LogErrorf("Cannot create fMP4 muxer for HLS segments: %v\n", err)
+						return
+					}
+					h.setInitSegment(fragmenter.InitSegment())
 				}
-				time.Sleep(100 * time.Millisecond)
-				continue
 			}
+		}
 
-			// Write packet to current segment via TS muxer
-			if tsMuxer != nil {
-				err = tsMuxer.WritePacket(packet)
+		if clockStart.IsZero() {
+			clockStart, clockMedia = time.Now(), packet.Time
+		}
+
+		isCutPoint := videoIdx < 0 || (int(packet.Idx) == videoIdx && packet.IsKeyFrame)
+
+		if writer == nil {
+			// Every segment has to start with a keyframe so players can decode it on its own
+			if !isCutPoint {
+				continue
+			}
+		} else {
+			// Segments and parts end where the next packet starts, which likely
+			// comes as late after this one as this one came after the last
+			gap := packet.Time - lastPacketTime
+			elapsed := packet.Time - segmentStart
+			if (isCutPoint && elapsed >= h.segmentDuration) || elapsed+gap > maxDuration {
+				if !isCutPoint {
+					common.LogDebugf("No keyframe after %v, cutting HLS segment anyway\n", elapsed)
+				}
+				endSegment(packet.Time)
+			} else if h.config.EnableLowLatency && h.partDuration > 0 && packet.Time-partStart+gap > h.partDuration {
+				err = writer.Flush()
 				if err != nil {
-					common.LogErrorf("Error writing packet to TS muxer: %v\n", err)
-					continue
+					common.LogErrorf("Error flushing HLS part: %v\n", err)
 				}
+				h.finalizePart(currentSegmentBuffer.Bytes()[partOffset:], packet.Time-partStart, partIndependent)
+				partStart, partOffset, partIndependent = packet.Time, currentSegmentBuffer.Len(), isCutPoint
+			}
+		}
+
+		if writer == nil {
+			writer, err = h.startNewSegment(&currentSegmentBuffer, streams, fragmenter)
+			if err != nil {
+				common.LogErrorf("Failed to start HLS segment: %v\n", err)
+				return
 			}
+			segmentStart = packet.Time
+			segmentDate = clockStart.Add(packet.Time - clockMedia)
+			partStart, partOffset, partIndependent = packet.Time, 0, true
+		}
 
-			// Check if segment is getting too large (fallback protection)
-			if currentSegmentBuffer.Len() > 2*1024*1024 { // 2MB limit
-				common.LogDebugf("Segment size limit reached, creating segment\n")
-				h.finalizeSegment(&currentSegmentBuffer, time.Since(segmentStartTime))
-				h.startNewSegment(&currentSegmentBuffer, &tsMuxer, &segmentStartTime)
+		for _, tag := range h.takeTimedMetadata() {
+			err = writer.WriteMetadata(tag, packet.Time)
+			if err != nil {
+				common.LogErrorf("Error writing timed metadata to HLS segment: %v\n", err)
 			}
 		}
+
+		err = writer.WritePacket(packet)
+		if err != nil {
+			common.LogErrorf("Error writing packet to HLS segment: %v\n", err)
+			continue
+		}
+		lastPacketTime = packet.Time
+	}
+}
+
+// videoStreamIndex returns the index of the first video stream, -1 if there
+// is none
+func videoStreamIndex(streams []av.CodecData) int {
+	for i, stream := range streams {
+		if stream.Type().IsVideo() {
+			return i
+		}
 	}
+	return -1
 }
 
-// startNewSegment initializes a new segment with TS muxer
-func (h *HLSChannel) startNewSegment(buffer *bytes.Buffer, muxer **ts.Muxer, startTime *time.Time) {
+// addDiscontinuity tells the segmenter the source of the stream changes at
+// the packet with the given time
+func (h *HLSChannel) addDiscontinuity(at time.Duration, streams []av.CodecData) {
+	if h == nil {
+		return
+	}
+
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.discontinuities = append(h.discontinuities, hlsDiscontinuity{at: at, streams: streams})
+}
+
+// nextDiscontinuity returns the source change the packet at t belongs to if
+// the segmenter hasn't seen it yet.  Sources that were skipped over are left
+// out.
+func (h *HLSChannel) nextDiscontinuity(t time.Duration) (hlsDiscontinuity, bool) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	var change hlsDiscontinuity
+	found := false
+	for len(h.discontinuities) > 0 && h.discontinuities[0].at <= t {
+		change, found = h.discontinuities[0], true
+		h.discontinuities = h.discontinuities[1:]
+	}
+	return change, found
+}
+
+// segmentWriter muxes the packets of a segment into its buffer
+type segmentWriter interface {
+	WritePacket(pkt av.Packet) error
+
+	// Flush writes any buffered packets so the buffer ends on a part boundary
+	Flush() error
+
+	// WriteMetadata writes a timed ID3 tag at time t
+	WriteMetadata(tag []byte, t time.Duration) error
+}
+
+// tsSegmentWriter writes MPEG-TS segments, which have nothing to flush
+type tsSegmentWriter struct {
+	*ts.Muxer
+	w   io.Writer
+	id3 *tsio.TSWriter // the metadata stream
+}
+
+func (w tsSegmentWriter) Flush() error {
+	return nil
+}
+
+// startNewSegment initializes a new segment.  MPEG-TS segments get their own
+// muxer, fMP4 segments continue the stream's fragmenter.
+func (h *HLSChannel) startNewSegment(buffer *bytes.Buffer, streams []av.CodecData, fragmenter *fmp4Muxer) (segmentWriter, error) {
 	buffer.Reset()
-	*startTime = time.Now()
 
-	// Create new TS muxer that writes to our buffer
-	newMuxer := ts.NewMuxer(buffer)
-
-	// Get the streams from the original queue to initialize the muxer
-	if h.que != nil {
-		// Get stream headers from the queue
-		cursor := h.que.Latest()
-		if cursor != nil {
-			// Try to get the stream headers that were written to the queue
-			streams, err := cursor.Streams()
-			if err == nil && streams != nil && len(streams) > 0 {
-				// Write stream headers to the TS muxer
-				err := newMuxer.WriteHeader(streams)
-				if err != nil {
-					common.LogErrorf("Failed to write stream headers to TS muxer: %v\n", err)
-					// Fall back to creating muxer without headers, but this may cause issues
-				} else {
-					common.LogDebugf("TS muxer initialized with %d streams\n", len(streams))
-				}
-			} else {
-				common.LogDebugf("No streams available for TS muxer initialization\n")
-			}
-		}
+	if fragmenter != nil {
+		common.LogDebugf("Started new fMP4 HLS segment\n")
+		return fmp4SegmentWriter{muxer: fragmenter, w: buffer}, nil
 	}
 
-	*muxer = newMuxer
+	// Create new TS muxer that writes to our buffer
+	writer, err := newTSSegmentWriter(buffer, streams)
+	if err != nil {
+		return nil, fmt.Errorf("failed to write stream headers to TS muxer: %w", err)
+	}
 
 	common.LogDebugf("Started new HLS segment\n")
+	return writer, nil
+}
+
+// setInitSegment stores the fMP4 init segment and adds it to the playlist as
+// the EXT-X-MAP
+func (h *HLSChannel) setInitSegment(data []byte) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	h.initURI = fmt.Sprintf("%s/init_%s.mp4", h.config.BaseURI, generateSegmentID())
+	h.initSegments[h.initURI] = data
+
+	// Until the segments of the old one leave the window they carry their own EXT-X-MAP
+	if h.playlist.Count() == 0 {
+		h.playlist.SetDefaultMap(h.initURI, 0, 0)
+	}
 }
 
-// finalizeSegment completes the current segment and adds it to the playlist
-func (h *HLSChannel) finalizeSegment(buffer *bytes.Buffer, duration time.Duration) {
+// finalizeSegment completes the current segment and adds it to the playlist.
+// date is the wall clock time of its first packet.
+func (h *HLSChannel) finalizeSegment(buffer *bytes.Buffer, duration time.Duration, date time.Time, discontinuity bool) {
 	if buffer.Len() == 0 {
 		return
 	}
@@ -382,19 +641,23 @@ func (h *HLSChannel) finalizeSegment(buffer *bytes.Buffer, duration time.Duratio
 	segmentData := make([]byte, buffer.Len())
 	copy(segmentData, buffer.Bytes())
 
+	h.mutex.Lock()
 	currentSeq := h.sequenceNumber
 	h.sequenceNumber++
+	segmentURI := h.segmentURI(h.segmentID)
+	initURI := h.initURI
+	h.mutex.Unlock()
 
-	// Generate unique segment ID to avoid browser caching issues across service restarts
-	segmentID := generateSegmentID()
-	segmentURI := fmt.Sprintf("/live/segment_%s.ts", segmentID)
 	durationSeconds := duration.Seconds()
 
 	segment := HLSSegment{
-		URI:      segmentURI,
-		Duration: durationSeconds,
-		Data:     segmentData,
-		Sequence: currentSeq, // Keep sequence for internal ordering
+		URI:             segmentURI,
+		Duration:        durationSeconds,
+		Data:            segmentData,
+		Sequence:        currentSeq, // Keep sequence for internal ordering
+		ProgramDateTime: date.UTC().Truncate(time.Millisecond),
+		Discontinuity:   discontinuity,
+		InitURI:         initURI,
 	}
 
 	// Add segment with proper sliding window management
@@ -404,6 +667,34 @@ func (h *HLSChannel) finalizeSegment(buffer *bytes.Buffer, duration time.Duratio
 		currentSeq, len(segmentData), durationSeconds)
 }
 
+// trimInitSegments drops the init segments that neither the current segment
+// nor a segment of the playlist, the clip buffer or the DVR window needs.
+// Caller must hold the mutex.
+func (h *HLSChannel) trimInitSegments() {
+	if len(h.initSegments) < 2 {
+		return
+	}
+
+	used := map[string]bool{h.initURI: true}
+	for _, segment := range h.segments {
+		used[segment.InitURI] = true
+	}
+	for _, segment := range h.clipSegments {
+		used[segment.InitURI] = true
+	}
+	if h.dvr != nil {
+		for _, segment := range h.dvr.segments {
+			used[segment.InitURI] = true
+		}
+	}
+
+	for uri := range h.initSegments {
+		if !used[uri] {
+			delete(h.initSegments, uri)
+		}
+	}
+}
+
 // createSegment creates a new HLS segment
 // addGeneratedSegment adds a generated segment to the HLS channel with proper sliding window
 func (h *HLSChannel) addGeneratedSegment(segment HLSSegment) {
@@ -411,8 +702,41 @@ func (h *HLSChannel) addGeneratedSegment(segment HLSSegment) {
 		return
 	}
 
+	// The disk is written to after the mutex is released
+	vod, init, writes := h.insertSegment(segment)
+	if vod != nil {
+		vod.addSegment(init, segment)
+	}
+	if h.dvr != nil && (len(writes.spill) > 0 || len(writes.remove) > 0) {
+		h.dvr.write(writes)
+
+		h.mutex.Lock()
+		leftover := h.dvr.spilled(writes)
+		h.mutex.Unlock()
+
+		for _, file := range leftover {
+			h.dvr.remove(file)
+		}
+	}
+}
+
+// insertSegment puts a segment in the playlist.  It returns the VOD the
+// segment goes to along with its init segment, and what is left to write to
+// the DVR window.
+func (h *HLSChannel) insertSegment(segment HLSSegment) (vod *vodWriter, init []byte, writes dvrWrites) {
 	h.mutex.Lock()
 	defer h.mutex.Unlock()
+	defer h.notifyUpdate()
+	defer h.trimInitSegments()
+
+	// The parts that were published while the segment was generated belong to it
+	if segment.Parts == nil {
+		segment.Parts = h.pendingParts
+	}
+	h.pendingParts = nil
+
+	// Generate unique segment ID to avoid browser caching issues across service restarts
+	h.segmentID = generateSegmentID()
 
 	// Add segment to our local list with sliding window management
 	h.segments = append(h.segments, segment)
@@ -421,9 +745,36 @@ func (h *HLSChannel) addGeneratedSegment(segment HLSSegment) {
 	if len(h.segments) > h.maxSegments {
 		// Remove oldest segments to maintain window size
 		excess := len(h.segments) - h.maxSegments
+		for _, old := range h.segments[:excess] {
+			if old.Discontinuity {
+				h.discontinuitySeq++
+			}
+		}
 		h.segments = h.segments[excess:]
 	}
 
+	if h.config.ClipBuffer > 0 {
+		h.clipSegments = append(h.clipSegments, segment)
+		h.clipSegments = trimSegments(h.clipSegments, h.config.ClipBuffer)
+	}
+
+	if h.vod != nil {
+		vod, init = h.vod, h.initSegments[segment.InitURI]
+	}
+
+	if h.dvr != nil {
+		// The playlist is the whole DVR window instead of the newest segments
+		writes = h.dvr.add(segment)
+		playlist, err := h.dvr.playlist(h.config.HLSVersion, h.initURI)
+		if err != nil {
+			common.LogErrorf("Failed to create DVR playlist: %v\n", err)
+			return
+		}
+		h.playlist = playlist
+		h.updateDateRanges()
+		return
+	}
+
 	// If this is the first segment, set the initial MediaSequence
 	if h.playlist.Count() == 0 {
 		h.playlist.SeqNo = segment.Sequence
@@ -440,6 +791,7 @@ func (h *HLSChannel) addGeneratedSegment(segment HLSSegment) {
 		}
 		newPlaylist.SetVersion(h.config.HLSVersion)
 		newPlaylist.Closed = false
+		newPlaylist.DiscontinuitySeq = h.discontinuitySeq
 
 		// Add only the segments that should remain (excluding the oldest one)
 		segmentsToKeep := h.maxSegments - 1 // Leave room for the new segment
@@ -451,11 +803,13 @@ func (h *HLSChannel) addGeneratedSegment(segment HLSSegment) {
 		// Set the media sequence to match the first segment that will be in the new playlist
 		if startIdx < len(h.segments) {
 			newPlaylist.SeqNo = h.segments[startIdx].Sequence
+			if uri := h.segments[startIdx].InitURI; uri != "" {
+				newPlaylist.SetDefaultMap(uri, 0, 0)
+			}
 		}
 
 		for i := startIdx; i < len(h.segments)-1; i++ { // -1 because we haven't added the new segment yet
-			seg := h.segments[i]
-			newPlaylist.Append(seg.URI, seg.Duration, "")
+			appendSegment(newPlaylist, h.segments[i])
 		}
 
 		// Replace the old playlist
@@ -463,17 +817,152 @@ func (h *HLSChannel) addGeneratedSegment(segment HLSSegment) {
 	}
 
 	// Now add the new segment
-	h.playlist.Append(segment.URI, segment.Duration, "")
-
-	// Update target duration if needed
-	duration := time.Duration(segment.Duration * float64(time.Second))
-	if duration > h.targetDuration {
-		h.targetDuration = duration
-		h.playlist.TargetDuration = uint(segment.Duration)
+	err := appendSegment(h.playlist, segment)
+	if err != nil {
+		common.LogErrorf("Failed to add segment to playlist: %v\n", err)
 	}
+	h.updateDateRanges()
 
 	common.LogDebugf("Added generated HLS segment %d with duration %.2fs (playlist count: %d/%d)\n",
 		segment.Sequence, segment.Duration, h.playlist.Count(), h.maxSegments)
+	return
+}
+
+// appendSegment adds a segment to a playlist along with its date,
+// discontinuity and init segment
+func appendSegment(playlist *m3u8.MediaPlaylist, segment HLSSegment) error {
+	seg := &m3u8.MediaSegment{
+		URI:             segment.URI,
+		Duration:        segment.Duration,
+		Discontinuity:   segment.Discontinuity,
+		ProgramDateTime: segment.ProgramDateTime,
+	}
+	if segment.InitURI != "" {
+		seg.Map = &m3u8.Map{URI: segment.InitURI}
+	}
+	return playlist.AppendSegment(seg)
+}
+
+// addChapter adds a chapter to the playlist as an EXT-X-DATERANGE
+func (h *HLSChannel) addChapter(chapter Chapter) {
+	if h == nil || h.playlist == nil {
+		return
+	}
+
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	h.chapters = append(h.chapters, chapter)
+	h.updateDateRanges()
+}
+
+// updateDateRanges drops the chapters that are over before the first segment
+// of the playlist and puts the rest in it.  Caller must hold the mutex.
+func (h *HLSChannel) updateDateRanges() {
+	var first time.Time
+	if h.dvr != nil && len(h.dvr.segments) > 0 {
+		first = h.dvr.segments[0].ProgramDateTime
+	} else if h.dvr == nil && len(h.segments) > 0 {
+		first = h.segments[0].ProgramDateTime
+	}
+	if !first.IsZero() {
+		h.chapters = trimChapters(h.chapters, first)
+	}
+
+	h.playlist.DateRanges = nil
+	for _, chapter := range h.chapters {
+		h.playlist.DateRanges = append(h.playlist.DateRanges, chapter.dateRange())
+	}
+	h.playlist.ResetCache()
+}
+
+// setVOD sets the VOD the finished segments are written to, nil stops writing
+// them
+func (h *HLSChannel) setVOD(writer *vodWriter) {
+	if h == nil {
+		return
+	}
+
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.vod = writer
+}
+
+// trimSegments drops the oldest segments that aren't needed to cover length
+func trimSegments(segments []HLSSegment, length time.Duration) []HLSSegment {
+	total := 0.0
+	for _, segment := range segments {
+		total += segment.Duration
+	}
+
+	drop := 0
+	for drop < len(segments)-1 && total-segments[drop].Duration >= length.Seconds() {
+		total -= segments[drop].Duration
+		drop++
+	}
+	if drop == 0 {
+		return segments
+	}
+	return append([]HLSSegment(nil), segments[drop:]...)
+}
+
+// RecentSegments returns the newest segments that cover length, or as many as
+// there are, and the init segment needed to play them.  The segments all
+// share that init segment, so they don't go back past a change of codecs.
+func (h *HLSChannel) RecentSegments(length time.Duration) ([]byte, []HLSSegment) {
+	if h == nil {
+		return nil, nil
+	}
+
+	h.mutex.RLock()
+	defer h.mutex.RUnlock()
+
+	source := h.segments
+	if h.config.ClipBuffer > 0 {
+		source = h.clipSegments
+	}
+
+	if len(source) == 0 {
+		return nil, nil
+	}
+	initURI := source[len(source)-1].InitURI
+
+	start := len(source)
+	total := 0.0
+	for start > 0 && total < length.Seconds() && source[start-1].InitURI == initURI {
+		start--
+		total += source[start].Duration
+	}
+	return h.initSegments[initURI], append([]HLSSegment(nil), source[start:]...)
+}
+
+// segmentURI returns the URI of the segment with the given ID
+func (h *HLSChannel) segmentURI(segmentID string) string {
+	if h.config.SegmentFormat == HLSFormatFMP4 {
+		return fmt.Sprintf("%s/segment_%s.m4s", h.config.BaseURI, segmentID)
+	}
+	return fmt.Sprintf("%s/segment_%s.ts", h.config.BaseURI, segmentID)
+}
+
+// targetDurationSeconds converts the longest segment duration into an
+// EXT-X-TARGETDURATION value.  Version 6 and later round to the nearest
+// second, older versions round up.
+func targetDurationSeconds(duration time.Duration, version uint8) uint {
+	if version < 6 {
+		return uint(math.Ceil(duration.Seconds()))
+	}
+	return uint(math.Round(duration.Seconds()))
+}
+
+// maxSegmentDuration is the longest a segment can get before its duration
+// rounds up past the EXT-X-TARGETDURATION of target.  The target duration of
+// a playlist must not change, so segments are cut to fit it.
+func maxSegmentDuration(target time.Duration, version uint8) time.Duration {
+	seconds := time.Duration(targetDurationSeconds(target, version)) * time.Second
+	if version < 6 {
+		return seconds
+	}
+	return seconds + time.Second/2 - time.Millisecond
 }
 
 // GetPlaylist returns the current m3u8 playlist
@@ -482,12 +971,15 @@ func (h *HLSChannel) GetPlaylist() string {
 		return ""
 	}
 
-	h.mutex.RLock()
-	defer h.mutex.RUnlock()
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
 
 	// Set final playlist properties
-	h.playlist.TargetDuration = uint(h.targetDuration.Seconds())
+	h.playlist.TargetDuration = targetDurationSeconds(h.targetDuration, h.config.HLSVersion)
 
+	if h.config.EnableLowLatency {
+		return h.lowLatencyPlaylist()
+	}
 	return h.playlist.String()
 }
 
@@ -530,10 +1022,33 @@ func (h *HLSChannel) GetSegmentByURI(uri string) ([]byte, error) {
 	h.mutex.RLock()
 	defer h.mutex.RUnlock()
 
+	if data, ok := h.initSegments[uri]; ok {
+		return data, nil
+	}
+
 	for _, segment := range h.segments {
 		if segment.URI == uri {
 			return segment.Data, nil
 		}
+
+		for _, part := range segment.Parts {
+			if part.URI == uri {
+				return part.Data, nil
+			}
+		}
+	}
+
+	for _, part := range h.pendingParts {
+		if part.URI == uri {
+			return part.Data, nil
+		}
+	}
+
+	// Viewers that rewound
+	if h.dvr != nil {
+		if data, ok := h.dvr.get(uri); ok {
+			return data, nil
+		}
 	}
 
 	return nil, fmt.Errorf("segment with URI %s not found", uri)
@@ -667,6 +1182,12 @@ func (h *HLSChannel) Close() {
 	h.viewers = make(map[string]*HLSViewerInfo)
 	h.viewersMutex.Unlock()
 
+	h.mutex.Lock()
+	if h.dvr != nil {
+		h.dvr.close()
+	}
+	h.mutex.Unlock()
+
 	common.LogInfof("[HLS] Channel closed and all viewers cleaned up\n")
 }
 
@@ -697,8 +1218,9 @@ func IsValidSegmentURI(uri string) bool {
 		return false
 	}
 
-	// Check if it's a .ts segment
-	if !strings.HasSuffix(uri, ".ts") {
+	// Check if it's a .ts or fMP4 .m4s segment
+	ext := path.Ext(uri)
+	if ext != ".ts" && ext != ".m4s" {
 		return false
 	}
 
@@ -715,7 +1237,7 @@ func IsValidSegmentURI(uri string) bool {
 	}
 
 	// Extract identifier and validate
-	name := strings.TrimSuffix(filename, ".ts")
+	name := strings.TrimSuffix(filename, ext)
 	parts := strings.Split(name, "_")
 	if len(parts) != 2 {
 		return false
@@ -740,6 +1262,34 @@ func IsValidSegmentURI(uri string) bool {
 	return false
 }
 
+// IsValidInitURI checks if a URI is an fMP4 init segment like "init_<id>.mp4"
+func IsValidInitURI(uri string) bool {
+	filename := path.Base(uri)
+	if !strings.HasPrefix(filename, "init_") || !strings.HasSuffix(filename, ".mp4") {
+		return false
+	}
+
+	identifier := strings.TrimSuffix(strings.TrimPrefix(filename, "init_"), ".mp4")
+	if len(identifier) != 32 {
+		return false
+	}
+	_, err := hex.DecodeString(identifier)
+	return err == nil
+}
+
+// hlsSegmentContentType returns the Content-Type of a segment, part or init
+// segment URI
+func hlsSegmentContentType(uri string) string {
+	switch path.Ext(uri) {
+	case ".m4s":
+		return GetContentTypeForFormat("m4s")
+	case ".mp4":
+		return GetContentTypeForFormat("mp4")
+	default:
+		return GetContentTypeForFormat("ts")
+	}
+}
+
 // ParseSequenceFromURI extracts sequence number from segment URI
 // Note: This function is deprecated for UUID-based segments and maintained for backward compatibility
 func ParseSequenceFromURI(uri string) (uint64, error) {
@@ -755,7 +1305,7 @@ func ParseSequenceFromURI(uri string) (uint64, error) {
 	}
 
 	// Extract identifier from "segment_IDENTIFIER.ts"
-	name := strings.TrimSuffix(filename, ".ts")
+	name := strings.TrimSuffix(filename, path.Ext(filename))
 	parts := strings.Split(name, "_")
 	if len(parts) != 2 {
 		return 0, fmt.Errorf("invalid segment URI format: %s", uri)
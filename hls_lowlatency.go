@@ -0,0 +1,252 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Eyevinn/hls-m3u8/m3u8"
+)
+
+// lowLatencyPartSegments is how many of the newest segments list their parts
+// in the playlist.  Older parts are dropped as the spec allows.
+const lowLatencyPartSegments = 3
+
+var (
+	errPartTooFarAhead = errors.New("requested segment is too far ahead of the live edge")
+	errPartTimeout     = errors.New("timed out waiting for the requested segment")
+)
+
+// hlsPartURI returns the URI of a partial segment of the given segment
+func hlsPartURI(segmentURI string, index int) string {
+	ext := path.Ext(segmentURI)
+	return fmt.Sprintf("%s.%d%s", strings.TrimSuffix(segmentURI, ext), index, ext)
+}
+
+// IsValidPartURI checks if a URI is a partial segment of a valid segment URI
+func IsValidPartURI(uri string) bool {
+	ext := path.Ext(uri)
+	if ext != ".ts" && ext != ".m4s" {
+		return false
+	}
+	name := strings.TrimSuffix(uri, ext)
+
+	dot := strings.LastIndex(name, ".")
+	if dot < 0 {
+		return false
+	}
+
+	if _, err := strconv.ParseUint(name[dot+1:], 10, 32); err != nil {
+		return false
+	}
+
+	return IsValidSegmentURI(name[:dot] + ext)
+}
+
+// finalizePart publishes a partial segment of the segment that is being
+// generated.  Does nothing when low latency is disabled.
+func (h *HLSChannel) finalizePart(data []byte, duration time.Duration, independent bool) {
+	if !h.config.EnableLowLatency || len(data) == 0 {
+		return
+	}
+
+	partData := make([]byte, len(data))
+	copy(partData, data)
+
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	h.pendingParts = append(h.pendingParts, HLSPart{
+		URI:         hlsPartURI(h.segmentURI(h.segmentID), len(h.pendingParts)),
+		Duration:    duration.Seconds(),
+		Independent: independent,
+		Data:        partData,
+	})
+	h.pendingSequence = h.sequenceNumber
+
+	h.notifyUpdate()
+}
+
+// notifyUpdate wakes up everything that is waiting for a new part or
+// segment.  Caller must hold the mutex.
+func (h *HLSChannel) notifyUpdate() {
+	close(h.updated)
+	h.updated = make(chan struct{})
+}
+
+// hasPart checks if media sequence number msn, or the given part of it, is
+// available.  A negative part waits for the whole segment.  Caller must hold
+// the mutex.
+func (h *HLSChannel) hasPart(msn uint64, part int) (ready bool, tooFar bool) {
+	var lastSeq uint64
+	if len(h.segments) > 0 {
+		lastSeq = h.segments[len(h.segments)-1].Sequence
+		if lastSeq >= msn {
+			return true, false
+		}
+	}
+
+	// The spec allows requests up to two segments past the last one
+	if msn > lastSeq+2 {
+		return false, true
+	}
+
+	if part >= 0 && len(h.pendingParts) > part && h.pendingSequence == msn {
+		return true, false
+	}
+	return false, false
+}
+
+// WaitForPart blocks until the playlist contains media sequence number msn,
+// or the given part of it if part isn't negative.  This is used for LL-HLS
+// blocking playlist reloads.
+func (h *HLSChannel) WaitForPart(ctx context.Context, msn uint64, part int) error {
+	h.mutex.RLock()
+	timeout := time.NewTimer(3 * h.targetDuration)
+	h.mutex.RUnlock()
+	defer timeout.Stop()
+
+	for {
+		h.mutex.RLock()
+		ready, tooFar := h.hasPart(msn, part)
+		updated := h.updated
+		h.mutex.RUnlock()
+
+		if tooFar {
+			return errPartTooFarAhead
+		}
+		if ready {
+			return nil
+		}
+
+		select {
+		case <-updated:
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-h.ctx.Done():
+			return errPartTimeout
+		case <-timeout.C:
+			return errPartTimeout
+		}
+	}
+}
+
+// WaitForSegmentByURI returns a segment or part by its URI.  If it doesn't
+// exist yet it waits for a short while, so players can request the part in
+// the preload hint before it is ready.
+func (h *HLSChannel) WaitForSegmentByURI(ctx context.Context, uri string) ([]byte, error) {
+	h.mutex.RLock()
+	timeout := time.NewTimer(3 * h.partDuration)
+	h.mutex.RUnlock()
+	defer timeout.Stop()
+
+	for {
+		h.mutex.RLock()
+		updated := h.updated
+		h.mutex.RUnlock()
+
+		data, err := h.GetSegmentByURI(uri)
+		if err == nil {
+			return data, nil
+		}
+
+		select {
+		case <-updated:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-h.ctx.Done():
+			return nil, err
+		case <-timeout.C:
+			return nil, err
+		}
+	}
+}
+
+// lowLatencyPlaylist renders the playlist with LL-HLS parts, server control
+// and the preload hint for the next part.  Caller must hold the mutex.
+func (h *HLSChannel) lowLatencyPlaylist() string {
+	// Parts are cut before they get longer than the part duration
+	partTarget := h.partDuration.Seconds()
+	h.playlist.PartTargetDuration = partTarget
+	h.playlist.ServerControl = &m3u8.ServerControl{
+		CanBlockReload: true,
+		PartHoldBack:   3 * partTarget,
+	}
+
+	// Only the newest segments list their parts
+	recentParts := map[string][]HLSPart{}
+	for i := len(h.segments) - lowLatencyPartSegments; i < len(h.segments); i++ {
+		if i >= 0 {
+			recentParts[h.segments[i].URI] = h.segments[i].Parts
+		}
+	}
+
+	for _, seg := range h.playlist.Segments {
+		if seg == nil {
+			continue
+		}
+
+		if parts := recentParts[seg.URI]; len(parts) > 0 {
+			seg.Custom = m3u8.CustomMap{partsTagName: partsTag(parts)}
+		} else {
+			seg.Custom = nil
+		}
+	}
+	h.playlist.ResetCache()
+
+	buf := bytes.NewBufferString(h.playlist.String())
+	for _, part := range h.pendingParts {
+		writePartTag(buf, part)
+		buf.WriteString("\n")
+	}
+
+	nextPart := hlsPartURI(h.segmentURI(h.segmentID), len(h.pendingParts))
+	fmt.Fprintf(buf, "#EXT-X-PRELOAD-HINT:TYPE=PART,URI=\"%s\"\n", nextPart)
+
+	return buf.String()
+}
+
+const partsTagName = "#EXT-X-PART:"
+
+// partsTag writes the EXT-X-PART tags of a finished segment in front of its
+// EXTINF line
+type partsTag []HLSPart
+
+func (t partsTag) TagName() string {
+	return partsTagName
+}
+
+func (t partsTag) Encode() *bytes.Buffer {
+	if len(t) == 0 {
+		return nil
+	}
+
+	buf := &bytes.Buffer{}
+	for i, part := range t {
+		if i > 0 {
+			buf.WriteString("\n")
+		}
+		writePartTag(buf, part)
+	}
+	return buf
+}
+
+func (t partsTag) String() string {
+	if buf := t.Encode(); buf != nil {
+		return buf.String()
+	}
+	return ""
+}
+
+// writePartTag writes a single EXT-X-PART tag without a trailing newline
+func writePartTag(buf *bytes.Buffer, part HLSPart) {
+	fmt.Fprintf(buf, "#EXT-X-PART:DURATION=%.3f,URI=\"%s\"", part.Duration, part.URI)
+	if part.Independent {
+		buf.WriteString(",INDEPENDENT=YES")
+	}
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/Eyevinn/hls-m3u8/m3u8"
+	"github.com/nareix/joy4/av"
+	"github.com/nareix/joy4/codec/aacparser"
+	"github.com/nareix/joy4/codec/h264parser"
+	"github.com/zorchenhimer/MovieNight/common"
+)
+
+var errNoRenditions = errors.New("no renditions are ready")
+
+// splitRenditionName splits a stream published as "<name>_<rendition>" into
+// its group and rendition.  Streams without a rendition are their own group.
+func splitRenditionName(streamPath string) (group, rendition string) {
+	idx := strings.LastIndex(streamPath, "_")
+	if idx <= 0 || idx == len(streamPath)-1 {
+		return streamPath, ""
+	}
+	return streamPath[:idx], streamPath[idx+1:]
+}
+
+// rendition is a single variant of a channel group
+type rendition struct {
+	streamPath string
+	ch         *Channel
+}
+
+// findRenditions returns the channels that belong to a group, the plain
+// "<name>" stream included, with the highest resolution first.  The caller is
+// expected to hold the channel lock.
+func findRenditions(group string) []rendition {
+	var found []rendition
+	for streamPath, ch := range channels {
+		if g, _ := splitRenditionName(streamPath); streamPath == group || g == group {
+			found = append(found, rendition{streamPath: streamPath, ch: ch})
+		}
+	}
+
+	sort.Slice(found, func(i, j int) bool {
+		hi, hj := found[i].ch.hlsChan.videoHeight(), found[j].ch.hlsChan.videoHeight()
+		if hi != hj {
+			return hi > hj
+		}
+		return found[i].streamPath < found[j].streamPath
+	})
+	return found
+}
+
+// groupChannel returns the channel viewers of name should watch.  That is the
+// stream published as name itself, or the best rendition of the group.
+func groupChannel(name string) (*Channel, bool) {
+	l.RLock()
+	defer l.RUnlock()
+
+	if ch, ok := channels[name]; ok {
+		return ch, true
+	}
+	if found := findRenditions(name); len(found) > 0 {
+		return found[0].ch, true
+	}
+	return nil, false
+}
+
+// hasRenditions checks if the group of name has more than one stream
+func hasRenditions(name string) bool {
+	l.RLock()
+	defer l.RUnlock()
+	return len(findRenditions(name)) > 1
+}
+
+// MasterPlaylist renders an EXT-X-STREAM-INF master playlist that points at
+// the media playlist of every rendition in the group the requester can watch.
+// Backstage renditions are only listed for mods and admins.
+func MasterPlaylist(group string, level common.CommandLevel) (string, error) {
+	l.RLock()
+	var found []rendition
+	for _, r := range findRenditions(group) {
+		if !r.ch.backstage || level >= common.CmdlMod {
+			found = append(found, r)
+		}
+	}
+	l.RUnlock()
+
+	master := m3u8.NewMasterPlaylist()
+	for _, r := range found {
+		params, ok := r.ch.hlsChan.variantParams()
+		if !ok {
+			continue
+		}
+		_, name := splitRenditionName(r.streamPath)
+		if r.streamPath == group {
+			name = "source"
+		}
+		params.Name = name
+		master.Append(fmt.Sprintf("/hls/%s/playlist.m3u8", r.streamPath), nil, params)
+	}
+
+	if len(master.Variants) == 0 {
+		return "", errNoRenditions
+	}
+
+	// One audio only variant for bad connections.  Every rendition carries
+	// the same audio so it doesn't matter which one it comes from.
+	for _, r := range found {
+		if params, ok := r.ch.audioHLS.variantParams(); ok {
+			params.Name = "audio"
+			master.Append(fmt.Sprintf("/hls/%s/audio/playlist.m3u8", r.streamPath), nil, params)
+			break
+		}
+	}
+
+	return master.String(), nil
+}
+
+// variantParams describes the stream for the master playlist.  Returns false
+// until there are segments to measure the bandwidth from.
+func (h *HLSChannel) variantParams() (m3u8.VariantParams, bool) {
+	if h == nil {
+		return m3u8.VariantParams{}, false
+	}
+
+	h.mutex.RLock()
+	defer h.mutex.RUnlock()
+
+	var peak, total, duration float64
+	for _, seg := range h.segments {
+		if seg.Duration <= 0 {
+			continue
+		}
+		bits := float64(len(seg.Data) * 8)
+		if rate := bits / seg.Duration; rate > peak {
+			peak = rate
+		}
+		total += bits
+		duration += seg.Duration
+	}
+	if duration == 0 {
+		return m3u8.VariantParams{}, false
+	}
+
+	params := m3u8.VariantParams{
+		Bandwidth:        uint32(peak),
+		AverageBandwidth: uint32(total / duration),
+	}
+
+	var codecs []string
+	for _, stream := range h.streams {
+		if codec := rfc6381Codec(stream); codec != "" {
+			codecs = append(codecs, codec)
+		}
+		if video, ok := stream.(av.VideoCodecData); ok {
+			params.Resolution = fmt.Sprintf("%dx%d", video.Width(), video.Height())
+		}
+	}
+	params.Codecs = strings.Join(codecs, ",")
+
+	return params, true
+}
+
+// videoHeight returns the height of the video stream, or 0 for audio only
+// streams and streams that haven't started segmenting
+func (h *HLSChannel) videoHeight() int {
+	if h == nil {
+		return 0
+	}
+
+	h.mutex.RLock()
+	defer h.mutex.RUnlock()
+
+	for _, stream := range h.streams {
+		if video, ok := stream.(av.VideoCodecData); ok {
+			return video.Height()
+		}
+	}
+	return 0
+}
+
+// rfc6381Codec returns the codec string used in CODECS attributes, or an
+// empty string for codecs that aren't known
+func rfc6381Codec(stream av.CodecData) string {
+	switch codec := stream.(type) {
+	case h264parser.CodecData:
+		info := codec.RecordInfo
+		return fmt.Sprintf("avc1.%02x%02x%02x", info.AVCProfileIndication, info.ProfileCompatibility, info.AVCLevelIndication)
+	case aacparser.CodecData:
+		return fmt.Sprintf("mp4a.40.%d", codec.Config.ObjectType)
+	}
+	return ""
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/nareix/joy4/av"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/zorchenhimer/MovieNight/common"
+)
+
+func TestSplitRenditionName(t *testing.T) {
+	tests := []struct {
+		streamPath string
+		group      string
+		rendition  string
+	}{
+		{"live", "live", ""},
+		{"live_720p", "live", "720p"},
+		{"movie_night_480p", "movie_night", "480p"},
+		{"_720p", "_720p", ""},
+		{"live_", "live_", ""},
+	}
+
+	for _, tt := range tests {
+		group, rendition := splitRenditionName(tt.streamPath)
+		assert.Equal(t, tt.group, group, tt.streamPath)
+		assert.Equal(t, tt.rendition, rendition, tt.streamPath)
+	}
+}
+
+func TestMasterPlaylist(t *testing.T) {
+	common.SetupLogging(common.LLError, "/dev/null")
+
+	newRendition := func(bytesPerSecond int) *Channel {
+		queue := newTestQueue(t, av.H264)
+		streams, err := queue.Latest().Streams()
+		require.NoError(t, err)
+
+		hlsChan, err := NewHLSChannel(queue)
+		require.NoError(t, err)
+		t.Cleanup(hlsChan.Close)
+
+		hlsChan.streams = streams
+		hlsChan.segments = []HLSSegment{
+			{Duration: 1, Data: make([]byte, bytesPerSecond)},
+			{Duration: 2, Data: make([]byte, bytesPerSecond)},
+		}
+		return &Channel{que: queue, hlsChan: hlsChan}
+	}
+
+	l.Lock()
+	channels["group-test_high"] = newRendition(2000)
+	channels["group-test_low"] = newRendition(1000)
+	channels["other"] = newRendition(1000)
+	l.Unlock()
+	defer func() {
+		l.Lock()
+		delete(channels, "group-test_high")
+		delete(channels, "group-test_low")
+		delete(channels, "other")
+		l.Unlock()
+	}()
+
+	assert.True(t, hasRenditions("group-test"))
+	assert.False(t, hasRenditions("other"))
+
+	ch, ok := groupChannel("group-test")
+	require.True(t, ok)
+	assert.NotNil(t, ch)
+
+	playlist, err := MasterPlaylist("group-test", common.CmdlUser)
+	require.NoError(t, err)
+	assert.Contains(t, playlist, "#EXT-X-STREAM-INF:")
+	assert.Contains(t, playlist, "BANDWIDTH=16000,AVERAGE-BANDWIDTH=10666")
+	assert.Contains(t, playlist, "CODECS=\"avc1.42c01e\"")
+	assert.Contains(t, playlist, "RESOLUTION=")
+	assert.Contains(t, playlist, "/hls/group-test_high/playlist.m3u8")
+	assert.Contains(t, playlist, "/hls/group-test_low/playlist.m3u8")
+	assert.NotContains(t, playlist, "/hls/other/")
+
+	// Only mods see the renditions that are still backstage
+	l.Lock()
+	channels["group-test_low"].backstage = true
+	l.Unlock()
+	playlist, err = MasterPlaylist("group-test", common.CmdlUser)
+	require.NoError(t, err)
+	assert.NotContains(t, playlist, "/hls/group-test_low/")
+	playlist, err = MasterPlaylist("group-test", common.CmdlMod)
+	require.NoError(t, err)
+	assert.Contains(t, playlist, "/hls/group-test_low/")
+
+	_, err = MasterPlaylist("missing", common.CmdlMod)
+	assert.ErrorIs(t, err, errNoRenditions)
+}
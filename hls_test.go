@@ -1,12 +1,17 @@
 package main
 
 import (
+	"bytes"
+	"context"
 	"fmt"
 	"net/http/httptest"
+	"strings"
 	"testing"
 	"time"
 
+	"github.com/nareix/joy4/av"
 	"github.com/nareix/joy4/av/pubsub"
+	"github.com/nareix/joy4/codec/h264parser"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 	"github.com/zorchenhimer/MovieNight/common"
@@ -92,6 +97,9 @@ func TestIsValidSegmentURI(t *testing.T) {
 		{"/live/segment_1234567890abcdef1234567890abcdef.ts", true},
 		{"segment_ABCDEF1234567890abcdef1234567890.ts", true},
 
+		// fMP4 segments
+		{"/live/segment_1234567890abcdef1234567890abcdef.m4s", true},
+
 		// Invalid formats
 		{"invalid.ts", false},
 		{"segment_0.mp4", false},
@@ -341,6 +349,330 @@ func TestHLSChannel_SlidingWindow(t *testing.T) {
 		"Should have exactly maxSegments in playlist")
 }
 
+func TestHLSChannel_KeyframeSegmentation(t *testing.T) {
+	common.SetupLogging(common.LLError, "/dev/null")
+
+	queue := newTestQueue(t, av.H264)
+	queue.SetMaxGopCount(100) // keep every packet around until the segmenter has read it
+	hlsChan, err := NewHLSChannel(queue)
+	require.NoError(t, err)
+	defer hlsChan.Stop()
+
+	hlsChan.segmentDuration = time.Second
+	require.NoError(t, hlsChan.Start())
+
+	// Give the segmenter a moment to attach its cursor to the queue
+	time.Sleep(50 * time.Millisecond)
+
+	// 10 fps with a keyframe every 500ms.  The first frame isn't a keyframe and
+	// must not end up in a segment.
+	for i := 0; i <= 30; i++ {
+		err = queue.WritePacket(av.Packet{
+			Time:       time.Duration(i) * 100 * time.Millisecond,
+			IsKeyFrame: i > 0 && i%5 == 0,
+			Data:       []byte{0x00, 0x00, 0x00, 0x02, 0x09, 0xf0},
+		})
+		require.NoError(t, err)
+	}
+	queue.Close()
+	waitForDone(t, hlsChan.Done())
+
+	var durations []float64
+	assert.Eventually(t, func() bool {
+		hlsChan.mutex.RLock()
+		defer hlsChan.mutex.RUnlock()
+
+		durations = nil
+		for _, seg := range hlsChan.segments {
+			durations = append(durations, seg.Duration)
+		}
+		return len(durations) == 3
+	}, 2*time.Second, 10*time.Millisecond, "segments should be generated")
+
+	// Segments are cut on the first keyframe after a second of media, not on the wall clock
+	assert.Equal(t, []float64{1.0, 1.0, 0.5}, durations)
+}
+
+func TestHLSChannel_SegmentsFitTargetDuration(t *testing.T) {
+	common.SetupLogging(common.LLError, "/dev/null")
+
+	queue := newTestQueue(t, av.H264)
+	queue.SetMaxGopCount(100)
+
+	config := DefaultHLSConfig()
+	config.EnableLowLatency = false
+	config.SegmentDuration = time.Second
+	config.TargetDuration = 2 * time.Second
+	hlsChan, err := NewHLSChannelWithConfig(queue, config)
+	require.NoError(t, err)
+	defer hlsChan.Stop()
+	require.NoError(t, hlsChan.Start())
+	time.Sleep(50 * time.Millisecond)
+
+	// 10 fps with a keyframe every 3 seconds
+	for i := 0; i <= 90; i++ {
+		err = queue.WritePacket(av.Packet{
+			Time:       time.Duration(i) * 100 * time.Millisecond,
+			IsKeyFrame: i%30 == 0,
+			Data:       []byte{0x00, 0x00, 0x00, 0x02, 0x09, 0xf0},
+		})
+		require.NoError(t, err)
+	}
+	queue.Close()
+	waitForDone(t, hlsChan.Done())
+
+	hlsChan.mutex.RLock()
+	var durations []float64
+	for _, seg := range hlsChan.segments {
+		durations = append(durations, seg.Duration)
+	}
+	hlsChan.mutex.RUnlock()
+
+	// Segments are cut before they get longer than the target, keyframe or not
+	assert.InDeltaSlice(t, []float64{2.4, 2.4, 1.2, 2.4, 0.6}, durations, 0.001)
+	assert.Contains(t, hlsChan.GetPlaylist(), "#EXT-X-TARGETDURATION:2\n")
+}
+
+func TestHLSChannel_LowLatencyParts(t *testing.T) {
+	common.SetupLogging(common.LLError, "/dev/null")
+
+	queue := newTestQueue(t, av.H264)
+	queue.SetMaxGopCount(100)
+	hlsChan, err := NewHLSChannel(queue)
+	require.NoError(t, err)
+	defer hlsChan.Stop()
+
+	require.True(t, hlsChan.config.EnableLowLatency)
+	hlsChan.segmentDuration = time.Second
+	hlsChan.partDuration = 200 * time.Millisecond
+	require.NoError(t, hlsChan.Start())
+	time.Sleep(50 * time.Millisecond)
+
+	for i := 0; i <= 30; i++ {
+		err = queue.WritePacket(av.Packet{
+			Time:       time.Duration(i) * 100 * time.Millisecond,
+			IsKeyFrame: i > 0 && i%5 == 0,
+			Data:       []byte{0x00, 0x00, 0x00, 0x02, 0x09, 0xf0},
+		})
+		require.NoError(t, err)
+	}
+
+	assert.Eventually(t, func() bool {
+		hlsChan.mutex.RLock()
+		defer hlsChan.mutex.RUnlock()
+		return len(hlsChan.segments) == 2 && len(hlsChan.pendingParts) == 2
+	}, 2*time.Second, 10*time.Millisecond, "segments and parts should be generated")
+
+	hlsChan.mutex.RLock()
+	segment := hlsChan.segments[0]
+	hlsChan.mutex.RUnlock()
+
+	// A segment is made of exactly its parts, and the first one starts on a keyframe
+	require.Len(t, segment.Parts, 5)
+	assert.True(t, segment.Parts[0].Independent)
+	var joined []byte
+	for _, part := range segment.Parts {
+		assert.InDelta(t, 0.2, part.Duration, 0.001)
+		joined = append(joined, part.Data...)
+
+		data, err := hlsChan.GetSegmentByURI(part.URI)
+		require.NoError(t, err)
+		assert.Equal(t, part.Data, data)
+	}
+	assert.True(t, bytes.Equal(segment.Data, joined))
+
+	playlist := hlsChan.GetPlaylist()
+	assert.Contains(t, playlist, "#EXT-X-SERVER-CONTROL:")
+	assert.Contains(t, playlist, "CAN-BLOCK-RELOAD=YES")
+	assert.Contains(t, playlist, "#EXT-X-PART-INF:PART-TARGET=0.200\n", "PART-TARGET is the part duration")
+	assert.Contains(t, playlist, fmt.Sprintf("#EXT-X-PART:DURATION=0.200,URI=%q,INDEPENDENT=YES", segment.Parts[0].URI))
+	assert.Contains(t, playlist, fmt.Sprintf("#EXT-X-PRELOAD-HINT:TYPE=PART,URI=%q", hlsPartURI(hlsChan.segmentURI(hlsChan.segmentID), 2)))
+
+	// Blocking reloads
+	assert.NoError(t, hlsChan.WaitForPart(context.Background(), 1, -1))
+	assert.NoError(t, hlsChan.WaitForPart(context.Background(), 2, 1))
+	assert.ErrorIs(t, hlsChan.WaitForPart(context.Background(), 4, 0), errPartTooFarAhead)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	assert.Error(t, hlsChan.WaitForPart(ctx, 2, 3))
+
+	queue.Close()
+	waitForDone(t, hlsChan.Done())
+}
+
+func TestHLSChannel_FMP4Segments(t *testing.T) {
+	common.SetupLogging(common.LLError, "/dev/null")
+
+	queue := newTestQueue(t, av.H264)
+	queue.SetMaxGopCount(100)
+
+	config := DefaultHLSConfig()
+	config.SegmentFormat = HLSFormatFMP4
+	config.EnableLowLatency = false
+	config.SegmentDuration = time.Second
+	hlsChan, err := NewHLSChannelWithConfig(queue, config)
+	require.NoError(t, err)
+	defer hlsChan.Stop()
+	assert.Equal(t, uint8(7), hlsChan.config.HLSVersion, "EXT-X-MAP without I-frames needs version 7")
+
+	require.NoError(t, hlsChan.Start())
+	time.Sleep(50 * time.Millisecond)
+
+	for i := 0; i <= 20; i++ {
+		err = queue.WritePacket(av.Packet{
+			Time:       time.Duration(i) * 100 * time.Millisecond,
+			IsKeyFrame: i%10 == 0,
+			Data:       []byte{0x00, 0x00, 0x00, 0x02, 0x09, 0xf0},
+		})
+		require.NoError(t, err)
+	}
+	queue.Close()
+	waitForDone(t, hlsChan.Done())
+
+	assert.Eventually(t, func() bool {
+		hlsChan.mutex.RLock()
+		defer hlsChan.mutex.RUnlock()
+		return len(hlsChan.segments) == 3
+	}, 2*time.Second, 10*time.Millisecond, "segments should be generated")
+
+	hlsChan.mutex.RLock()
+	initURI := hlsChan.initURI
+	segments := append([]HLSSegment(nil), hlsChan.segments...)
+	hlsChan.mutex.RUnlock()
+
+	require.True(t, IsValidInitURI(initURI), "init URI: %s", initURI)
+	init, err := hlsChan.GetSegmentByURI(initURI)
+	require.NoError(t, err)
+	assert.Equal(t, "ftyp", string(init[4:8]))
+	assert.Contains(t, string(init), "moov")
+	assert.Contains(t, string(init), "avc1")
+
+	for _, seg := range segments {
+		assert.True(t, strings.HasSuffix(seg.URI, ".m4s"), "segment URI: %s", seg.URI)
+		assert.Equal(t, "moof", string(seg.Data[4:8]))
+		assert.Contains(t, string(seg.Data), "mdat")
+	}
+
+	playlist := hlsChan.GetPlaylist()
+	assert.Contains(t, playlist, "#EXT-X-VERSION:7")
+	assert.Contains(t, playlist, fmt.Sprintf("#EXT-X-MAP:URI=\"%s\"", initURI))
+}
+
+func TestHLSChannel_Discontinuity(t *testing.T) {
+	common.SetupLogging(common.LLError, "/dev/null")
+
+	queue := newTestQueue(t, av.H264)
+	queue.SetMaxGopCount(100)
+	streams, err := queue.Latest().Streams()
+	require.NoError(t, err)
+
+	config := DefaultHLSConfig()
+	config.SegmentFormat = HLSFormatFMP4
+	config.EnableLowLatency = false
+	config.SegmentDuration = time.Second
+	hlsChan, err := NewHLSChannelWithConfig(queue, config)
+	require.NoError(t, err)
+	defer hlsChan.Stop()
+	require.NoError(t, hlsChan.Start())
+	time.Sleep(50 * time.Millisecond)
+
+	ch := &Channel{que: queue, hlsChan: hlsChan, ingest: newIngestMonitor("discontinuity-test")}
+	writeSource := func(streams []av.CodecData) {
+		require.NoError(t, ch.writeHeader(streams))
+		for i := 0; i <= 20; i++ {
+			require.NoError(t, ch.WritePacket(av.Packet{
+				Time:       time.Duration(i) * 100 * time.Millisecond,
+				IsKeyFrame: i%10 == 0,
+				Data:       []byte{0x00, 0x00, 0x00, 0x02, 0x09, 0xf0},
+			}))
+		}
+	}
+
+	writeSource(streams)
+
+	// The publisher reconnects with a different encoder setting
+	sps := streams[0].(h264parser.CodecData).SPS()
+	changed, err := h264parser.NewCodecDataFromSPSAndPPS(sps, []byte{0x68, 0xce, 0x38, 0x80})
+	require.NoError(t, err)
+	writeSource([]av.CodecData{changed})
+	queue.Close()
+	waitForDone(t, hlsChan.Done())
+
+	assert.Eventually(t, func() bool {
+		hlsChan.mutex.RLock()
+		defer hlsChan.mutex.RUnlock()
+		return len(hlsChan.segments) == 6
+	}, 2*time.Second, 10*time.Millisecond, "segments should be generated")
+
+	hlsChan.mutex.RLock()
+	segments := append([]HLSSegment(nil), hlsChan.segments...)
+	hlsChan.mutex.RUnlock()
+
+	for i, seg := range segments {
+		assert.Equal(t, i == 3, seg.Discontinuity, "segment %d", i)
+		assert.False(t, seg.ProgramDateTime.IsZero(), "segment %d", i)
+		if i > 0 {
+			assert.False(t, seg.ProgramDateTime.Before(segments[i-1].ProgramDateTime), "segment %d", i)
+		}
+	}
+	assert.Equal(t, segments[0].InitURI, segments[2].InitURI)
+	assert.NotEqual(t, segments[2].InitURI, segments[3].InitURI, "new codecs need a new init segment")
+
+	_, err = hlsChan.GetSegmentByURI(segments[0].InitURI)
+	assert.NoError(t, err, "the old init segment is still needed")
+
+	playlist := hlsChan.GetPlaylist()
+	assert.Equal(t, 1, strings.Count(playlist, "#EXT-X-DISCONTINUITY\n"))
+	assert.Equal(t, 6, strings.Count(playlist, "#EXT-X-PROGRAM-DATE-TIME:"))
+	assert.Equal(t, 2, strings.Count(playlist, "#EXT-X-MAP:"))
+	assert.Less(t, strings.Index(playlist, "#EXT-X-DISCONTINUITY"), strings.Index(playlist, segments[3].InitURI))
+
+	// The old init segment goes away with the last segment that needs it
+	for i := 0; i < 3; i++ {
+		hlsChan.addGeneratedSegment(HLSSegment{URI: fmt.Sprintf("/live/segment_%d.m4s", i), Duration: 1, Data: []byte{byte(i)}, Sequence: uint64(6 + i), InitURI: segments[3].InitURI})
+	}
+	_, err = hlsChan.GetSegmentByURI(segments[0].InitURI)
+	assert.Error(t, err)
+	_, err = hlsChan.GetSegmentByURI(segments[3].InitURI)
+	assert.NoError(t, err)
+}
+
+func TestNewHLSChannelWithConfig_UnknownFormat(t *testing.T) {
+	config := DefaultHLSConfig()
+	config.SegmentFormat = "webm"
+	_, err := NewHLSChannelWithConfig(pubsub.NewQueue(), config)
+	assert.Error(t, err)
+}
+
+func TestIsValidPartURI(t *testing.T) {
+	assert.True(t, IsValidPartURI("/live/segment_1234567890abcdef1234567890abcdef.0.ts"))
+	assert.True(t, IsValidPartURI("segment_1234567890abcdef1234567890abcdef.12.ts"))
+	assert.False(t, IsValidPartURI("/live/segment_1234567890abcdef1234567890abcdef.ts"))
+	assert.False(t, IsValidPartURI("/live/segment_1234567890abcdef1234567890abcdef.x.ts"))
+	assert.False(t, IsValidPartURI("/live/other.0.ts"))
+	assert.False(t, IsValidPartURI(""))
+
+	assert.True(t, IsValidPartURI("/live/segment_1234567890abcdef1234567890abcdef.3.m4s"))
+	assert.Equal(t, "/live/segment_1234567890abcdef1234567890abcdef.3.m4s",
+		hlsPartURI("/live/segment_1234567890abcdef1234567890abcdef.m4s", 3))
+}
+
+func TestIsValidInitURI(t *testing.T) {
+	assert.True(t, IsValidInitURI("/live/init_1234567890abcdef1234567890abcdef.mp4"))
+	assert.True(t, IsValidInitURI("init_1234567890abcdef1234567890abcdef.mp4"))
+	assert.False(t, IsValidInitURI("/live/init_1234.mp4"))
+	assert.False(t, IsValidInitURI("/live/segment_1234567890abcdef1234567890abcdef.mp4"))
+	assert.False(t, IsValidInitURI("/live/init_1234567890abcdef1234567890abcdef.m4s"))
+	assert.False(t, IsValidInitURI(""))
+}
+
+func TestTargetDurationSeconds(t *testing.T) {
+	assert.Equal(t, uint(4), targetDurationSeconds(4400*time.Millisecond, 6))
+	assert.Equal(t, uint(5), targetDurationSeconds(4600*time.Millisecond, 6))
+	assert.Equal(t, uint(5), targetDurationSeconds(4400*time.Millisecond, 5))
+}
+
 func TestHLSChannel_GetPlaylist(t *testing.T) {
 	// Initialize logging for tests
 	common.SetupLogging(common.LLDebug, "")
@@ -386,6 +718,8 @@ func TestGetContentTypeForFormat(t *testing.T) {
 	}{
 		{"hls", "application/vnd.apple.mpegurl"},
 		{"ts", "video/mp2t"},
+		{"m4s", "video/iso.segment"},
+		{"mp4", "video/mp4"},
 		{"flv", "video/x-flv"},
 		{"unknown", "video/x-flv"},
 		{"", "video/x-flv"},
@@ -439,6 +773,9 @@ func TestIsHLSSegmentRequest(t *testing.T) {
 		{"playlist", "/live/playlist.m3u8", false},
 		{"regular path", "/live", false},
 		{"other ts file", "/live/other.ts", false},
+		{"fmp4 segment", "/live/segment_0.m4s", true},
+		{"fmp4 init segment", "/live/init_0.mp4", true},
+		{"other mp4 file", "/live/movie.mp4", false},
 	}
 
 	for _, tt := range tests {
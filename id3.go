@@ -0,0 +1,163 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/nareix/joy4/av"
+	"github.com/nareix/joy4/format/ts"
+	"github.com/nareix/joy4/format/ts/tsio"
+)
+
+// Timed metadata in MPEG-TS segments is carried as ID3 tags in its own
+// elementary stream, as Apple describes in "Timed Metadata for HTTP Live
+// Streaming".  ts.Muxer only knows about H264 and AAC, so the PAT and PMT are
+// written here with the metadata stream added.
+const (
+	id3PID      = 0x1ff // clear of the 0x100+ PIDs ts.Muxer gives its streams
+	id3StreamID = 0xbd  // private_stream_1
+
+	tsStreamTypeMetadata     = 0x15
+	tsMetadataPointerDescTag = 0x25
+	tsMetadataDescTag        = 0x26
+
+	// ts.Muxer shifts every timestamp by a second
+	tsTimeOffset = time.Second
+)
+
+var (
+	// metadata_pointer_descriptor of the program: ID3 format, service 0, program 1
+	id3PointerDescriptor = []byte{0xff, 0xff, 'I', 'D', '3', ' ', 0xff, 'I', 'D', '3', ' ', 0x00, 0x1f, 0x00, 0x01}
+	// metadata_descriptor of the metadata stream: ID3 format, service 0
+	id3Descriptor = []byte{0xff, 0xff, 'I', 'D', '3', ' ', 0xff, 'I', 'D', '3', ' ', 0x00, 0x0f}
+)
+
+// newTSSegmentWriter creates the muxer of an MPEG-TS segment that can carry
+// timed ID3 metadata
+func newTSSegmentWriter(w io.Writer, streams []av.CodecData) (tsSegmentWriter, error) {
+	// ts.Muxer writes its own tables along with the header, those are dropped
+	muxer := ts.NewMuxer(io.Discard)
+	err := muxer.WriteHeader(streams)
+	if err != nil {
+		return tsSegmentWriter{}, err
+	}
+	muxer.SetWriter(w)
+
+	err = writeTSTables(w, streams)
+	if err != nil {
+		return tsSegmentWriter{}, fmt.Errorf("could not write PAT and PMT: %w", err)
+	}
+	return tsSegmentWriter{Muxer: muxer, w: w, id3: tsio.NewTSWriter(id3PID)}, nil
+}
+
+// writeTSTables writes the PAT and the PMT of a segment.  The streams get the
+// same PIDs ts.Muxer gives them, the metadata stream comes last.
+func writeTSTables(w io.Writer, streams []av.CodecData) error {
+	psi := make([]byte, 188)
+
+	pat := tsio.PAT{Entries: []tsio.PATEntry{{ProgramNumber: 1, ProgramMapPID: tsio.PMT_PID}}}
+	length := pat.Marshal(psi[tsio.PSIHeaderLength:])
+	n := tsio.FillPSI(psi, tsio.TableIdPAT, tsio.TableExtPAT, length)
+	err := tsio.NewTSWriter(tsio.PAT_PID).WritePackets(w, [][]byte{psi[:n]}, 0, false, true)
+	if err != nil {
+		return err
+	}
+
+	pmt := tsio.PMT{
+		PCRPID:             0x100,
+		ProgramDescriptors: []tsio.Descriptor{{Tag: tsMetadataPointerDescTag, Data: id3PointerDescriptor}},
+	}
+	for i, stream := range streams {
+		info := tsio.ElementaryStreamInfo{ElementaryPID: uint16(0x100 + i)}
+		switch stream.Type() {
+		case av.H264:
+			info.StreamType = tsio.ElementaryStreamTypeH264
+		case av.AAC:
+			info.StreamType = tsio.ElementaryStreamTypeAdtsAAC
+		default:
+			return fmt.Errorf("codec type %s is not supported", stream.Type())
+		}
+		pmt.ElementaryStreamInfos = append(pmt.ElementaryStreamInfos, info)
+	}
+	pmt.ElementaryStreamInfos = append(pmt.ElementaryStreamInfos, tsio.ElementaryStreamInfo{
+		StreamType:    tsStreamTypeMetadata,
+		ElementaryPID: id3PID,
+		Descriptors:   []tsio.Descriptor{{Tag: tsMetadataDescTag, Data: id3Descriptor}},
+	})
+
+	if pmt.Len()+tsio.PSIHeaderLength+4 > len(psi) {
+		return fmt.Errorf("PMT too large")
+	}
+	length = pmt.Marshal(psi[tsio.PSIHeaderLength:])
+	n = tsio.FillPSI(psi, tsio.TableIdPMT, tsio.TableExtPMT, length)
+	return tsio.NewTSWriter(tsio.PMT_PID).WritePackets(w, [][]byte{psi[:n]}, 0, false, true)
+}
+
+// WriteMetadata writes an ID3 tag to the metadata stream at time t
+func (w tsSegmentWriter) WriteMetadata(tag []byte, t time.Duration) error {
+	header := make([]byte, tsio.MaxPESHeaderLength)
+	n := tsio.FillPESHeader(header, id3StreamID, len(tag), t+tsTimeOffset, 0)
+	header[6] |= 0x04 // data_alignment_indicator, the tag starts right away
+	return w.id3.WritePackets(w.w, [][]byte{header[:n], tag}, 0, false, false)
+}
+
+// id3Title encodes an ID3v2.4 tag with the title in a TIT2 frame
+func id3Title(title string) []byte {
+	text := append([]byte{0x03}, title...) // UTF-8
+	text = append(text, 0x00)
+
+	frame := make([]byte, 10, 10+len(text))
+	copy(frame, "TIT2")
+	putSynchsafe(frame[4:8], len(text))
+	frame = append(frame, text...)
+
+	tag := make([]byte, 10, 10+len(frame))
+	copy(tag, "ID3\x04\x00\x00")
+	putSynchsafe(tag[6:10], len(frame))
+	return append(tag, frame...)
+}
+
+// putSynchsafe writes the size as an ID3 synchsafe integer, 7 bits per byte
+func putSynchsafe(b []byte, size int) {
+	for i := 3; i >= 0; i-- {
+		b[i] = byte(size & 0x7f)
+		size >>= 7
+	}
+}
+
+// addTimedMetadata queues an ID3 tag to be written to the stream along with
+// the next packet.  Only MPEG-TS segments carry it, fMP4 would need emsg
+// boxes.
+func (h *HLSChannel) addTimedMetadata(tag []byte) {
+	if h == nil || h.config.SegmentFormat == HLSFormatFMP4 {
+		return
+	}
+
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.timedMetadata = append(h.timedMetadata, tag)
+}
+
+// takeTimedMetadata returns the queued ID3 tags
+func (h *HLSChannel) takeTimedMetadata() [][]byte {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	tags := h.timedMetadata
+	h.timedMetadata = nil
+	return tags
+}
+
+// markTitle puts a new /playing title into the HLS streams of every
+// rendition of a group
+func markTitle(group, title string) {
+	l.RLock()
+	defer l.RUnlock()
+
+	tag := id3Title(title)
+	for _, r := range findRenditions(group) {
+		r.ch.hlsChan.addTimedMetadata(tag)
+		r.ch.audioHLS.addTimedMetadata(tag)
+	}
+}
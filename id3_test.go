@@ -0,0 +1,177 @@
+package main
+
+import (
+	"encoding/binary"
+	"testing"
+	"time"
+
+	"github.com/nareix/joy4/av"
+	"github.com/nareix/joy4/format/ts/tsio"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/zorchenhimer/MovieNight/common"
+)
+
+func TestID3Title(t *testing.T) {
+	assert.Equal(t, []byte{
+		'I', 'D', '3', 0x04, 0x00, 0x00, 0x00, 0x00, 0x00, 0x0e,
+		'T', 'I', 'T', '2', 0x00, 0x00, 0x00, 0x04, 0x00, 0x00,
+		0x03, 'H', 'i', 0x00,
+	}, id3Title("Hi"))
+
+	size := make([]byte, 4)
+	putSynchsafe(size, 200)
+	assert.Equal(t, []byte{0x00, 0x00, 0x01, 0x48}, size, "sizes only use 7 bits per byte")
+}
+
+// tsMetadata returns the stream types of the PMT, the number of video TS
+// packets and the PTS and payload of every PES on the ID3 PID of a TS segment
+func tsMetadata(t *testing.T, data []byte) (streamTypes []uint8, video int, times []time.Duration, tags [][]byte) {
+	t.Helper()
+
+	var pes []byte
+	flush := func() {
+		if len(pes) == 0 {
+			return
+		}
+		hdrlen, streamid, _, pts, _, err := tsio.ParsePESHeader(pes)
+		require.NoError(t, err)
+		assert.Equal(t, uint8(id3StreamID), streamid)
+		times = append(times, pts-tsTimeOffset)
+		tags = append(tags, pes[hdrlen:])
+		pes = nil
+	}
+
+	for i := 0; i+188 <= len(data); i += 188 {
+		pid, start, _, hdrlen, err := tsio.ParseTSHeader(data[i : i+188])
+		require.NoError(t, err)
+		payload := data[i+hdrlen : i+188]
+
+		switch pid {
+		case tsio.PMT_PID:
+			// tsio.PMT can't parse descriptors that end the PMT
+			_, _, psihdrlen, datalen, err := tsio.ParsePSI(payload)
+			require.NoError(t, err)
+			pmt := payload[psihdrlen : psihdrlen+datalen]
+			infoLength := int(binary.BigEndian.Uint16(pmt[2:4]) & 0x3ff)
+			require.Positive(t, infoLength)
+			assert.Equal(t, uint8(tsMetadataPointerDescTag), pmt[4])
+			for n := 4 + infoLength; n+5 <= len(pmt); {
+				streamTypes = append(streamTypes, pmt[n])
+				n += 5 + int(binary.BigEndian.Uint16(pmt[n+3:n+5])&0x3ff)
+			}
+		case 0x100:
+			video++
+		case id3PID:
+			if start {
+				flush()
+			}
+			pes = append(pes, payload...)
+		}
+	}
+	flush()
+	return streamTypes, video, times, tags
+}
+
+func TestHLSChannel_TimedMetadata(t *testing.T) {
+	common.SetupLogging(common.LLError, "/dev/null")
+
+	queue := newTestQueue(t, av.H264)
+	queue.SetMaxGopCount(100)
+
+	config := DefaultHLSConfig()
+	config.EnableLowLatency = false
+	config.SegmentDuration = time.Second
+	hlsChan, err := NewHLSChannelWithConfig(queue, config)
+	require.NoError(t, err)
+	defer hlsChan.Stop()
+	require.NoError(t, hlsChan.Start())
+	time.Sleep(50 * time.Millisecond)
+
+	writePackets := func(from, to int) {
+		for i := from; i < to; i++ {
+			require.NoError(t, queue.WritePacket(av.Packet{
+				Time:       time.Duration(i) * 100 * time.Millisecond,
+				IsKeyFrame: i%10 == 0,
+				Data:       []byte{0x00, 0x00, 0x00, 0x02, 0x09, 0xf0},
+			}))
+		}
+	}
+
+	writePackets(0, 11)
+	require.Eventually(t, func() bool {
+		return hlsChan.HasSegments()
+	}, 2*time.Second, 10*time.Millisecond)
+
+	hlsChan.addTimedMetadata(id3Title("Second Feature"))
+	writePackets(11, 31)
+	queue.Close()
+	waitForDone(t, hlsChan.Done())
+
+	require.Eventually(t, func() bool {
+		hlsChan.mutex.RLock()
+		defer hlsChan.mutex.RUnlock()
+		return len(hlsChan.segments) == 4
+	}, 2*time.Second, 10*time.Millisecond, "segments should be generated")
+
+	hlsChan.mutex.RLock()
+	segments := append([]HLSSegment(nil), hlsChan.segments...)
+	hlsChan.mutex.RUnlock()
+
+	found := 0
+	for i, segment := range segments {
+		streamTypes, video, times, tags := tsMetadata(t, segment.Data)
+		assert.Equal(t, []uint8{tsio.ElementaryStreamTypeH264, tsStreamTypeMetadata}, streamTypes, "segment %d", i)
+
+		for j, tag := range tags {
+			found++
+			assert.Equal(t, 1, i, "the tag is in the segment that was being generated")
+			assert.Equal(t, id3Title("Second Feature"), tag)
+			assert.GreaterOrEqual(t, times[j], 1100*time.Millisecond)
+			assert.Less(t, times[j], 2*time.Second)
+		}
+		assert.Positive(t, video, "segment %d", i)
+	}
+	assert.Equal(t, 1, found, "the tag is written once")
+}
+
+func TestChatRoom_SetPlayingTimedMetadata(t *testing.T) {
+	common.SetupLogging(common.LLError, "/dev/null")
+	settings = &Settings{TitleLength: 50}
+
+	hlsChan, err := NewHLSChannelWithConfig(newTestQueue(t, av.AAC), DefaultHLSConfig())
+	require.NoError(t, err)
+	defer hlsChan.Close()
+
+	room, err := chatRoomFor("id3-test")
+	require.NoError(t, err)
+	l.Lock()
+	channels["id3-test"] = &Channel{hlsChan: hlsChan}
+	l.Unlock()
+	defer func() {
+		l.Lock()
+		delete(channels, "id3-test")
+		l.Unlock()
+		chatRoomsMtx.Lock()
+		delete(chatRooms, "id3-test")
+		chatRoomsMtx.Unlock()
+	}()
+
+	room.SetPlaying("First Feature", "")
+	room.SetPlaying("First Feature", "https://example.com")
+	room.ClearPlaying()
+
+	tags := hlsChan.takeTimedMetadata()
+	require.Len(t, tags, 2, "only changes of the title are put into the stream")
+	assert.Equal(t, id3Title("First Feature"), tags[0])
+	assert.Equal(t, id3Title(""), tags[1])
+
+	// fMP4 segments can't carry the tags
+	config := DefaultHLSConfig()
+	config.SegmentFormat = HLSFormatFMP4
+	fmp4Chan, err := NewHLSChannelWithConfig(newTestQueue(t, av.AAC), config)
+	require.NoError(t, err)
+	defer fmp4Chan.Close()
+	fmp4Chan.addTimedMetadata(id3Title("First Feature"))
+	assert.Empty(t, fmp4Chan.takeTimedMetadata())
+}
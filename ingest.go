@@ -0,0 +1,332 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nareix/joy4/av"
+	"github.com/zorchenhimer/MovieNight/common"
+)
+
+const (
+	ingestWindow       = 5 * time.Second  // bitrate and frame rate are measured over this long
+	ingestMaxGap       = 2 * time.Second  // timestamp jumps larger than this are gaps
+	ingestMaxGOP       = 10 * time.Second // keyframe intervals longer than this get a warning
+	ingestMaxDrift     = time.Second      // audio and video further apart than this get a warning
+	ingestWarnCooldown = time.Minute      // the same warning is repeated at most this often
+)
+
+// IngestStats describes the health of the stream being published to a channel
+type IngestStats struct {
+	Stream       string
+	Since        time.Time // when the current source started publishing
+	VideoBitrate int64     // bits per second over the last few seconds
+	AudioBitrate int64
+	FrameRate    float64 // video frames per second
+	PeakFrame    float64 // highest frame rate seen from the current source
+	GOPSeconds   float64 // time between the last two keyframes
+	GOPFrames    int     // frames between the last two keyframes
+	Gaps         int     // timestamp jumps larger than ingestMaxGap
+	LargestGap   float64 // in seconds
+	AVDrift      float64 // seconds the audio is ahead of the video, negative if behind
+	Warnings     []string
+}
+
+// ingestSample is a packet that arrived within the measuring window
+type ingestSample struct {
+	at    time.Time
+	size  int
+	video bool
+}
+
+// IngestMonitor looks at the packets published to a channel and keeps track
+// of how healthy the stream is.  Mods are warned when it degrades.
+type IngestMonitor struct {
+	stream string
+	now    func() time.Time // replaced in tests
+
+	mutex      sync.Mutex
+	since      time.Time
+	video      int8 // stream index of the video, -1 if there is none
+	audio      int8
+	samples    []ingestSample
+	peakFrame  float64
+	lastTime   map[int8]time.Duration
+	lastVideo  time.Duration
+	lastAudio  time.Duration
+	gotVideo   bool
+	gotAudio   bool
+	keyframe   time.Duration
+	gotKey     bool
+	gopFrames  int
+	gopLength  time.Duration
+	gopCount   int
+	gaps       int
+	largestGap time.Duration
+	warned     map[string]time.Time
+}
+
+func newIngestMonitor(stream string) *IngestMonitor {
+	return &IngestMonitor{
+		stream: stream,
+		now:    time.Now,
+		video:  -1,
+		audio:  -1,
+		warned: map[string]time.Time{},
+	}
+}
+
+// reset starts measuring a new source with the given streams
+func (m *IngestMonitor) reset(streams []av.CodecData) {
+	if m == nil {
+		return
+	}
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	m.since = m.now()
+	m.video, m.audio = -1, -1
+	for i, stream := range streams {
+		if stream.Type().IsVideo() && m.video < 0 {
+			m.video = int8(i)
+		} else if stream.Type().IsAudio() && m.audio < 0 {
+			m.audio = int8(i)
+		}
+	}
+
+	m.samples = nil
+	m.peakFrame = 0
+	m.lastTime = map[int8]time.Duration{}
+	m.gotVideo, m.gotAudio, m.gotKey = false, false, false
+	m.gopFrames, m.gopLength, m.gopCount = 0, 0, 0
+	m.gaps, m.largestGap = 0, 0
+}
+
+// observe records a packet that is being written to the channel
+func (m *IngestMonitor) observe(pkt av.Packet) {
+	if m == nil {
+		return
+	}
+
+	m.mutex.Lock()
+	now := m.now()
+	isVideo := pkt.Idx == m.video
+	m.samples = append(m.samples, ingestSample{at: now, size: len(pkt.Data), video: isVideo})
+	m.trim(now)
+
+	if last, ok := m.lastTime[pkt.Idx]; ok {
+		if gap := pkt.Time - last; gap > ingestMaxGap || gap < -ingestMaxGap {
+			m.gaps++
+			if gap < 0 {
+				gap = -gap
+			}
+			if gap > m.largestGap {
+				m.largestGap = gap
+			}
+			m.warn("gap", fmt.Sprintf("timestamps of %s jumped by %v", m.stream, gap.Round(time.Millisecond)))
+		}
+	}
+	m.lastTime[pkt.Idx] = pkt.Time
+
+	switch pkt.Idx {
+	case m.video:
+		m.lastVideo, m.gotVideo = pkt.Time, true
+		if pkt.IsKeyFrame {
+			if m.gotKey {
+				m.gopLength = pkt.Time - m.keyframe
+				m.gopFrames = m.gopCount
+			}
+			m.keyframe, m.gotKey, m.gopCount = pkt.Time, true, 0
+		}
+		m.gopCount++
+
+		if m.gotKey && pkt.Time-m.keyframe > ingestMaxGOP {
+			m.warn("gop", fmt.Sprintf("%s has gone %v without a keyframe", m.stream, (pkt.Time-m.keyframe).Round(time.Second)))
+		}
+	case m.audio:
+		m.lastAudio, m.gotAudio = pkt.Time, true
+	}
+
+	if drift := m.drift(); drift > ingestMaxDrift || drift < -ingestMaxDrift {
+		m.warn("drift", fmt.Sprintf("audio and video of %s are %v apart", m.stream, drift.Round(time.Millisecond)))
+	}
+
+	// Only judge the frame rate once there is a full window to measure
+	if isVideo && now.Sub(m.since) >= ingestWindow {
+		fps := m.frameRate()
+		if fps > m.peakFrame {
+			m.peakFrame = fps
+		}
+		if fps < m.peakFrame/2 {
+			m.warn("fps", fmt.Sprintf("frame rate of %s dropped to %.1f fps from %.1f fps", m.stream, fps, m.peakFrame))
+		}
+	}
+	m.mutex.Unlock()
+}
+
+// trim drops the samples that are older than the measuring window
+func (m *IngestMonitor) trim(now time.Time) {
+	idx := sort.Search(len(m.samples), func(i int) bool {
+		return now.Sub(m.samples[i].at) <= ingestWindow
+	})
+	m.samples = m.samples[idx:]
+}
+
+// window returns how long the samples have been collected for, at most
+// ingestWindow
+func (m *IngestMonitor) window() time.Duration {
+	window := m.now().Sub(m.since)
+	if window > ingestWindow {
+		window = ingestWindow
+	}
+	return window
+}
+
+func (m *IngestMonitor) frameRate() float64 {
+	window := m.window().Seconds()
+	if window <= 0 {
+		return 0
+	}
+
+	frames := 0
+	for _, s := range m.samples {
+		if s.video {
+			frames++
+		}
+	}
+	return float64(frames) / window
+}
+
+func (m *IngestMonitor) drift() time.Duration {
+	if !m.gotVideo || !m.gotAudio {
+		return 0
+	}
+	return m.lastAudio - m.lastVideo
+}
+
+// warn sends a warning to the mods of the channel, unless the same kind of
+// warning was sent recently.  The caller is expected to hold the monitor's
+// mutex.
+func (m *IngestMonitor) warn(kind, msg string) {
+	now := m.now()
+	if last, ok := m.warned[kind]; ok && now.Sub(last) < ingestWarnCooldown {
+		return
+	}
+	m.warned[kind] = now
+
+	common.LogInfof("[ingest] %s\n", msg)
+
+	// Finding the chat room needs the channel lock, which may be held by
+	// whoever waits for this packet to be written, eg. when stopping a fallback
+	go streamModNotice(m.stream, "Stream warning: "+msg)
+}
+
+// Stats returns a snapshot of the stream's health
+func (m *IngestMonitor) Stats() IngestStats {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	m.trim(m.now())
+	stats := IngestStats{
+		Stream:     m.stream,
+		Since:      m.since,
+		FrameRate:  m.frameRate(),
+		PeakFrame:  m.peakFrame,
+		GOPSeconds: m.gopLength.Seconds(),
+		GOPFrames:  m.gopFrames,
+		Gaps:       m.gaps,
+		LargestGap: m.largestGap.Seconds(),
+		AVDrift:    m.drift().Seconds(),
+		Warnings:   []string{},
+	}
+
+	if window := m.window().Seconds(); window > 0 {
+		var video, audio int
+		for _, s := range m.samples {
+			if s.video {
+				video += s.size
+			} else {
+				audio += s.size
+			}
+		}
+		stats.VideoBitrate = int64(float64(video*8) / window)
+		stats.AudioBitrate = int64(float64(audio*8) / window)
+	}
+
+	if stats.GOPSeconds > ingestMaxGOP.Seconds() {
+		stats.Warnings = append(stats.Warnings, "keyframe interval is too long")
+	}
+	if math.Abs(stats.AVDrift) > ingestMaxDrift.Seconds() {
+		stats.Warnings = append(stats.Warnings, "audio and video are out of sync")
+	}
+	if stats.PeakFrame > 0 && stats.FrameRate < stats.PeakFrame/2 {
+		stats.Warnings = append(stats.Warnings, "frame rate dropped")
+	}
+	return stats
+}
+
+// String formats the stats for chat
+func (s IngestStats) String() string {
+	str := fmt.Sprintf("%s: video %d kbps, audio %d kbps, %.1f fps, keyframe every %.1fs (%d frames), %d gap(s), A/V drift %.0fms",
+		s.Stream,
+		s.VideoBitrate/1000,
+		s.AudioBitrate/1000,
+		s.FrameRate,
+		s.GOPSeconds,
+		s.GOPFrames,
+		s.Gaps,
+		s.AVDrift*1000,
+	)
+	if len(s.Warnings) > 0 {
+		str += ", warnings: " + strings.Join(s.Warnings, ", ")
+	}
+	return str
+}
+
+// ingestStats returns the ingest stats of every live channel sorted by name
+func ingestStats() []IngestStats {
+	l.RLock()
+	defer l.RUnlock()
+
+	list := []IngestStats{}
+	for _, ch := range channels {
+		if ch.ingest != nil {
+			list = append(list, ch.ingest.Stats())
+		}
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Stream < list[j].Stream })
+	return list
+}
+
+// checkAdminAPI checks that a request to the admin API carries the admin
+// password as a bearer token
+func checkAdminAPI(w http.ResponseWriter, r *http.Request) bool {
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if settings.AdminPassword == "" || subtle.ConstantTimeCompare([]byte(token), []byte(settings.AdminPassword)) != 1 {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return false
+	}
+	return true
+}
+
+// handleIngestAPI serves the ingest stats of every live channel as JSON
+func handleIngestAPI(w http.ResponseWriter, r *http.Request) {
+	if !checkAdminAPI(w, r) {
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-cache")
+	err := json.NewEncoder(w).Encode(ingestStats())
+	if err != nil {
+		common.LogErrorf("Could not write ingest stats: %v\n", err)
+	}
+}
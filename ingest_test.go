@@ -0,0 +1,139 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/nareix/joy4/av"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/zorchenhimer/MovieNight/common"
+)
+
+func TestIngestMonitor_Stats(t *testing.T) {
+	common.SetupLogging(common.LLError, "/dev/null")
+
+	streams := testStreams(t, av.H264, av.AAC)
+
+	// Warnings go to the mods of the channel's own room
+	room := newRoom()
+	chatRoomsMtx.Lock()
+	chatRooms["ingest-test"] = room
+	chatRoomsMtx.Unlock()
+	defer func() {
+		chatRoomsMtx.Lock()
+		delete(chatRooms, "ingest-test")
+		chatRoomsMtx.Unlock()
+	}()
+
+	clock := time.Unix(1000, 0)
+	m := newIngestMonitor("ingest-test")
+	m.now = func() time.Time { return clock }
+	m.reset(streams)
+
+	// 6 seconds of 25 fps video with a keyframe every 2 seconds and 50
+	// audio packets a second running 1.5 seconds ahead
+	for i := 0; i < 150; i++ {
+		pktTime := time.Duration(i) * 40 * time.Millisecond
+		m.observe(av.Packet{Idx: 0, IsKeyFrame: i%50 == 0, Time: pktTime, Data: make([]byte, 1000)})
+		m.observe(av.Packet{Idx: 1, Time: pktTime + 1500*time.Millisecond, Data: make([]byte, 100)})
+		m.observe(av.Packet{Idx: 1, Time: pktTime + 1520*time.Millisecond, Data: make([]byte, 100)})
+		clock = clock.Add(40 * time.Millisecond)
+	}
+
+	stats := m.Stats()
+	assert.Equal(t, "ingest-test", stats.Stream)
+	assert.InDelta(t, 25, stats.FrameRate, 0.5)
+	assert.InDelta(t, 200000, stats.VideoBitrate, 5000)
+	assert.InDelta(t, 40000, stats.AudioBitrate, 1000)
+	assert.InDelta(t, 2, stats.GOPSeconds, 0.001)
+	assert.Equal(t, 50, stats.GOPFrames)
+	assert.InDelta(t, 1.52, stats.AVDrift, 0.001)
+	assert.Contains(t, stats.Warnings, "audio and video are out of sync")
+	assert.Equal(t, 0, stats.Gaps)
+	assert.Contains(t, m.warned, "drift")
+	select {
+	case notice := <-room.modqueue:
+		assert.Contains(t, notice.Data.(common.DataMessage).Message, "audio and video of ingest-test are")
+	case <-time.After(2 * time.Second):
+		t.Fatal("the mods were not warned")
+	}
+
+	// The encoder stalls for 3 seconds and comes back at 5 fps
+	clock = clock.Add(3 * time.Second)
+	for i := 0; i < 30; i++ {
+		m.observe(av.Packet{Idx: 0, Time: 9*time.Second + time.Duration(i)*200*time.Millisecond, Data: make([]byte, 1000)})
+		clock = clock.Add(200 * time.Millisecond)
+	}
+
+	stats = m.Stats()
+	assert.Equal(t, 1, stats.Gaps)
+	assert.InDelta(t, 3.04, stats.LargestGap, 0.001)
+	assert.InDelta(t, 5, stats.FrameRate, 0.5)
+	assert.Contains(t, stats.Warnings, "frame rate dropped")
+	assert.Contains(t, m.warned, "gap")
+	assert.Contains(t, m.warned, "fps")
+
+	// A new source starts over
+	m.reset(streams)
+	stats = m.Stats()
+	assert.Equal(t, 0, stats.Gaps)
+	assert.Empty(t, stats.Warnings)
+}
+
+func TestIngestMonitor_WarnWithChannelLock(t *testing.T) {
+	common.SetupLogging(common.LLError, "/dev/null")
+
+	m := newIngestMonitor("ingest-lock-test")
+	m.reset(testStreams(t, av.H264))
+
+	// Packets are written with the channel lock held while a fallback stops
+	l.Lock()
+	defer l.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		m.observe(av.Packet{Idx: 0, IsKeyFrame: true, Data: []byte{0}})
+		m.observe(av.Packet{Idx: 0, Time: time.Minute, Data: []byte{0}})
+	}()
+	waitForDone(t, done)
+	assert.Contains(t, m.warned, "gap")
+}
+
+func TestHandleIngestAPI(t *testing.T) {
+	common.SetupLogging(common.LLError, "/dev/null")
+	settings = &Settings{TitleLength: 50, AdminPassword: "secret"}
+
+	streams := testStreams(t, av.AAC)
+
+	l.Lock()
+	ch := newChannel("ingest-test", streams)
+	channels["ingest-test"] = ch
+	l.Unlock()
+	defer func() {
+		l.Lock()
+		delete(channels, "ingest-test")
+		ch.close()
+		l.Unlock()
+		waitForDone(t, channelDone(ch)...)
+	}()
+
+	w := httptest.NewRecorder()
+	handleIngestAPI(w, httptest.NewRequest(http.MethodGet, "/api/ingest", nil))
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+
+	req := httptest.NewRequest(http.MethodGet, "/api/ingest", nil)
+	req.Header.Set("Authorization", "Bearer secret")
+	w = httptest.NewRecorder()
+	handleIngestAPI(w, req)
+	require.Equal(t, http.StatusOK, w.Code)
+
+	var list []IngestStats
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &list))
+	require.Len(t, list, 1)
+	assert.Equal(t, "ingest-test", list[0].Stream)
+}
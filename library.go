@@ -0,0 +1,372 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nareix/joy4/av"
+	"github.com/nareix/joy4/format/flv"
+	"github.com/nareix/joy4/format/mp4"
+	"github.com/zorchenhimer/MovieNight/common"
+)
+
+// global media library for playing local files
+var library *MediaLibrary
+
+// libraryExtensions are the file types that joy4 can demux for playback
+var libraryExtensions = []string{".flv", ".mp4"}
+
+// MediaLibrary is a directory of video files that can be queued and played
+// into a Channel in place of a live publisher
+type MediaLibrary struct {
+	dir        string
+	streamName string
+
+	mutex      sync.Mutex
+	queue      []string
+	nowPlaying string
+	cancel     context.CancelFunc
+	done       chan struct{} // closed when playback has finished
+	skip       chan struct{}
+}
+
+// NewMediaLibrary creates a media library for the given directory.  Files are
+// played into the channel named streamName.
+func NewMediaLibrary(dir, streamName string) *MediaLibrary {
+	return &MediaLibrary{
+		dir:        dir,
+		streamName: streamName,
+		queue:      []string{},
+		skip:       make(chan struct{}, 1),
+	}
+}
+
+// List returns the names of all playable files in the library, relative to
+// the library directory.  If filter is not empty, only names containing it
+// are returned.
+func (ml *MediaLibrary) List(filter string) ([]string, error) {
+	if ml == nil || ml.dir == "" {
+		return nil, fmt.Errorf("media library is not configured")
+	}
+
+	filter = strings.ToLower(filter)
+	names := []string{}
+	err := filepath.WalkDir(ml.dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return nil
+		}
+
+		if !isLibraryFile(path) {
+			return nil
+		}
+
+		name, err := filepath.Rel(ml.dir, path)
+		if err != nil {
+			return nil
+		}
+		name = filepath.ToSlash(name)
+
+		if filter == "" || strings.Contains(strings.ToLower(name), filter) {
+			names = append(names, name)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("could not read media library: %w", err)
+	}
+
+	sort.Strings(names)
+	return names, nil
+}
+
+// Enqueue adds a file to the end of the play queue and starts playback if
+// nothing is playing.
+func (ml *MediaLibrary) Enqueue(name string) error {
+	if ml == nil || ml.dir == "" {
+		return fmt.Errorf("media library is not configured")
+	}
+
+	path, err := ml.resolve(name)
+	if err != nil {
+		return err
+	}
+
+	info, err := os.Stat(path)
+	if err != nil || info.IsDir() {
+		return fmt.Errorf("%q is not in the media library", name)
+	}
+
+	ml.mutex.Lock()
+	defer ml.mutex.Unlock()
+
+	ml.queue = append(ml.queue, filepath.ToSlash(filepath.Clean(name)))
+	if ml.cancel == nil {
+		ctx, cancel := context.WithCancel(context.Background())
+		ml.cancel = cancel
+		ml.done = make(chan struct{})
+		go ml.play(ctx, ml.done)
+	}
+	return nil
+}
+
+// Queue returns the files waiting to be played
+func (ml *MediaLibrary) Queue() []string {
+	ml.mutex.Lock()
+	defer ml.mutex.Unlock()
+
+	queue := make([]string, len(ml.queue))
+	copy(queue, ml.queue)
+	return queue
+}
+
+// NowPlaying returns the file that is currently playing, if any
+func (ml *MediaLibrary) NowPlaying() string {
+	ml.mutex.Lock()
+	defer ml.mutex.Unlock()
+
+	return ml.nowPlaying
+}
+
+// Skip stops the current file and moves on to the next one in the queue
+func (ml *MediaLibrary) Skip() error {
+	ml.mutex.Lock()
+	defer ml.mutex.Unlock()
+
+	if ml.nowPlaying == "" {
+		return fmt.Errorf("nothing is playing")
+	}
+
+	select {
+	case ml.skip <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// Stop clears the queue and ends playback
+func (ml *MediaLibrary) Stop() {
+	ml.mutex.Lock()
+	defer ml.mutex.Unlock()
+
+	ml.queue = []string{}
+	if ml.cancel != nil {
+		ml.cancel()
+	}
+}
+
+// resolve turns a library name into a path on disk, making sure it cannot
+// escape the library directory
+func (ml *MediaLibrary) resolve(name string) (string, error) {
+	clean := filepath.Clean(filepath.FromSlash(name))
+	if clean == "." || filepath.IsAbs(clean) || strings.HasPrefix(clean, "..") {
+		return "", fmt.Errorf("invalid file name %q", name)
+	}
+
+	if !isLibraryFile(clean) {
+		return "", fmt.Errorf("%q is not a supported file type", name)
+	}
+
+	return filepath.Join(ml.dir, clean), nil
+}
+
+// next pops the next file off the queue
+func (ml *MediaLibrary) next() (string, bool) {
+	ml.mutex.Lock()
+	defer ml.mutex.Unlock()
+
+	// Throw away a skip request that came in for the previous file
+	select {
+	case <-ml.skip:
+	default:
+	}
+
+	if len(ml.queue) == 0 {
+		ml.nowPlaying = ""
+		return "", false
+	}
+
+	name := ml.queue[0]
+	ml.queue = ml.queue[1:]
+	ml.nowPlaying = name
+	return name, true
+}
+
+// Done returns a channel that is closed once the current playback has
+// finished, or nil if nothing was ever played
+func (ml *MediaLibrary) Done() <-chan struct{} {
+	ml.mutex.Lock()
+	defer ml.mutex.Unlock()
+	return ml.done
+}
+
+// play plays the queued files one after another into the library's channel
+func (ml *MediaLibrary) play(ctx context.Context, done chan struct{}) {
+	var ch *Channel
+
+	defer close(done)
+	defer func() {
+		ml.mutex.Lock()
+		ml.nowPlaying = ""
+		ml.cancel = nil
+		ml.mutex.Unlock()
+
+		if ch != nil {
+			l.Lock()
+			// A publisher may have taken the stream name in the meantime
+			if channels[ml.streamName] == ch {
+				endChannel(ml.streamName, ch)
+			} else {
+				stats.endStream()
+				ch.close()
+			}
+			l.Unlock()
+		}
+		common.LogInfoln("[library] Playback finished")
+	}()
+
+	for {
+		name, ok := ml.next()
+		if !ok {
+			return
+		}
+
+		var err error
+		ch, err = ml.playFile(ctx, ch, name)
+		if err != nil {
+			common.LogErrorf("[library] Could not play %s: %v\n", name, err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		default:
+		}
+	}
+}
+
+// playFile demuxes a single file into the channel in real time.  The channel
+// is created for the first file that is played.
+func (ml *MediaLibrary) playFile(ctx context.Context, ch *Channel, name string) (*Channel, error) {
+	path, err := ml.resolve(name)
+	if err != nil {
+		return ch, err
+	}
+
+	demuxer, err := openLibraryFile(path)
+	if err != nil {
+		return ch, fmt.Errorf("could not open file: %w", err)
+	}
+	defer demuxer.Close()
+
+	streams, err := demuxer.Streams()
+	if err != nil {
+		return ch, fmt.Errorf("could not read streams: %w", err)
+	}
+
+	if ch == nil {
+		l.Lock()
+		if _, exists := channels[ml.streamName]; exists {
+			l.Unlock()
+			return ch, fmt.Errorf("stream %q is already running", ml.streamName)
+		}
+		ch = newChannel(ml.streamName, streams)
+		channels[ml.streamName] = ch
+		l.Unlock()
+
+		stats.startStream()
+	} else {
+		err = ch.writeHeader(streams)
+		if err != nil {
+			return ch, fmt.Errorf("could not write header: %w", err)
+		}
+	}
+
+	common.LogInfof("[library] Now playing %s on %s\n", name, ml.streamName)
+	if room := existingChatRoom(ml.streamName); room != nil {
+		title := strings.TrimSuffix(filepath.Base(name), filepath.Ext(name))
+		if len(title) > settings.TitleLength {
+			title = title[:settings.TitleLength]
+		}
+		room.SetPlaying(title, "")
+	}
+
+	start := time.Now()
+	for {
+		packet, err := demuxer.ReadPacket()
+		if err != nil {
+			if err == io.EOF {
+				break
+			}
+			return ch, fmt.Errorf("could not read packet: %w", err)
+		}
+
+		// Pace the packets so the file plays back in real time
+		if wait := packet.Time - time.Since(start); wait > 0 {
+			select {
+			case <-ctx.Done():
+				return ch, nil
+			case <-ml.skip:
+				common.LogInfof("[library] Skipped %s\n", name)
+				return ch, nil
+			case <-time.After(wait):
+			}
+		}
+
+		err = ch.WritePacket(packet)
+		if err != nil {
+			return ch, fmt.Errorf("could not write packet: %w", err)
+		}
+	}
+
+	return ch, nil
+}
+
+// libraryDemuxer is a demuxer for a file on disk
+type libraryDemuxer struct {
+	av.Demuxer
+	file *os.File
+}
+
+func (d libraryDemuxer) Close() error {
+	return d.file.Close()
+}
+
+// openLibraryFile opens a file with the demuxer that matches its extension
+func openLibraryFile(path string) (av.DemuxCloser, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var demuxer av.Demuxer
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".mp4":
+		demuxer = mp4.NewDemuxer(file)
+	case ".flv":
+		demuxer = flv.NewDemuxer(file)
+	default:
+		file.Close()
+		return nil, fmt.Errorf("unsupported file type")
+	}
+
+	return libraryDemuxer{Demuxer: demuxer, file: file}, nil
+}
+
+// isLibraryFile checks the extension of a file against the playable types
+func isLibraryFile(name string) bool {
+	ext := strings.ToLower(filepath.Ext(name))
+	for _, e := range libraryExtensions {
+		if ext == e {
+			return true
+		}
+	}
+	return false
+}
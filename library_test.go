@@ -0,0 +1,146 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/nareix/joy4/av"
+	"github.com/nareix/joy4/format/flv"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/zorchenhimer/MovieNight/common"
+)
+
+// writeTestFLV writes a short audio-only FLV file for playback tests
+func writeTestFLV(t *testing.T, path string, packets int) {
+	t.Helper()
+
+	streams := testStreams(t, av.AAC)
+	file, err := os.Create(path)
+	require.NoError(t, err)
+	defer file.Close()
+
+	muxer := flv.NewMuxer(file)
+	require.NoError(t, muxer.WriteHeader(streams))
+	for i := 0; i < packets; i++ {
+		err = muxer.WritePacket(av.Packet{
+			Time: time.Duration(i) * 23 * time.Millisecond,
+			Data: []byte{0x21, 0x00, 0x49, 0x90, 0x02, 0x19},
+		})
+		require.NoError(t, err)
+	}
+	require.NoError(t, muxer.WriteTrailer())
+}
+
+func TestMediaLibrary_List(t *testing.T) {
+	dir := t.TempDir()
+	require.NoError(t, os.MkdirAll(filepath.Join(dir, "shorts"), 0755))
+
+	for _, name := range []string{"Movie One.mp4", "movie two.flv", "shorts/cartoon.flv", "notes.txt", "poster.png"} {
+		require.NoError(t, os.WriteFile(filepath.Join(dir, name), []byte("data"), 0644))
+	}
+
+	ml := NewMediaLibrary(dir, "live")
+
+	names, err := ml.List("")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"Movie One.mp4", "movie two.flv", "shorts/cartoon.flv"}, names)
+
+	names, err = ml.List("MOVIE")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"Movie One.mp4", "movie two.flv"}, names)
+
+	_, err = NewMediaLibrary("", "live").List("")
+	assert.Error(t, err)
+}
+
+func TestMediaLibrary_Resolve(t *testing.T) {
+	ml := NewMediaLibrary("/srv/movies", "live")
+
+	path, err := ml.resolve("shorts/cartoon.flv")
+	require.NoError(t, err)
+	assert.Equal(t, filepath.Join("/srv/movies", "shorts", "cartoon.flv"), path)
+
+	for _, name := range []string{"../secret.flv", "/etc/passwd.flv", "shorts/../../secret.mp4", "settings.json", ""} {
+		_, err := ml.resolve(name)
+		assert.Error(t, err, name)
+	}
+}
+
+func TestMediaLibrary_EnqueueMissing(t *testing.T) {
+	ml := NewMediaLibrary(t.TempDir(), "live")
+	assert.Error(t, ml.Enqueue("missing.flv"))
+	assert.Empty(t, ml.Queue())
+	assert.Error(t, ml.Skip())
+}
+
+func TestMediaLibrary_Playback(t *testing.T) {
+	common.SetupLogging(common.LLError, "/dev/null")
+	settings = &Settings{TitleLength: 50}
+
+	dir := t.TempDir()
+	writeTestFLV(t, filepath.Join(dir, "first.flv"), 10)
+	writeTestFLV(t, filepath.Join(dir, "second.flv"), 10)
+
+	ml := NewMediaLibrary(dir, "library-test")
+	require.NoError(t, ml.Enqueue("first.flv"))
+	require.NoError(t, ml.Enqueue("second.flv"))
+
+	var ch *Channel
+	require.Eventually(t, func() bool {
+		_, found, err := findChannel("library-test")
+		ch = found
+		return err == nil
+	}, time.Second, 10*time.Millisecond, "channel should be created for playback")
+
+	assert.Eventually(t, func() bool {
+		return ml.NowPlaying() == "second.flv"
+	}, 2*time.Second, 10*time.Millisecond, "second file should start after the first")
+
+	ml.Stop()
+
+	waitForDone(t, ml.Done())
+	waitForDone(t, channelDone(ch)...)
+	_, _, err := findChannel("library-test")
+	assert.Error(t, err, "channel should be removed after playback stops")
+	assert.Empty(t, ml.NowPlaying())
+}
+
+func TestMediaLibrary_StopKeepsNewChannel(t *testing.T) {
+	common.SetupLogging(common.LLError, "/dev/null")
+	settings = &Settings{TitleLength: 50}
+
+	dir := t.TempDir()
+	writeTestFLV(t, filepath.Join(dir, "long.flv"), 200)
+
+	ml := NewMediaLibrary(dir, "library-takeover")
+	require.NoError(t, ml.Enqueue("long.flv"))
+
+	var played *Channel
+	require.Eventually(t, func() bool {
+		_, found, err := findChannel("library-takeover")
+		played = found
+		return err == nil
+	}, time.Second, 10*time.Millisecond, "channel should be created for playback")
+
+	// Somebody else takes the stream name over while the file plays
+	other := &Channel{}
+	l.Lock()
+	channels["library-takeover"] = other
+	l.Unlock()
+	defer func() {
+		l.Lock()
+		delete(channels, "library-takeover")
+		l.Unlock()
+	}()
+
+	ml.Stop()
+	waitForDone(t, ml.Done())
+	waitForDone(t, channelDone(played)...)
+
+	_, found, err := findChannel("library-takeover")
+	require.NoError(t, err)
+	assert.Same(t, other, found, "the new channel should be left alone")
+}
@@ -113,6 +113,16 @@ func run(args args) {
 		os.Exit(1)
 	}
 
+	library = NewMediaLibrary(settings.LibraryDir, settings.LibraryStream)
+	if settings.LibraryDir != "" {
+		common.LogInfoln("Media library: ", settings.LibraryDir)
+	}
+
+	// VODs the last run was writing when it went down
+	if settings.KeepVODs {
+		finishCrashedVODs(settings.GetVODDir())
+	}
+
 	if args.Addr == "" {
 		args.Addr = settings.ListenAddress
 	}
@@ -153,9 +163,18 @@ func run(args args) {
 	router.HandleFunc("/help", wrapAuth(handleHelpTemplate))
 	router.HandleFunc("/emotes", wrapAuth(handleEmoteTemplate))
 
-	router.HandleFunc("/live", wrapAuth(handleLive))
-	router.HandleFunc("/live/", wrapAuth(handleLiveSegments)) // HLS segments from /live/ path
-	router.HandleFunc("/hls/", wrapAuth(handleHLS))           // HLS playlist and segments
+	router.HandleFunc("/live", wrapStreamAuth(handleLive))
+	router.HandleFunc("/live/", wrapStreamAuth(handleLiveSegments)) // HLS segments from /live/ path
+	router.HandleFunc("/hls/", wrapStreamAuth(handleHLS))           // HLS playlist and segments
+	router.HandleFunc("/dash/", wrapAuth(handleDASH))               // DASH manifest and segments
+	router.HandleFunc("/c/", wrapAuth(handleChannelPage))
+	router.HandleFunc("/channels", wrapAuth(handleDirectory))
+	router.HandleFunc("/clips/", wrapAuth(handleClip))
+	router.HandleFunc("/vod/", wrapAuth(handleVOD))
+	router.HandleFunc("/api/channels", wrapAuth(handleChannelsAPI))
+	router.HandleFunc("/api/ingest", handleIngestAPI)
+	router.HandleFunc("/api/status", wrapAuth(handleStatusAPI))
+	router.HandleFunc("/api/vods", wrapAuth(handleVODsAPI))
 	router.HandleFunc("/", wrapAuth(handleDefault))
 
 	httpServer := &http.Server{
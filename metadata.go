@@ -0,0 +1,144 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/nareix/joy4/av"
+	"github.com/zorchenhimer/MovieNight/common"
+)
+
+// StreamMetadata describes the streams a publisher sends
+type StreamMetadata struct {
+	Width      int
+	Height     int
+	VideoCodec string
+	AudioCodec string
+	SampleRate int
+	Channels   int
+}
+
+// newStreamMetadata reads the metadata from the codecs of the streams.  It
+// returns nil if there are no streams.
+func newStreamMetadata(streams []av.CodecData) *StreamMetadata {
+	if len(streams) == 0 {
+		return nil
+	}
+
+	meta := &StreamMetadata{}
+	for _, stream := range streams {
+		switch codec := stream.(type) {
+		case av.VideoCodecData:
+			meta.VideoCodec = codec.Type().String()
+			meta.Width = codec.Width()
+			meta.Height = codec.Height()
+		case av.AudioCodecData:
+			meta.AudioCodec = codec.Type().String()
+			meta.SampleRate = codec.SampleRate()
+			meta.Channels = codec.ChannelLayout().Count()
+		}
+	}
+	return meta
+}
+
+func (m *StreamMetadata) String() string {
+	parts := []string{}
+
+	video := []string{}
+	if m.Width > 0 && m.Height > 0 {
+		video = append(video, fmt.Sprintf("%dx%d", m.Width, m.Height))
+	}
+	if m.VideoCodec != "" {
+		video = append(video, m.VideoCodec)
+	}
+	if len(video) > 0 {
+		parts = append(parts, strings.Join(video, " "))
+	}
+
+	audio := []string{}
+	if m.AudioCodec != "" {
+		audio = append(audio, m.AudioCodec)
+	}
+	if m.SampleRate > 0 {
+		audio = append(audio, fmt.Sprintf("%d Hz", m.SampleRate))
+	}
+	if m.Channels > 0 {
+		audio = append(audio, fmt.Sprintf("%d ch", m.Channels))
+	}
+	if len(audio) > 0 {
+		parts = append(parts, strings.Join(audio, " "))
+	}
+
+	if len(parts) == 0 {
+		return "no details"
+	}
+	return strings.Join(parts, ", ")
+}
+
+// setMetadata keeps the metadata of the publisher
+func (ch *Channel) setMetadata(meta *StreamMetadata) {
+	l.Lock()
+	defer l.Unlock()
+	ch.metadata = meta
+}
+
+// StreamStatus is the state of a live stream as served by /api/status
+type StreamStatus struct {
+	Stream    string
+	Group     string // channel group of renditions
+	Waiting   bool   // the publisher is gone and may come back
+	Backstage bool
+	Viewers   int
+	Metadata  *StreamMetadata
+}
+
+// streamStatuses returns the status of every live stream sorted by name.
+// Backstage streams are only included for mods and admins.
+func streamStatuses(level common.CommandLevel) []StreamStatus {
+	l.RLock()
+	list := make([]StreamStatus, 0, len(channels))
+	for streamPath, ch := range channels {
+		if ch.backstage && level < common.CmdlMod {
+			continue
+		}
+		list = append(list, StreamStatus{
+			Stream:    streamPath,
+			Group:     groupName(streamPath),
+			Waiting:   ch.waiting,
+			Backstage: ch.backstage,
+			Viewers:   ch.viewerCount(),
+			Metadata:  ch.metadata,
+		})
+	}
+	l.RUnlock()
+
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Stream < list[j].Stream
+	})
+	return list
+}
+
+// handleStatusAPI serves the status of the live streams as JSON.  It can be
+// limited to a single channel group with ?channel=<name>.
+func handleStatusAPI(w http.ResponseWriter, r *http.Request) {
+	list := streamStatuses(requesterLevel(r))
+	if group := r.URL.Query().Get("channel"); group != "" {
+		filtered := []StreamStatus{}
+		for _, status := range list {
+			if status.Group == group {
+				filtered = append(filtered, status)
+			}
+		}
+		list = filtered
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-cache")
+	err := json.NewEncoder(w).Encode(list)
+	if err != nil {
+		common.LogErrorf("Could not write stream status: %v\n", err)
+	}
+}
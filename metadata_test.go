@@ -0,0 +1,50 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/nareix/joy4/av"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/zorchenhimer/MovieNight/common"
+)
+
+func TestNewStreamMetadata(t *testing.T) {
+	assert.Nil(t, newStreamMetadata(nil))
+
+	meta := newStreamMetadata(testStreams(t, av.H264, av.AAC))
+	require.NotNil(t, meta)
+	assert.Equal(t, "H264", meta.VideoCodec)
+	assert.Equal(t, "AAC", meta.AudioCodec)
+	assert.Equal(t, 44100, meta.SampleRate)
+	assert.Equal(t, 2, meta.Channels)
+	assert.Equal(t, "640x360 H264, AAC 44100 Hz 2 ch", meta.String())
+
+	assert.Equal(t, "no details", (&StreamMetadata{}).String())
+}
+
+func TestSetMetadata_Status(t *testing.T) {
+	common.SetupLogging(common.LLError, "/dev/null")
+	settings = &Settings{}
+
+	streams := testStreams(t, av.AAC)
+
+	l.Lock()
+	ch := newChannel("metadata-test", streams)
+	channels["metadata-test"] = ch
+	l.Unlock()
+	defer func() {
+		l.Lock()
+		delete(channels, "metadata-test")
+		ch.close()
+		l.Unlock()
+		waitForDone(t, channelDone(ch)...)
+	}()
+
+	ch.setMetadata(newStreamMetadata(streams))
+
+	list := streamStatuses(common.CmdlUser)
+	require.Len(t, list, 1)
+	require.NotNil(t, list[0].Metadata)
+	assert.Equal(t, 44100, list[0].Metadata.SampleRate)
+}
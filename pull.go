@@ -0,0 +1,386 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nareix/joy4/av"
+	"github.com/nareix/joy4/format/flv"
+	"github.com/nareix/joy4/format/rtmp"
+	"github.com/zorchenhimer/MovieNight/common"
+)
+
+const (
+	pullDialTimeout = 10 * time.Second
+	pullReadTimeout = 15 * time.Second
+	pullMinBackoff  = time.Second
+	pullMaxBackoff  = time.Minute
+)
+
+// Puller states
+const (
+	PullConnecting = "connecting"
+	PullLive       = "live"
+	PullRetrying   = "retrying"
+	PullStopped    = "stopped"
+)
+
+// PullStatus is a snapshot of a puller
+type PullStatus struct {
+	Name       string
+	Source     string // URL of the source without its query or stream key
+	State      string
+	Since      time.Time // when the puller entered its current state
+	LastError  error
+	Reconnects int
+	Packets    int64
+}
+
+// Puller ingests a stream from a remote RTMP or HTTP-FLV URL and publishes it
+// as a local channel, the same way a publisher connecting to the RTMP server
+// would.  The source is reconnected with an exponential backoff when it fails.
+type Puller struct {
+	name   string
+	source string
+	ctx    context.Context
+	cancel context.CancelFunc
+	done   chan struct{}
+
+	// dial connects to the source.  Replaced in tests.
+	dial        func(source string) (av.DemuxCloser, error)
+	minBackoff  time.Duration
+	maxBackoff  time.Duration
+	readTimeout time.Duration
+	grace       time.Duration // how long viewers wait for the source to come back
+
+	mutex      sync.RWMutex
+	ch         *Channel // channel of the last connection, guarded by l
+	state      string
+	since      time.Time
+	lastError  error
+	reconnects int
+	packets    int64
+}
+
+var (
+	pullers      = map[string]*Puller{}
+	pullersMutex sync.Mutex
+)
+
+// NewPuller creates a puller that publishes source as the stream name
+func NewPuller(name, source string) (*Puller, error) {
+	if !isValidStreamName(name) {
+		return nil, fmt.Errorf("invalid stream name %q", name)
+	}
+
+	u, err := url.Parse(source)
+	if err != nil {
+		return nil, fmt.Errorf("invalid source URL: %w", err)
+	}
+	if u.Host == "" || (u.Scheme != "rtmp" && u.Scheme != "http" && u.Scheme != "https") {
+		return nil, fmt.Errorf("source URL must be rtmp://, http:// or https://, given %q", redactPullURL(source))
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Puller{
+		name:        name,
+		source:      source,
+		ctx:         ctx,
+		cancel:      cancel,
+		done:        make(chan struct{}),
+		dial:        dialPull,
+		minBackoff:  pullMinBackoff,
+		maxBackoff:  pullMaxBackoff,
+		readTimeout: pullReadTimeout,
+		grace:       time.Second * settings.ReconnectGracePeriod,
+		state:       PullConnecting,
+		since:       time.Now(),
+	}, nil
+}
+
+// StartPull starts pulling source into the stream name
+func StartPull(name, source string) (*Puller, error) {
+	pullersMutex.Lock()
+	defer pullersMutex.Unlock()
+
+	if _, exists := pullers[name]; exists {
+		return nil, fmt.Errorf("stream %s is already being pulled", name)
+	}
+
+	puller, err := NewPuller(name, source)
+	if err != nil {
+		return nil, err
+	}
+
+	pullers[name] = puller
+	puller.Start()
+	common.LogInfof("Pulling %s into stream %s\n", redactPullURL(source), name)
+	return puller, nil
+}
+
+// StopPull stops the puller of the stream name and ends its stream
+func StopPull(name string) error {
+	pullersMutex.Lock()
+	puller, exists := pullers[name]
+	delete(pullers, name)
+	pullersMutex.Unlock()
+
+	if !exists {
+		return fmt.Errorf("stream %s is not being pulled", name)
+	}
+
+	puller.Stop()
+	<-puller.Done()
+	return nil
+}
+
+// PullStatuses returns the status of every puller
+func PullStatuses() []PullStatus {
+	pullersMutex.Lock()
+	defer pullersMutex.Unlock()
+
+	statuses := make([]PullStatus, 0, len(pullers))
+	for _, puller := range pullers {
+		statuses = append(statuses, puller.Status())
+	}
+	return statuses
+}
+
+// Start begins pulling the stream
+func (p *Puller) Start() {
+	go p.run()
+}
+
+// Stop disconnects from the source and ends the stream
+func (p *Puller) Stop() {
+	if p == nil {
+		return
+	}
+	p.cancel()
+}
+
+// Done returns a channel that is closed once the puller has stopped
+func (p *Puller) Done() <-chan struct{} {
+	return p.done
+}
+
+// Status returns a snapshot of the puller
+func (p *Puller) Status() PullStatus {
+	p.mutex.RLock()
+	defer p.mutex.RUnlock()
+
+	return PullStatus{
+		Name:       p.name,
+		Source:     redactPullURL(p.source),
+		State:      p.state,
+		Since:      p.since,
+		LastError:  p.lastError,
+		Reconnects: p.reconnects,
+		Packets:    p.packets,
+	}
+}
+
+func (p *Puller) setState(state string, err error) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	p.state = state
+	p.since = time.Now()
+	if err != nil {
+		p.lastError = err
+	}
+}
+
+// run connects to the source and publishes it until the puller is stopped,
+// reconnecting whenever the source fails or ends
+func (p *Puller) run() {
+	defer close(p.done)
+	defer p.setState(PullStopped, nil)
+	defer p.endStream()
+
+	backoff := p.minBackoff
+	for {
+		p.setState(PullConnecting, nil)
+		connected, err := p.pull()
+		if p.ctx.Err() != nil {
+			return
+		}
+		if err == nil {
+			err = fmt.Errorf("the source ended the stream")
+		}
+
+		common.LogErrorf("Pull of %s from %s failed: %v\n", p.name, redactPullURL(p.source), err)
+		if connected {
+			backoff = p.minBackoff
+		}
+
+		p.setState(PullRetrying, err)
+		select {
+		case <-time.After(backoff):
+		case <-p.ctx.Done():
+			return
+		}
+
+		p.mutex.Lock()
+		p.reconnects++
+		p.mutex.Unlock()
+
+		backoff *= 2
+		if backoff > p.maxBackoff {
+			backoff = p.maxBackoff
+		}
+	}
+}
+
+// pull makes a single connection to the source and copies its packets into
+// the channel.  Returns a nil error when the source ended the stream.
+func (p *Puller) pull() (connected bool, err error) {
+	src, err := p.dial(p.source)
+	if err != nil {
+		return false, fmt.Errorf("could not connect: %w", err)
+	}
+
+	// Close the source when the puller is stopped or the source stalls so
+	// a blocked read returns
+	stall := time.AfterFunc(p.readTimeout, func() { src.Close() })
+	defer stall.Stop()
+	stop := context.AfterFunc(p.ctx, func() { src.Close() })
+	defer stop()
+	defer src.Close()
+
+	streams, err := src.Streams()
+	if err != nil {
+		return false, fmt.Errorf("could not read stream header: %w", err)
+	}
+
+	l.Lock()
+	ch, err := startPublishing(p.name, streams)
+	if err == nil {
+		p.ch = ch
+	}
+	l.Unlock()
+	if err != nil {
+		return false, err
+	}
+
+	p.setState(PullLive, nil)
+	common.LogInfof("Pulled stream %s is live\n", p.name)
+	streamModNotice(p.name, fmt.Sprintf("Pulling %s from %s", p.name, redactPullURL(p.source)))
+
+	defer func() {
+		if p.ctx.Err() != nil {
+			// endStream closes the channel right away
+			return
+		}
+		l.Lock()
+		stopPublishing(p.name, ch, p.grace)
+		l.Unlock()
+	}()
+
+	for {
+		stall.Reset(p.readTimeout)
+		pkt, err := src.ReadPacket()
+		if err == io.EOF {
+			return true, nil
+		}
+		if err != nil {
+			return true, fmt.Errorf("could not read packet: %w", err)
+		}
+
+		err = ch.WritePacket(pkt)
+		if err != nil {
+			return true, fmt.Errorf("could not write packet: %w", err)
+		}
+
+		p.mutex.Lock()
+		p.packets++
+		p.mutex.Unlock()
+	}
+}
+
+// endStream closes the puller's channel when the puller is stopped, whether
+// the source is connected or the channel is waiting for it to come back
+func (p *Puller) endStream() {
+	l.Lock()
+	defer l.Unlock()
+
+	if p.ch == nil || channels[p.name] != p.ch {
+		return
+	}
+
+	common.LogInfof("Stopped pulling stream %s\n", p.name)
+	stopPublishing(p.name, p.ch, 0)
+	p.ch = nil
+}
+
+// httpFLVSource is an FLV stream read from an HTTP response
+type httpFLVSource struct {
+	*flv.Demuxer
+	body io.Closer
+}
+
+func (s httpFLVSource) Close() error {
+	return s.body.Close()
+}
+
+// rtmpPullConn is an RTMP client connection that doesn't wait forever on the
+// handshake
+type rtmpPullConn struct {
+	*rtmp.Conn
+}
+
+func (c rtmpPullConn) Streams() ([]av.CodecData, error) {
+	// The handshake and play happen here
+	c.NetConn().SetDeadline(time.Now().Add(pullDialTimeout))
+	defer c.NetConn().SetDeadline(time.Time{})
+	return c.Conn.Streams()
+}
+
+var pullHTTPClient = &http.Client{
+	Transport: &http.Transport{
+		Proxy:                 http.ProxyFromEnvironment,
+		DialContext:           (&net.Dialer{Timeout: pullDialTimeout}).DialContext,
+		TLSHandshakeTimeout:   pullDialTimeout,
+		ResponseHeaderTimeout: pullDialTimeout,
+	},
+}
+
+func dialPull(source string) (av.DemuxCloser, error) {
+	if strings.HasPrefix(source, "rtmp://") {
+		conn, err := rtmp.DialTimeout(source, pullDialTimeout)
+		if err != nil {
+			return nil, err
+		}
+		return rtmpPullConn{conn}, nil
+	}
+
+	resp, err := pullHTTPClient.Get(source)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return httpFLVSource{Demuxer: flv.NewDemuxer(resp.Body), body: resp.Body}, nil
+}
+
+// redactPullURL removes the query and the stream key of RTMP URLs from a
+// source URL so it can be shown in chat and logs
+func redactPullURL(source string) string {
+	u, err := url.Parse(source)
+	if err != nil || u.Host == "" {
+		return "(invalid URL)"
+	}
+	if u.Scheme == "rtmp" {
+		return redactRelayURL(source)
+	}
+	return u.Scheme + "://" + u.Host + u.Path
+}
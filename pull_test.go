@@ -0,0 +1,82 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/zorchenhimer/MovieNight/common"
+)
+
+func TestNewPuller_Invalid(t *testing.T) {
+	settings = &Settings{TitleLength: 50}
+
+	_, err := NewPuller("", "rtmp://example.com/live/key")
+	assert.Error(t, err)
+	_, err = NewPuller("a/b", "rtmp://example.com/live/key")
+	assert.Error(t, err)
+	_, err = NewPuller("remote", "ftp://example.com/live.flv")
+	assert.Error(t, err)
+	_, err = NewPuller("remote", "http:///live.flv")
+	assert.Error(t, err)
+
+	assert.Error(t, StopPull("not-pulled"))
+}
+
+func TestRedactPullURL(t *testing.T) {
+	assert.Equal(t, "rtmp://origin.example.com/live", redactPullURL("rtmp://origin.example.com/live/secretkey"))
+	assert.Equal(t, "https://cdn.example.com/live.flv", redactPullURL("https://cdn.example.com/live.flv?token=secret"))
+}
+
+func TestPuller_HTTPFLVReconnects(t *testing.T) {
+	common.SetupLogging(common.LLError, "/dev/null")
+	settings = &Settings{TitleLength: 50}
+
+	file := filepath.Join(t.TempDir(), "source.flv")
+	writeTestFLV(t, file, 10)
+	data, err := os.ReadFile(file)
+	require.NoError(t, err)
+
+	// The first connection ends right away, the second one stays open
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(data)
+		if atomic.AddInt32(&requests, 1) > 1 {
+			w.(http.Flusher).Flush()
+			<-r.Context().Done()
+		}
+	}))
+	defer server.Close()
+
+	puller, err := NewPuller("pull-test", server.URL+"/live.flv")
+	require.NoError(t, err)
+	puller.minBackoff = 10 * time.Millisecond
+	puller.maxBackoff = 20 * time.Millisecond
+	puller.Start()
+
+	assert.Eventually(t, func() bool {
+		status := puller.Status()
+		return status.State == PullLive && status.Reconnects == 1
+	}, 2*time.Second, 5*time.Millisecond, "puller should reconnect after the source ends")
+
+	_, ch, err := findChannel("pull-test")
+	require.NoError(t, err, "pulled stream should be registered as a channel")
+	assert.NotNil(t, ch.hlsChan)
+
+	puller.Stop()
+	select {
+	case <-puller.Done():
+	case <-time.After(time.Second):
+		t.Fatal("puller should stop")
+	}
+	assert.Equal(t, PullStopped, puller.Status().State)
+
+	_, _, err = findChannel("pull-test")
+	assert.Error(t, err, "stopping the puller should end the stream")
+}
@@ -0,0 +1,465 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nareix/joy4/av"
+	"github.com/nareix/joy4/av/pubsub"
+	"github.com/nareix/joy4/format/flv"
+	"github.com/nareix/joy4/format/ts"
+	"github.com/zorchenhimer/MovieNight/common"
+)
+
+// RecorderConfig represents configuration for writing a stream to disk
+type RecorderConfig struct {
+	Dir         string        // Directory the recordings are written to
+	Format      string        // Container format of the recordings ("flv" or "ts")
+	MaxDuration time.Duration // Start a new file after this long (0 disables)
+	MaxSize     int64         // Start a new file after this many bytes (0 disables)
+	Retention   int           // Number of files to keep per stream (0 keeps everything)
+}
+
+// RecorderStatus is a snapshot of a running recorder
+type RecorderStatus struct {
+	Stream      string
+	CurrentFile string
+	Started     time.Time
+	Files       int
+	Bytes       int64
+}
+
+// Recorder writes everything published to a Channel's queue to disk
+type Recorder struct {
+	que        *pubsub.Queue
+	streamName string
+	config     RecorderConfig
+	ctx        context.Context
+	cancel     context.CancelFunc
+	done       chan struct{}
+
+	mutex       sync.RWMutex
+	currentFile string
+	started     time.Time
+	files       int
+	bytes       int64
+	position    time.Duration // of the newest packet in the current file
+	chapters    []chapterMark // of the current file
+}
+
+// countingWriter keeps track of how many bytes have been written to the current file
+type countingWriter struct {
+	w     io.Writer
+	count int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.count += int64(n)
+	return n, err
+}
+
+// recordingFile is a single file of a recording along with its muxer
+type recordingFile struct {
+	file     *os.File
+	counter  *countingWriter
+	muxer    av.Muxer
+	name     string
+	opened   time.Time
+	baseTime time.Duration
+	gotBase  bool
+}
+
+// startRecording starts a recorder on the channel.  The caller is expected to hold the channel lock.
+func (ch *Channel) startRecording(streamName string) error {
+	if ch.recorder != nil {
+		return fmt.Errorf("stream %q is already being recorded", streamName)
+	}
+
+	recorder, err := NewRecorder(ch.que, streamName, settings.GetRecorderConfig())
+	if err != nil {
+		return fmt.Errorf("could not create recorder: %w", err)
+	}
+
+	err = recorder.Start()
+	if err != nil {
+		return fmt.Errorf("could not start recorder: %w", err)
+	}
+
+	ch.recorder = recorder
+
+	// A recorder that gave up, eg. on a full disk, can be started again
+	go func() {
+		<-recorder.Done()
+		l.Lock()
+		if ch.recorder == recorder {
+			ch.recorder = nil
+		}
+		l.Unlock()
+	}()
+	return nil
+}
+
+// stopRecording stops the channel's recorder if there is one.  The caller is
+// expected to hold the channel lock.
+func (ch *Channel) stopRecording() bool {
+	if ch.recorder == nil {
+		return false
+	}
+
+	ch.recorder.Stop()
+	ch.recorder = nil
+	return true
+}
+
+// createRecordingsDir creates the directory the recorders write to.  It is
+// called before the channel lock is taken, so the lock doesn't wait on the
+// disk.
+func createRecordingsDir() error {
+	err := os.MkdirAll(settings.GetRecorderConfig().Dir, 0755)
+	if err != nil {
+		return fmt.Errorf("could not create recordings directory: %w", err)
+	}
+	return nil
+}
+
+// NewRecorder creates a new recorder for the given queue.  The directory
+// of the recordings has to exist.
+func NewRecorder(que *pubsub.Queue, streamName string, config RecorderConfig) (*Recorder, error) {
+	if que == nil {
+		return nil, fmt.Errorf("queue cannot be nil")
+	}
+
+	switch config.Format {
+	case "flv", "ts":
+	default:
+		return nil, fmt.Errorf("unsupported recording format: %q", config.Format)
+	}
+
+	if config.Dir == "" {
+		return nil, fmt.Errorf("recordings directory cannot be empty")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	return &Recorder{
+		que:        que,
+		streamName: streamName,
+		config:     config,
+		ctx:        ctx,
+		cancel:     cancel,
+		done:       make(chan struct{}),
+	}, nil
+}
+
+// Start begins writing the stream to disk
+func (r *Recorder) Start() error {
+	if r == nil {
+		return fmt.Errorf("recorder is nil")
+	}
+
+	r.mutex.Lock()
+	r.started = time.Now()
+	r.mutex.Unlock()
+
+	go r.record()
+	return nil
+}
+
+// Stop stops the recording.  The current file is finalized right away, even
+// if the stream stalled.
+func (r *Recorder) Stop() {
+	if r == nil || r.cancel == nil {
+		return
+	}
+	r.cancel()
+}
+
+// Done returns a channel that is closed once the last file has been written
+func (r *Recorder) Done() <-chan struct{} {
+	return r.done
+}
+
+// Status returns a snapshot of the recorder's progress
+func (r *Recorder) Status() RecorderStatus {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	return RecorderStatus{
+		Stream:      r.streamName,
+		CurrentFile: r.currentFile,
+		Started:     r.started,
+		Files:       r.files,
+		Bytes:       r.bytes,
+	}
+}
+
+// record reads packets from the queue and writes them to rotating files
+func (r *Recorder) record() {
+	defer close(r.done)
+	defer r.cancel() // stops the reader
+
+	cursor := r.que.Latest()
+	streams, err := cursor.Streams()
+	if err != nil {
+		common.LogErrorf("[record] Unable to get streams for %s: %v\n", r.streamName, err)
+		return
+	}
+
+	videoIdx := -1
+	for i, stream := range streams {
+		if stream.Type().IsVideo() {
+			videoIdx = i
+			break
+		}
+	}
+
+	var current *recordingFile
+	defer func() {
+		r.closeFile(current)
+	}()
+
+	// The cursor blocks until the next packet, so it is read on its own to
+	// let Stop close the file of a stalled stream
+	packets := make(chan av.Packet)
+	readErr := make(chan error, 1)
+	go func() {
+		for {
+			packet, err := cursor.ReadPacket()
+			if err != nil {
+				readErr <- err
+				return
+			}
+			select {
+			case packets <- packet:
+			case <-r.ctx.Done():
+				return
+			}
+		}
+	}()
+
+	for {
+		var packet av.Packet
+		select {
+		case <-r.ctx.Done():
+			return
+		case err := <-readErr:
+			if err != io.EOF {
+				common.LogErrorf("[record] Error reading from stream cursor: %v\n", err)
+			}
+			return
+		case packet = <-packets:
+		}
+
+		isVideoKey := videoIdx == -1 || (int(packet.Idx) == videoIdx && packet.IsKeyFrame)
+
+		// Don't start a file in the middle of a GOP.
+		if current == nil && !isVideoKey {
+			continue
+		}
+
+		// Only rotate on keyframes so every file starts playable.
+		if current != nil && isVideoKey && r.shouldRotate(current) {
+			r.closeFile(current)
+			current = nil
+		}
+
+		if current == nil {
+			current, err = r.openFile(streams)
+			if err != nil {
+				common.LogErrorf("[record] Could not open recording file: %v\n", err)
+				return
+			}
+		}
+
+		if !current.gotBase {
+			current.baseTime = packet.Time
+			current.gotBase = true
+		}
+		packet.Time -= current.baseTime
+
+		err = current.muxer.WritePacket(packet)
+		if err != nil {
+			common.LogErrorf("[record] Error writing packet to %s: %v\n", current.name, err)
+			return
+		}
+
+		r.mutex.Lock()
+		r.bytes += int64(len(packet.Data))
+		r.position = packet.Time
+		r.mutex.Unlock()
+	}
+}
+
+// shouldRotate checks the size and time limits of the current file
+func (r *Recorder) shouldRotate(file *recordingFile) bool {
+	if r.config.MaxSize > 0 && file.counter.count >= r.config.MaxSize {
+		return true
+	}
+	if r.config.MaxDuration > 0 && time.Since(file.opened) >= r.config.MaxDuration {
+		return true
+	}
+	return false
+}
+
+// openFile creates a new file in the recordings directory and writes the stream headers to it
+func (r *Recorder) openFile(streams []av.CodecData) (*recordingFile, error) {
+	name := filepath.Join(r.config.Dir, recordingFileName(r.streamName, r.config.Format, time.Now()))
+
+	file, err := os.Create(name)
+	if err != nil {
+		return nil, fmt.Errorf("could not create %s: %w", name, err)
+	}
+
+	counter := &countingWriter{w: file}
+
+	var muxer av.Muxer
+	switch r.config.Format {
+	case "ts":
+		muxer = ts.NewMuxer(counter)
+	default:
+		muxer = flv.NewMuxer(counter)
+	}
+
+	err = muxer.WriteHeader(streams)
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("could not write header to %s: %w", name, err)
+	}
+
+	r.mutex.Lock()
+	r.currentFile = name
+	r.files++
+	r.mutex.Unlock()
+
+	common.LogInfof("[record] Recording %s to %s\n", r.streamName, name)
+
+	return &recordingFile{
+		file:    file,
+		counter: counter,
+		muxer:   muxer,
+		name:    name,
+		opened:  time.Now(),
+	}, nil
+}
+
+// closeFile finalizes a recording file and applies the retention limit
+func (r *Recorder) closeFile(file *recordingFile) {
+	if file == nil {
+		return
+	}
+
+	err := file.muxer.WriteTrailer()
+	if err != nil {
+		common.LogErrorf("[record] Could not write trailer to %s: %v\n", file.name, err)
+	}
+
+	err = file.file.Close()
+	if err != nil {
+		common.LogErrorf("[record] Could not close %s: %v\n", file.name, err)
+	}
+
+	// The chapter that is going on carries over to the next file
+	r.mutex.Lock()
+	r.currentFile = ""
+	marks, end := r.chapters, r.position
+	r.chapters, r.position = nil, 0
+	if len(marks) > 0 {
+		r.chapters = []chapterMark{{Title: marks[len(marks)-1].Title}}
+	}
+	r.mutex.Unlock()
+
+	common.LogInfof("[record] Finished %s (%d bytes)\n", file.name, file.counter.count)
+
+	if len(marks) > 0 {
+		err = saveChaptersVTT(chaptersFileName(file.name), marks, end)
+		if err != nil {
+			common.LogErrorf("[record] Could not save the chapters of %s: %v\n", file.name, err)
+		}
+	}
+
+	err = pruneRecordings(r.config.Dir, r.streamName, r.config.Retention)
+	if err != nil {
+		common.LogErrorf("[record] Could not prune old recordings: %v\n", err)
+	}
+}
+
+// addChapter marks a chapter in the current file.  The chapters of a file are
+// saved next to it in a WebVTT file when it's finished.
+func (r *Recorder) addChapter(chapter Chapter) {
+	if r == nil {
+		return
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.chapters = append(r.chapters, chapterMark{At: r.position, Title: chapter.Title})
+}
+
+// chaptersFileName returns the name of the chapters file of a recording
+func chaptersFileName(name string) string {
+	return strings.TrimSuffix(name, filepath.Ext(name)) + ".vtt"
+}
+
+// recordingTimeLayout is the timestamp format used in recording file names
+const recordingTimeLayout = "20060102-150405.000"
+
+// recordingFileName returns the file name used for a recording started at the given time
+func recordingFileName(streamName, format string, t time.Time) string {
+	return fmt.Sprintf("%s_%s.%s", streamName, t.Format(recordingTimeLayout), format)
+}
+
+// pruneRecordings removes the oldest recordings of a stream so that at most
+// keep files remain.  A keep value of zero or less disables pruning.
+func pruneRecordings(dir, streamName string, keep int) error {
+	if keep <= 0 {
+		return nil
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return fmt.Errorf("could not read recordings directory: %w", err)
+	}
+
+	// The timestamp in the name sorts the same as the time the recording started.
+	names := []string{}
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+		ext := filepath.Ext(entry.Name())
+		if ext != ".flv" && ext != ".ts" {
+			continue
+		}
+		stamp := strings.TrimSuffix(strings.TrimPrefix(entry.Name(), streamName+"_"), ext)
+		if _, err := time.Parse(recordingTimeLayout, stamp); err == nil {
+			names = append(names, entry.Name())
+		}
+	}
+
+	if len(names) <= keep {
+		return nil
+	}
+
+	sort.Strings(names)
+	for _, name := range names[:len(names)-keep] {
+		err = os.Remove(filepath.Join(dir, name))
+		if err != nil {
+			return fmt.Errorf("could not remove %s: %w", name, err)
+		}
+		err = os.Remove(filepath.Join(dir, chaptersFileName(name)))
+		if err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("could not remove chapters of %s: %w", name, err)
+		}
+		common.LogInfof("[record] Removed old recording %s\n", name)
+	}
+
+	return nil
+}
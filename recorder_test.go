@@ -0,0 +1,172 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/nareix/joy4/av"
+	"github.com/nareix/joy4/av/pubsub"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/zorchenhimer/MovieNight/common"
+)
+
+func TestNewRecorder_InvalidConfig(t *testing.T) {
+	common.SetupLogging(common.LLError, "/dev/null")
+
+	_, err := NewRecorder(nil, "live", RecorderConfig{Dir: t.TempDir(), Format: "flv"})
+	assert.Error(t, err)
+
+	queue := pubsub.NewQueue()
+	_, err = NewRecorder(queue, "live", RecorderConfig{Dir: t.TempDir(), Format: "mkv"})
+	assert.Error(t, err)
+
+	_, err = NewRecorder(queue, "live", RecorderConfig{Format: "ts"})
+	assert.Error(t, err)
+}
+
+func TestRecorder_WritesFile(t *testing.T) {
+	common.SetupLogging(common.LLError, "/dev/null")
+
+	for _, format := range []string{"flv", "ts"} {
+		t.Run(format, func(t *testing.T) {
+			dir := t.TempDir()
+			queue := newTestQueue(t, av.AAC)
+
+			recorder, err := NewRecorder(queue, "live", RecorderConfig{Dir: dir, Format: format})
+			require.NoError(t, err)
+			require.NoError(t, recorder.Start())
+
+			// Give the recorder a moment to attach its cursor to the queue
+			time.Sleep(50 * time.Millisecond)
+
+			for i := 0; i < 10; i++ {
+				err = queue.WritePacket(av.Packet{
+					Time: time.Duration(i) * 23 * time.Millisecond,
+					Data: []byte{0x21, 0x00, 0x49, 0x90, 0x02, 0x19},
+				})
+				require.NoError(t, err)
+			}
+			queue.Close()
+
+			select {
+			case <-recorder.Done():
+			case <-time.After(2 * time.Second):
+				t.Fatal("recorder did not finish after the queue was closed")
+			}
+
+			entries, err := os.ReadDir(dir)
+			require.NoError(t, err)
+			require.Len(t, entries, 1)
+			assert.Equal(t, "."+format, filepath.Ext(entries[0].Name()))
+
+			info, err := entries[0].Info()
+			require.NoError(t, err)
+			assert.Greater(t, info.Size(), int64(0))
+
+			status := recorder.Status()
+			assert.Equal(t, 1, status.Files)
+			assert.Equal(t, "", status.CurrentFile)
+		})
+	}
+}
+
+func TestRecorder_StopStalled(t *testing.T) {
+	common.SetupLogging(common.LLError, "/dev/null")
+
+	dir := t.TempDir()
+	queue := newTestQueue(t, av.AAC)
+	defer queue.Close()
+
+	recorder, err := NewRecorder(queue, "live", RecorderConfig{Dir: dir, Format: "flv"})
+	require.NoError(t, err)
+	require.NoError(t, recorder.Start())
+	time.Sleep(50 * time.Millisecond)
+
+	require.NoError(t, queue.WritePacket(av.Packet{Data: []byte{0x21, 0x00, 0x49, 0x90, 0x02, 0x19}}))
+	require.Eventually(t, func() bool {
+		return recorder.Status().CurrentFile != ""
+	}, time.Second, 10*time.Millisecond)
+
+	// No more packets come, the file is closed anyway
+	recorder.Stop()
+	waitForDone(t, recorder.Done())
+	assert.Equal(t, "", recorder.Status().CurrentFile)
+}
+
+func TestPruneRecordings(t *testing.T) {
+	common.SetupLogging(common.LLError, "/dev/null")
+
+	dir := t.TempDir()
+	start := time.Date(2024, 1, 1, 20, 0, 0, 0, time.UTC)
+
+	names := []string{}
+	for i := 0; i < 4; i++ {
+		name := recordingFileName("live", "flv", start.Add(time.Duration(i)*time.Hour))
+		names = append(names, name)
+		require.NoError(t, os.WriteFile(filepath.Join(dir, name), []byte("data"), 0644))
+	}
+
+	// Files that don't belong to the stream must never be removed
+	others := []string{
+		recordingFileName("live_hd", "flv", start),
+		"notes.txt",
+	}
+	for _, name := range others {
+		require.NoError(t, os.WriteFile(filepath.Join(dir, name), []byte("data"), 0644))
+	}
+
+	require.NoError(t, pruneRecordings(dir, "live", 2))
+
+	for i, name := range names {
+		_, err := os.Stat(filepath.Join(dir, name))
+		if i < 2 {
+			assert.True(t, os.IsNotExist(err), "%s should have been removed", name)
+		} else {
+			assert.NoError(t, err, "%s should have been kept", name)
+		}
+	}
+
+	for _, name := range others {
+		_, err := os.Stat(filepath.Join(dir, name))
+		assert.NoError(t, err, "%s should have been kept", name)
+	}
+
+	// Zero disables pruning
+	require.NoError(t, pruneRecordings(dir, "live", 0))
+	_, err := os.Stat(filepath.Join(dir, names[2]))
+	assert.NoError(t, err)
+}
+
+func TestChannel_RecorderGivesUp(t *testing.T) {
+	common.SetupLogging(common.LLError, "/dev/null")
+	dir := filepath.Join(t.TempDir(), "recordings")
+	settings = &Settings{TitleLength: 50, RecordingsDir: dir, RecordingFormat: "flv"}
+
+	queue := newTestQueue(t, av.AAC)
+	ch := &Channel{que: queue}
+	l.Lock()
+	require.NoError(t, ch.startRecording("live"))
+	l.Unlock()
+	time.Sleep(50 * time.Millisecond)
+
+	// The recording can't be written
+	require.NoError(t, os.RemoveAll(dir))
+	require.NoError(t, queue.WritePacket(av.Packet{Data: []byte{0x21, 0x00, 0x49, 0x90, 0x02, 0x19}}))
+
+	assert.Eventually(t, func() bool {
+		l.Lock()
+		defer l.Unlock()
+		return ch.recorder == nil
+	}, 2*time.Second, 10*time.Millisecond, "the recorder is cleared once it stops")
+
+	require.NoError(t, os.MkdirAll(dir, 0755))
+	l.Lock()
+	require.NoError(t, ch.startRecording("live"), "recording can be started again")
+	recorder := ch.recorder
+	l.Unlock()
+	queue.Close()
+	waitForDone(t, recorder.Done())
+}
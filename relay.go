@@ -0,0 +1,301 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"path"
+	"sync"
+	"time"
+
+	"github.com/nareix/joy4/av"
+	"github.com/nareix/joy4/av/pubsub"
+	"github.com/nareix/joy4/format/rtmp"
+	"github.com/zorchenhimer/MovieNight/common"
+)
+
+const (
+	relayDialTimeout  = 10 * time.Second
+	relayWriteTimeout = 10 * time.Second
+	relayMinBackoff   = time.Second
+	relayMaxBackoff   = time.Minute
+)
+
+// RelayTarget is an external RTMP server a stream is pushed to
+type RelayTarget struct {
+	URL    string // rtmp:// URL of the destination, including its stream key
+	Stream string // name of the local stream to relay; defaults to "live"
+}
+
+// Relay states
+const (
+	RelayConnecting = "connecting"
+	RelayLive       = "live"
+	RelayRetrying   = "retrying"
+	RelayStopped    = "stopped"
+)
+
+// RelayStatus is a snapshot of a relay
+type RelayStatus struct {
+	Target     string // URL of the destination without the stream key
+	State      string
+	Since      time.Time // when the relay entered its current state
+	LastError  error
+	Reconnects int
+	Packets    int64
+}
+
+// Relay copies everything published to a Channel's queue to an external RTMP
+// server.  The connection is retried with an exponential backoff when it fails.
+type Relay struct {
+	que    *pubsub.Queue
+	target string
+	stream string // local stream, the mods of its channel are told about the relay
+	ctx    context.Context
+	cancel context.CancelFunc
+	done   chan struct{}
+
+	// dial connects to the target.  Replaced in tests.
+	dial       func(target string) (av.MuxCloser, error)
+	minBackoff time.Duration
+	maxBackoff time.Duration
+
+	mutex      sync.RWMutex
+	state      string
+	since      time.Time
+	lastError  error
+	reconnects int
+	packets    int64
+}
+
+// NewRelay creates a relay from the queue to the given RTMP URL
+func NewRelay(que *pubsub.Queue, target string) (*Relay, error) {
+	if que == nil {
+		return nil, fmt.Errorf("queue cannot be nil")
+	}
+
+	u, err := url.Parse(target)
+	if err != nil {
+		return nil, fmt.Errorf("invalid relay URL: %w", err)
+	}
+	if u.Scheme != "rtmp" || u.Host == "" {
+		return nil, fmt.Errorf("relay URL must be rtmp://host/app/key, given %q", redactRelayURL(target))
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Relay{
+		que:        que,
+		target:     target,
+		ctx:        ctx,
+		cancel:     cancel,
+		done:       make(chan struct{}),
+		dial:       dialRelay,
+		minBackoff: relayMinBackoff,
+		maxBackoff: relayMaxBackoff,
+		state:      RelayConnecting,
+		since:      time.Now(),
+	}, nil
+}
+
+// Start begins relaying the stream
+func (r *Relay) Start() {
+	go r.run()
+}
+
+// Stop stops relaying.  The connection is closed once the next packet
+// arrives or the queue is closed.
+func (r *Relay) Stop() {
+	if r == nil {
+		return
+	}
+	r.cancel()
+}
+
+// Done returns a channel that is closed once the relay has stopped
+func (r *Relay) Done() <-chan struct{} {
+	return r.done
+}
+
+// Status returns a snapshot of the relay
+func (r *Relay) Status() RelayStatus {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	return RelayStatus{
+		Target:     redactRelayURL(r.target),
+		State:      r.state,
+		Since:      r.since,
+		LastError:  r.lastError,
+		Reconnects: r.reconnects,
+		Packets:    r.packets,
+	}
+}
+
+func (r *Relay) setState(state string, err error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	r.state = state
+	r.since = time.Now()
+	if err != nil {
+		r.lastError = err
+	}
+}
+
+// run connects to the target and copies packets until the relay is stopped
+// or the queue is closed, reconnecting whenever the connection fails
+func (r *Relay) run() {
+	defer close(r.done)
+	defer r.setState(RelayStopped, nil)
+
+	backoff := r.minBackoff
+	for {
+		r.setState(RelayConnecting, nil)
+		connected, err := r.relay()
+		if err == nil || r.ctx.Err() != nil {
+			return
+		}
+
+		common.LogErrorf("Relay to %s failed: %v\n", redactRelayURL(r.target), err)
+		if connected {
+			backoff = r.minBackoff
+			streamModNotice(r.stream, fmt.Sprintf("Relay to %s lost its connection, reconnecting", redactRelayURL(r.target)))
+		}
+
+		r.setState(RelayRetrying, err)
+		select {
+		case <-time.After(backoff):
+		case <-r.ctx.Done():
+			return
+		}
+
+		r.mutex.Lock()
+		r.reconnects++
+		r.mutex.Unlock()
+
+		backoff *= 2
+		if backoff > r.maxBackoff {
+			backoff = r.maxBackoff
+		}
+	}
+}
+
+// relay makes a single connection to the target and copies packets to it.
+// Returns a nil error when the relay was stopped or the stream ended.
+func (r *Relay) relay() (connected bool, err error) {
+	conn, err := r.dial(r.target)
+	if err != nil {
+		return false, fmt.Errorf("could not connect: %w", err)
+	}
+	defer conn.Close()
+
+	cursor := r.que.Latest()
+	streams, err := cursor.Streams()
+	if err != nil {
+		return false, nil
+	}
+
+	err = conn.WriteHeader(streams)
+	if err != nil {
+		return false, fmt.Errorf("could not publish: %w", err)
+	}
+
+	r.setState(RelayLive, nil)
+	common.LogInfof("Relaying stream to %s\n", redactRelayURL(r.target))
+	streamModNotice(r.stream, fmt.Sprintf("Relaying the stream to %s", redactRelayURL(r.target)))
+
+	// The destination sees a new stream on every connection, so start it at zero
+	var base time.Duration
+	gotBase := false
+	for {
+		pkt, err := cursor.ReadPacket()
+		if err != nil {
+			// The queue was closed, the stream is over
+			conn.WriteTrailer()
+			return true, nil
+		}
+
+		if r.ctx.Err() != nil {
+			conn.WriteTrailer()
+			return true, nil
+		}
+
+		if !gotBase {
+			base, gotBase = pkt.Time, true
+		}
+		pkt.Time -= base
+
+		err = conn.WritePacket(pkt)
+		if err != nil {
+			return true, fmt.Errorf("could not send packet: %w", err)
+		}
+
+		r.mutex.Lock()
+		r.packets++
+		r.mutex.Unlock()
+	}
+}
+
+// rtmpRelayConn is an RTMP client connection that doesn't wait forever on a
+// stalled destination
+type rtmpRelayConn struct {
+	*rtmp.Conn
+}
+
+func (c rtmpRelayConn) WriteHeader(streams []av.CodecData) error {
+	// The handshake and publish happen here
+	c.NetConn().SetDeadline(time.Now().Add(relayDialTimeout))
+	defer c.NetConn().SetDeadline(time.Time{})
+	return c.Conn.WriteHeader(streams)
+}
+
+func (c rtmpRelayConn) WritePacket(pkt av.Packet) error {
+	c.NetConn().SetWriteDeadline(time.Now().Add(relayWriteTimeout))
+	return c.Conn.WritePacket(pkt)
+}
+
+func dialRelay(target string) (av.MuxCloser, error) {
+	conn, err := rtmp.DialTimeout(target, relayDialTimeout)
+	if err != nil {
+		return nil, err
+	}
+	return rtmpRelayConn{conn}, nil
+}
+
+// redactRelayURL removes the stream key, the last part of the path, from a
+// relay URL so it can be shown in chat and logs
+func redactRelayURL(target string) string {
+	u, err := url.Parse(target)
+	if err != nil || u.Host == "" {
+		return "(invalid URL)"
+	}
+	return u.Scheme + "://" + u.Host + path.Dir(u.Path)
+}
+
+// startRelays starts a relay for every target of the stream.  The caller is
+// expected to hold the channel lock.
+func (ch *Channel) startRelays(streamName string) {
+	for _, target := range settings.GetRelayTargets() {
+		if target.Stream != streamName {
+			continue
+		}
+
+		relay, err := NewRelay(ch.que, target.URL)
+		if err != nil {
+			common.LogErrorf("Could not create relay for %s: %v\n", streamName, err)
+			continue
+		}
+		relay.stream = streamName
+		relay.Start()
+		ch.relays = append(ch.relays, relay)
+	}
+}
+
+// stopRelays stops all of the channel's relays.  The caller is expected to
+// hold the channel lock.
+func (ch *Channel) stopRelays() {
+	for _, relay := range ch.relays {
+		relay.Stop()
+	}
+	ch.relays = nil
+}
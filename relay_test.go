@@ -0,0 +1,123 @@
+package main
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/nareix/joy4/av"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/zorchenhimer/MovieNight/common"
+)
+
+// fakeRelayConn collects the packets a relay sends
+type fakeRelayConn struct {
+	mutex   sync.Mutex
+	packets []av.Packet
+	failAt  int // WritePacket fails on this packet, 0 never fails
+	closed  bool
+}
+
+func (c *fakeRelayConn) WriteHeader([]av.CodecData) error { return nil }
+func (c *fakeRelayConn) WriteTrailer() error              { return nil }
+
+func (c *fakeRelayConn) WritePacket(pkt av.Packet) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.failAt > 0 && len(c.packets)+1 == c.failAt {
+		return errors.New("connection reset")
+	}
+	c.packets = append(c.packets, pkt)
+	return nil
+}
+
+func (c *fakeRelayConn) Close() error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.closed = true
+	return nil
+}
+
+func (c *fakeRelayConn) count() int {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return len(c.packets)
+}
+
+func TestNewRelay_InvalidURL(t *testing.T) {
+	queue := newTestQueue(t, av.AAC)
+
+	_, err := NewRelay(nil, "rtmp://example.com/live/key")
+	assert.Error(t, err)
+	_, err = NewRelay(queue, "http://example.com/live/key")
+	assert.Error(t, err)
+	_, err = NewRelay(queue, "rtmp:///live/key")
+	assert.Error(t, err)
+}
+
+func TestRedactRelayURL(t *testing.T) {
+	assert.Equal(t, "rtmp://backup.example.com:1935/live", redactRelayURL("rtmp://backup.example.com:1935/live/secretkey"))
+	assert.NotContains(t, redactRelayURL("rtmp://a.example.com/app/secretkey"), "secretkey")
+}
+
+func TestRelay_ReconnectsWithBackoff(t *testing.T) {
+	common.SetupLogging(common.LLError, "/dev/null")
+
+	queue := newTestQueue(t, av.AAC)
+	relay, err := NewRelay(queue, "rtmp://backup.example.com/live/key")
+	require.NoError(t, err)
+	relay.minBackoff = 10 * time.Millisecond
+	relay.maxBackoff = 20 * time.Millisecond
+
+	// Fail to connect twice, then lose the connection on the third packet,
+	// then stay connected
+	var dials int
+	conns := []*fakeRelayConn{{failAt: 3}, {}}
+	relay.dial = func(string) (av.MuxCloser, error) {
+		dials++
+		if dials <= 2 {
+			return nil, errors.New("connection refused")
+		}
+		conn := conns[0]
+		conns = conns[1:]
+		return conn, nil
+	}
+	first, second := conns[0], conns[1]
+
+	relay.Start()
+
+	assert.Eventually(t, func() bool {
+		return relay.Status().State == RelayLive
+	}, time.Second, 5*time.Millisecond, "relay should connect after retrying")
+	assert.Equal(t, 2, relay.Status().Reconnects)
+	assert.Error(t, relay.Status().LastError)
+
+	for i := 0; i < 5; i++ {
+		require.NoError(t, queue.WritePacket(av.Packet{Time: time.Duration(i+10) * time.Second, Data: []byte{0x21}}))
+	}
+
+	assert.Eventually(t, func() bool {
+		return relay.Status().Reconnects == 3 && relay.Status().State == RelayLive
+	}, time.Second, 5*time.Millisecond, "relay should reconnect after losing the connection")
+	assert.Equal(t, 2, first.count())
+	first.mutex.Lock()
+	assert.Equal(t, time.Duration(0), first.packets[0].Time, "relayed streams should start at zero")
+	assert.True(t, first.closed)
+	first.mutex.Unlock()
+
+	require.NoError(t, queue.WritePacket(av.Packet{Time: 20 * time.Second, Data: []byte{0x21}}))
+	assert.Eventually(t, func() bool {
+		return second.count() > 0
+	}, time.Second, 5*time.Millisecond, "packets should go to the new connection")
+
+	queue.Close()
+	select {
+	case <-relay.Done():
+	case <-time.After(time.Second):
+		t.Fatal("relay should stop when the stream ends")
+	}
+	assert.Equal(t, RelayStopped, relay.Status().State)
+}
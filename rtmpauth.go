@@ -0,0 +1,132 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nareix/joy4/format/rtmp"
+)
+
+// playTokenLifetime is how long a play token from /playtoken can be used
+const playTokenLifetime = 24 * time.Hour
+
+var (
+	errRTMPPlayDisabled = errors.New("RTMP playback is disabled")
+	errPlayDenied       = errors.New("a valid play token or the room PIN is required")
+)
+
+// playToken lets a chat user watch the stream over RTMP
+type playToken struct {
+	name    string // chat name of the viewer
+	host    string // address the viewer was in chat from
+	expires time.Time
+}
+
+var (
+	playTokens    = map[string]playToken{}
+	playTokensMtx sync.Mutex
+)
+
+// newPlayToken creates a play token for a viewer, replacing the one they had
+func newPlayToken(name, host string) string {
+	playTokensMtx.Lock()
+	defer playTokensMtx.Unlock()
+
+	now := time.Now()
+	for token, pt := range playTokens {
+		if pt.name == name || now.After(pt.expires) {
+			delete(playTokens, token)
+		}
+	}
+
+	token := randStringRunes(32)
+	playTokens[token] = playToken{name: name, host: host, expires: now.Add(playTokenLifetime)}
+	return token
+}
+
+// revokePlayTokens removes the play tokens of the named viewers
+func revokePlayTokens(names ...string) {
+	playTokensMtx.Lock()
+	defer playTokensMtx.Unlock()
+
+	for token, pt := range playTokens {
+		for _, name := range names {
+			if pt.name == name {
+				delete(playTokens, token)
+			}
+		}
+	}
+}
+
+// checkPlayToken returns the viewer a play token was given to
+func checkPlayToken(token string) (playToken, bool) {
+	playTokensMtx.Lock()
+	defer playTokensMtx.Unlock()
+
+	pt, ok := playTokens[token]
+	if !ok {
+		return pt, false
+	}
+	if time.Now().After(pt.expires) {
+		delete(playTokens, token)
+		return pt, false
+	}
+	return pt, true
+}
+
+// rtmpPlayRequest splits the URL of an RTMP play into the stream name and
+// its query.  Players put the query after the stream name
+// (rtmp://host/live?token=x) or after the app (rtmp://host/app?token=x/live).
+func rtmpPlayRequest(u *url.URL) (string, url.Values) {
+	query := u.Query()
+	for key, values := range query {
+		for i, value := range values {
+			value, _, _ = strings.Cut(value, "/")
+			query[key][i] = value
+		}
+	}
+	return strings.Trim(u.Path, "/"), query
+}
+
+// authorizePlay decides if an RTMP client at host can watch.  Viewers need a
+// play token from /playtoken, or the room PIN if the room has one.
+func authorizePlay(host string, query url.Values) error {
+	if settings.DisableRTMPPlay {
+		return errRTMPPlayDisabled
+	}
+
+	if banned, names := settings.IsBanned(host); banned {
+		return fmt.Errorf("%s is banned (%s)", host, strings.Join(names, ", "))
+	}
+
+	if token := query.Get("token"); token != "" {
+		pt, ok := checkPlayToken(token)
+		if !ok {
+			return errPlayDenied
+		}
+		if banned, _ := settings.IsBanned(pt.host); banned {
+			return fmt.Errorf("the play token of %s is from a banned address", pt.name)
+		}
+		return nil
+	}
+
+	if pin := query.Get("pin"); pin != "" && settings.RoomAccess == AccessPin && pin == settings.RoomAccessPin {
+		return nil
+	}
+	return errPlayDenied
+}
+
+// rtmpHost returns the address of an RTMP client without the port
+func rtmpHost(conn *rtmp.Conn) string {
+	addr := conn.NetConn().RemoteAddr().String()
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+	return host
+}
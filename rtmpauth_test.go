@@ -0,0 +1,58 @@
+package main
+
+import (
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRTMPPlayRequest(t *testing.T) {
+	for _, raw := range []string{"/live?token=abc", "/live/?token=abc"} {
+		u, err := url.ParseRequestURI(raw)
+		require.NoError(t, err)
+		name, query := rtmpPlayRequest(u)
+		assert.Equal(t, "live", name, raw)
+		assert.Equal(t, "abc", query.Get("token"), raw)
+	}
+
+	// The query was put on the app, so the stream name ended up in it
+	u, err := url.ParseRequestURI("/app?pin=1234/live")
+	require.NoError(t, err)
+	_, query := rtmpPlayRequest(u)
+	assert.Equal(t, "1234", query.Get("pin"))
+}
+
+func TestAuthorizePlay(t *testing.T) {
+	settings = &Settings{TitleLength: 50, RoomAccess: AccessOpen}
+
+	assert.ErrorIs(t, authorizePlay("10.0.0.1", url.Values{}), errPlayDenied, "open rooms still need a token")
+	assert.ErrorIs(t, authorizePlay("10.0.0.1", url.Values{"token": {"made-up"}}), errPlayDenied)
+
+	token := newPlayToken("viewer", "10.0.0.2")
+	assert.NoError(t, authorizePlay("10.0.0.1", url.Values{"token": {token}}))
+
+	again := newPlayToken("viewer", "10.0.0.2")
+	assert.Error(t, authorizePlay("10.0.0.1", url.Values{"token": {token}}), "a new token replaces the old one")
+	assert.NoError(t, authorizePlay("10.0.0.1", url.Values{"token": {again}}))
+
+	// The PIN only works when the room has one
+	assert.ErrorIs(t, authorizePlay("10.0.0.1", url.Values{"pin": {""}}), errPlayDenied)
+	settings.RoomAccess = AccessPin
+	settings.RoomAccessPin = "1234"
+	assert.NoError(t, authorizePlay("10.0.0.1", url.Values{"pin": {"1234"}}))
+	assert.ErrorIs(t, authorizePlay("10.0.0.1", url.Values{"pin": {"4321"}}), errPlayDenied)
+
+	// Bans apply to the player and to the viewer the token was given to
+	settings.Bans = []BanInfo{{IP: "10.0.0.2", Names: []string{"viewer"}}}
+	assert.Error(t, authorizePlay("10.0.0.2", url.Values{"pin": {"1234"}}))
+	assert.Error(t, authorizePlay("10.0.0.1", url.Values{"token": {again}}))
+
+	revokePlayTokens("viewer")
+	_, ok := checkPlayToken(again)
+	assert.False(t, ok)
+
+	settings.DisableRTMPPlay = true
+	assert.ErrorIs(t, authorizePlay("10.0.0.1", url.Values{"pin": {"1234"}}), errRTMPPlayDisabled)
+}
@@ -3,6 +3,7 @@ package main
 import (
 	"crypto/md5"
 	"crypto/rand"
+	"crypto/subtle"
 	_ "embed"
 	"encoding/hex"
 	"encoding/json"
@@ -10,12 +11,14 @@ import (
 	"fmt"
 	"math/big"
 	"os"
+	"path/filepath"
 	"strings"
 	"sync"
 	"time"
 
 	"github.com/gorilla/sessions"
 	"github.com/zorchenhimer/MovieNight/common"
+	"github.com/zorchenhimer/MovieNight/files"
 )
 
 var settings *Settings
@@ -45,10 +48,11 @@ type Settings struct {
 	RtmpListenAddress string // host:port that the RTMP server listens on
 	SessionKey        string // key for session data
 	StreamKey         string
+	StreamKeys        []StreamKeyInfo // named keys handed out to individual streamers
 	StreamStats       bool
-	TitleLength       int  // maximum length of the title that can be set with the /playing
-	WrappedEmotesOnly bool // only allow "wrapped" emotes.  eg :Kappa: and [Kappa] but not Kappa
-	UABotPatterns	  []string // list of suspicious patterns in UserAgent that might indicate bots or scrapers
+	TitleLength       int      // maximum length of the title that can be set with the /playing
+	WrappedEmotesOnly bool     // only allow "wrapped" emotes.  eg :Kappa: and [Kappa] but not Kappa
+	UABotPatterns     []string // list of suspicious patterns in UserAgent that might indicate bots or scrapers
 
 	// Rate limiting stuff, in seconds
 	RateLimitChat      time.Duration
@@ -60,6 +64,52 @@ type Settings struct {
 	// Send the NoCache header?
 	NoCache bool
 
+	// Recording stuff
+	AutoRecord         bool          // start recording as soon as a stream is published
+	RecordingsDir      string        // directory recordings are written to; defaults to "recordings" next to the executable
+	RecordingFormat    string        // container of the recordings, either "flv" or "ts"
+	RecordingMaxLength time.Duration // in minutes; start a new file after this long.  0 disables
+	RecordingMaxSize   int64         // in megabytes; start a new file after this size.  0 disables
+	RecordingRetention int           // number of files to keep per stream.  0 keeps everything
+
+	// Media library stuff
+	LibraryDir    string // directory of flv and mp4 files that can be played with /queue
+	LibraryStream string // name of the stream library files are played on; defaults to "live"
+
+	// Reconnect stuff
+	ReconnectGracePeriod time.Duration // in seconds; how long a stream is kept alive after the publisher drops.  0 disables
+	FallbackFile         string        // flv or mp4 file that is looped while waiting for the publisher
+
+	// Relay stuff
+	RelayTargets []RelayTarget // external RTMP servers streams are pushed to
+
+	// Clip stuff
+	ClipsDir         string        // directory clips are saved to; defaults to "clips" next to the executable
+	ClipBufferLength time.Duration // in seconds; how much of the stream is kept for /clip.  0 only keeps the HLS playlist
+
+	// DVR stuff
+	DVRWindow time.Duration // in minutes; how far back viewers can rewind the live stream.  0 disables
+	DVRDir    string        // directory older DVR segments are written to; defaults to the temp directory
+
+	// VOD stuff
+	KeepVODs bool   // keep finished streams and their chat to be watched again
+	VODDir   string // directory VODs are kept in; defaults to "vods" next to the executable
+
+	// RTMP playback stuff
+	DisableRTMPPlay bool // refuse every RTMP play request
+
+	// Backstage stuff
+	BackstagePreview bool // new streams are only shown to mods and admins until /golive
+
+	// Publish webhook stuff
+	OnPublishURL     string        // asked to allow or deny every publish
+	OnPublishDoneURL string        // told when a published stream ends
+	WebhookTimeout   time.Duration // in seconds; defaults to 5
+	WebhookFailOpen  bool          // check only the stream keys when OnPublishURL can't be reached instead of denying streams
+
+	// HLS stuff
+	HLSSegmentFormat string // container of the HLS segments, either "ts" or "fmp4".  Only ts carries timed metadata
+
 	lock sync.RWMutex
 }
 
@@ -77,6 +127,29 @@ type BanInfo struct {
 	When  time.Time
 }
 
+// StreamKeyInfo is a stream key that belongs to a single streamer
+type StreamKeyInfo struct {
+	Name    string
+	Key     string
+	Owner   string
+	Channel string    // the only channel the key can publish to, any channel if empty
+	Expires time.Time // the key stops working after this, never if zero
+	Created time.Time
+}
+
+// allows checks if the key can publish to streamPath at the given time.
+// Renditions of the allowed channel are allowed too.
+func (k StreamKeyInfo) allows(streamPath string, now time.Time) error {
+	if !k.Expires.IsZero() && now.After(k.Expires) {
+		return fmt.Errorf("stream key %s expired at %s", k.Name, k.Expires.Format(time.RFC1123))
+	}
+
+	if group, _ := splitRenditionName(streamPath); k.Channel != "" && k.Channel != streamPath && k.Channel != group {
+		return fmt.Errorf("stream key %s can only publish to %s", k.Name, k.Channel)
+	}
+	return nil
+}
+
 //go:embed settings_example.json
 var settingsExampleFS []byte
 
@@ -178,6 +251,75 @@ func LoadSettings(filename string) (*Settings, error) {
 		s.TitleLength = 50
 	}
 
+	if s.ReconnectGracePeriod < 0 {
+		s.ReconnectGracePeriod = 0
+	}
+
+	if s.LibraryStream == "" {
+		s.LibraryStream = "live"
+	}
+
+	s.RecordingFormat = strings.ToLower(s.RecordingFormat)
+	if s.RecordingFormat == "" {
+		s.RecordingFormat = "flv"
+	} else if s.RecordingFormat != "flv" && s.RecordingFormat != "ts" {
+		return nil, fmt.Errorf("value for RecordingFormat must be flv or ts, given %q", s.RecordingFormat)
+	}
+
+	if s.RecordingMaxLength < 0 {
+		s.RecordingMaxLength = 0
+	}
+
+	if s.RecordingMaxSize < 0 {
+		s.RecordingMaxSize = 0
+	}
+
+	if s.RecordingRetention < 0 {
+		s.RecordingRetention = 0
+	}
+
+	if s.ClipBufferLength < 0 {
+		s.ClipBufferLength = 0
+	}
+
+	if s.DVRWindow < 0 {
+		s.DVRWindow = 0
+	}
+
+	for i := range s.RelayTargets {
+		if s.RelayTargets[i].Stream == "" {
+			s.RelayTargets[i].Stream = "live"
+		}
+		if !strings.HasPrefix(s.RelayTargets[i].URL, "rtmp://") {
+			return nil, fmt.Errorf("relay target %d must have an rtmp:// URL", i)
+		}
+	}
+
+	if s.WebhookTimeout <= 0 {
+		s.WebhookTimeout = 5
+	}
+
+	for _, hook := range []string{s.OnPublishURL, s.OnPublishDoneURL} {
+		if hook != "" && !strings.HasPrefix(hook, "http://") && !strings.HasPrefix(hook, "https://") {
+			return nil, fmt.Errorf("webhook URLs must start with http:// or https://, given %q", hook)
+		}
+	}
+
+	for i, key := range s.StreamKeys {
+		if key.Name == "" || key.Key == "" {
+			return nil, fmt.Errorf("stream key %d must have a Name and a Key", i)
+		}
+	}
+
+	s.HLSSegmentFormat = strings.ToLower(s.HLSSegmentFormat)
+	if s.HLSSegmentFormat == "" {
+		s.HLSSegmentFormat = HLSFormatTS
+	} else if s.HLSSegmentFormat != HLSFormatTS && s.HLSSegmentFormat != HLSFormatFMP4 {
+		return nil, fmt.Errorf("value for HLSSegmentFormat must be ts or fmp4, given %q", s.HLSSegmentFormat)
+	} else if s.HLSSegmentFormat == HLSFormatFMP4 {
+		common.LogInfoln("fMP4 HLS segments don't carry the /playing title as timed metadata")
+	}
+
 	// Set a random stream key
 	if s.NewStreamKey {
 		s.rndStreamKey = randStringRunes(20)
@@ -320,6 +462,180 @@ func (s *Settings) GetStreamKey() string {
 	return s.StreamKey
 }
 
+// CheckStreamKey returns the owner of the key if it can publish to
+// streamPath.  The main stream key belongs to the "host".
+func (s *Settings) CheckStreamKey(key, streamPath string) (string, error) {
+	mainKey := s.GetStreamKey()
+
+	defer s.lock.RUnlock()
+	s.lock.RLock()
+
+	if key == "" {
+		return "", fmt.Errorf("missing stream key")
+	}
+
+	if subtle.ConstantTimeCompare([]byte(key), []byte(mainKey)) == 1 {
+		return "host", nil
+	}
+
+	for _, k := range s.StreamKeys {
+		if subtle.ConstantTimeCompare([]byte(key), []byte(k.Key)) == 1 {
+			if err := k.allows(streamPath, time.Now()); err != nil {
+				return "", err
+			}
+			return k.Owner, nil
+		}
+	}
+	return "", fmt.Errorf("stream key is incorrect")
+}
+
+// AddStreamKey creates a new named stream key and saves it
+func (s *Settings) AddStreamKey(name, owner, channel string, expires time.Time) (StreamKeyInfo, error) {
+	defer s.lock.Unlock()
+	s.lock.Lock()
+
+	for _, k := range s.StreamKeys {
+		if strings.EqualFold(k.Name, name) {
+			return StreamKeyInfo{}, fmt.Errorf("a stream key named %s already exists", k.Name)
+		}
+	}
+
+	key := StreamKeyInfo{
+		Name:    name,
+		Key:     randStringRunes(20),
+		Owner:   owner,
+		Channel: channel,
+		Expires: expires,
+		Created: time.Now(),
+	}
+	s.StreamKeys = append(s.StreamKeys, key)
+	common.LogInfof("[streamkey] Created key %s for %s\n", name, owner)
+
+	return key, s.unlockedSave()
+}
+
+// RevokeStreamKey deletes a named stream key and saves the settings
+func (s *Settings) RevokeStreamKey(name string) error {
+	defer s.lock.Unlock()
+	s.lock.Lock()
+
+	for i, k := range s.StreamKeys {
+		if strings.EqualFold(k.Name, name) {
+			s.StreamKeys = append(s.StreamKeys[:i], s.StreamKeys[i+1:]...)
+			common.LogInfof("[streamkey] Revoked key %s of %s\n", k.Name, k.Owner)
+			return s.unlockedSave()
+		}
+	}
+	return fmt.Errorf("there is no stream key named %s", name)
+}
+
+// IsConfiguredChannel checks if a channel has a stream key or the media
+// library set up for it, so it may go live
+func (s *Settings) IsConfiguredChannel(name string) bool {
+	defer s.lock.RUnlock()
+	s.lock.RLock()
+
+	if name == s.LibraryStream {
+		return true
+	}
+	for _, k := range s.StreamKeys {
+		if k.Channel == name {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *Settings) GetStreamKeys() []StreamKeyInfo {
+	defer s.lock.RUnlock()
+	s.lock.RLock()
+
+	keys := make([]StreamKeyInfo, len(s.StreamKeys))
+	copy(keys, s.StreamKeys)
+	return keys
+}
+
+func (s *Settings) GetRecorderConfig() RecorderConfig {
+	defer s.lock.RUnlock()
+	s.lock.RLock()
+
+	dir := s.RecordingsDir
+	if dir == "" {
+		dir = files.JoinRunPath("recordings")
+	}
+
+	return RecorderConfig{
+		Dir:         dir,
+		Format:      s.RecordingFormat,
+		MaxDuration: time.Minute * s.RecordingMaxLength,
+		MaxSize:     s.RecordingMaxSize * 1024 * 1024,
+		Retention:   s.RecordingRetention,
+	}
+}
+
+func (s *Settings) GetRelayTargets() []RelayTarget {
+	defer s.lock.RUnlock()
+	s.lock.RLock()
+
+	targets := make([]RelayTarget, len(s.RelayTargets))
+	copy(targets, s.RelayTargets)
+	return targets
+}
+
+func (s *Settings) GetWebhookConfig() WebhookConfig {
+	defer s.lock.RUnlock()
+	s.lock.RLock()
+
+	timeout := s.WebhookTimeout * time.Second
+	if timeout <= 0 {
+		timeout = 5 * time.Second
+	}
+
+	return WebhookConfig{
+		OnPublish:     s.OnPublishURL,
+		OnPublishDone: s.OnPublishDoneURL,
+		Timeout:       timeout,
+		FailOpen:      s.WebhookFailOpen,
+	}
+}
+
+func (s *Settings) GetHLSConfig() HLSConfig {
+	defer s.lock.RUnlock()
+	s.lock.RLock()
+
+	config := DefaultHLSConfig()
+	if s.HLSSegmentFormat != "" {
+		config.SegmentFormat = s.HLSSegmentFormat
+	}
+	config.ClipBuffer = time.Second * s.ClipBufferLength
+	config.DVRWindow = time.Minute * s.DVRWindow
+	config.DVRDir = s.DVRDir
+	if config.DVRDir == "" {
+		config.DVRDir = filepath.Join(os.TempDir(), "movienight-dvr")
+	}
+	return config
+}
+
+func (s *Settings) GetClipsDir() string {
+	defer s.lock.RUnlock()
+	s.lock.RLock()
+
+	if s.ClipsDir == "" {
+		return files.JoinRunPath("clips")
+	}
+	return s.ClipsDir
+}
+
+func (s *Settings) GetVODDir() string {
+	defer s.lock.RUnlock()
+	s.lock.RLock()
+
+	if s.VODDir == "" {
+		return files.JoinRunPath("vods")
+	}
+	return s.VODDir
+}
+
 func (s *Settings) generateNewPin() (string, error) {
 	defer s.lock.Unlock()
 	s.lock.Lock()
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/zorchenhimer/MovieNight/common"
+)
+
+// signedURLLifetime is how long a URL from /streamurl can be used
+const signedURLLifetime = 6 * time.Hour
+
+var (
+	errStreamTokenInvalid = errors.New("invalid stream token")
+	errStreamTokenExpired = errors.New("stream token expired")
+)
+
+// streamTokenKey is the HMAC key of the stream tokens.  The room PIN is part of
+// it so changing the PIN also cancels every signed URL.
+func streamTokenKey() []byte {
+	return []byte(settings.SessionKey + "\x00" + settings.RoomAccessPin)
+}
+
+func streamTokenSignature(stream, viewer string, expires int64) string {
+	mac := hmac.New(sha256.New, streamTokenKey())
+	fmt.Fprintf(mac, "%s\n%s\n%d", stream, viewer, expires)
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// newStreamToken signs access to a channel group for the viewer ID of a
+// session.  The token looks like <expires>.<viewer>.<signature>.
+func newStreamToken(stream, viewer string, expires time.Time) string {
+	unix := expires.Unix()
+	return fmt.Sprintf("%d.%s.%s", unix, viewer, streamTokenSignature(stream, viewer, unix))
+}
+
+// verifyStreamToken checks a token against the stream that is requested and
+// returns the viewer ID it was issued to.  Tokens for a channel group work for
+// all of its renditions.
+func verifyStreamToken(token, stream string, now time.Time) (string, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 || parts[1] == "" {
+		return "", errStreamTokenInvalid
+	}
+
+	expires, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return "", errStreamTokenInvalid
+	}
+
+	group, _ := splitRenditionName(stream)
+	valid := false
+	for _, name := range []string{stream, group} {
+		if hmac.Equal([]byte(parts[2]), []byte(streamTokenSignature(name, parts[1], expires))) {
+			valid = true
+		}
+	}
+	if !valid {
+		return "", errStreamTokenInvalid
+	}
+
+	if now.Unix() > expires {
+		return "", errStreamTokenExpired
+	}
+	return parts[1], nil
+}
+
+// requestStreamName returns the stream a /live, /hls or /dash request is for
+func requestStreamName(path string) string {
+	parts := strings.Split(strings.Trim(path, "/"), "/")
+	switch {
+	case parts[0] == "live" && len(parts) == 2 && strings.Contains(parts[1], "."):
+		// /live/segment_N.ts of the default stream
+		return defaultStream
+	case parts[0] == "live" && len(parts) > 1:
+		return parts[1]
+	case parts[0] == "live":
+		return defaultStream
+	case (parts[0] == "hls" || parts[0] == "dash") && len(parts) > 1:
+		return parts[1]
+	}
+	return ""
+}
+
+// requestStreamToken returns the viewer ID of a valid stream token in the
+// request's query
+func requestStreamToken(r *http.Request) (string, bool) {
+	token := r.URL.Query().Get("token")
+	stream := requestStreamName(r.URL.Path)
+	if token == "" || stream == "" {
+		return "", false
+	}
+
+	viewer, err := verifyStreamToken(token, stream, time.Now())
+	if err != nil {
+		common.LogDebugf("Stream token for %s from %s: %v\n", stream, r.RemoteAddr, err)
+		return "", false
+	}
+	return viewer, true
+}
+
+// wrapStreamAuth is wrapAuth for the stream itself.  External players that
+// don't have the session cookie can use a signed URL instead.
+func wrapStreamAuth(next http.HandlerFunc) http.HandlerFunc {
+	auth := wrapAuth(next)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if settings.RoomAccess != AccessOpen {
+			if _, ok := requestStreamToken(r); ok {
+				next.ServeHTTP(w, r)
+				return
+			}
+		}
+		auth.ServeHTTP(w, r)
+	})
+}
+
+// withStreamToken adds the stream token of the request to a URI that is sent
+// back to the player
+func withStreamToken(r *http.Request, uri string) string {
+	token := r.URL.Query().Get("token")
+	if token == "" {
+		return uri
+	}
+
+	sep := "?"
+	if strings.Contains(uri, "?") {
+		sep = "&"
+	}
+	return uri + sep + "token=" + token
+}
+
+var playlistURIAttr = regexp.MustCompile(`URI="([^"]*)"`)
+
+// signPlaylist carries the stream token of the request down to the URIs of a
+// playlist, so players that got in with a signed URL can load the segments
+func signPlaylist(r *http.Request, playlist string) string {
+	if r.URL.Query().Get("token") == "" {
+		return playlist
+	}
+
+	lines := strings.Split(playlist, "\n")
+	for i, line := range lines {
+		switch {
+		case line == "":
+		case strings.HasPrefix(line, "#"):
+			lines[i] = playlistURIAttr.ReplaceAllStringFunc(line, func(attr string) string {
+				uri := playlistURIAttr.FindStringSubmatch(attr)[1]
+				return `URI="` + withStreamToken(r, uri) + `"`
+			})
+		default:
+			lines[i] = withStreamToken(r, line)
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+// streamURL returns the signed URL a viewer can open in an external player
+func streamURL(stream, viewer string, now time.Time) string {
+	path := "/live"
+	if stream != defaultStream {
+		path += "/" + stream
+	}
+	base := strings.TrimRight(settings.AccessLink, "/")
+	return fmt.Sprintf("%s%s?format=hls&token=%s", base, path, newStreamToken(stream, viewer, now.Add(signedURLLifetime)))
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/gorilla/sessions"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/zorchenhimer/MovieNight/common"
+)
+
+func TestStreamToken(t *testing.T) {
+	settings = &Settings{TitleLength: 50, SessionKey: "signed-url-test-key", RoomAccess: AccessPin, RoomAccessPin: "1234"}
+	now := time.Now()
+
+	token := newStreamToken("movies", "viewer1", now.Add(time.Hour))
+	viewer, err := verifyStreamToken(token, "movies", now)
+	require.NoError(t, err)
+	assert.Equal(t, "viewer1", viewer)
+
+	_, err = verifyStreamToken(token, "movies_720p", now)
+	assert.NoError(t, err, "tokens for a group work for its renditions")
+
+	_, err = verifyStreamToken(token, "live", now)
+	assert.ErrorIs(t, err, errStreamTokenInvalid, "tokens are for one channel")
+
+	_, err = verifyStreamToken(token, "movies", now.Add(2*time.Hour))
+	assert.ErrorIs(t, err, errStreamTokenExpired)
+
+	_, err = verifyStreamToken("1.viewer2"+token[len("1.viewer1"):], "movies", now)
+	assert.ErrorIs(t, err, errStreamTokenInvalid)
+
+	settings.RoomAccessPin = "4321"
+	_, err = verifyStreamToken(token, "movies", now)
+	assert.ErrorIs(t, err, errStreamTokenInvalid, "a new PIN cancels the old URLs")
+}
+
+func TestRequestStreamName(t *testing.T) {
+	for path, name := range map[string]string{
+		"/live":                           "live",
+		"/live/segment_1.ts":              "live",
+		"/live/movies":                    "movies",
+		"/live/movies/segment_1.ts":       "movies",
+		"/hls/movies_720p/playlist.m3u8":  "movies_720p",
+		"/hls/movies/audio/playlist.m3u8": "movies",
+		"/dash/movies/manifest.mpd":       "movies",
+		"/chat":                           "",
+	} {
+		assert.Equal(t, name, requestStreamName(path), path)
+	}
+}
+
+func TestSignPlaylist(t *testing.T) {
+	playlist := "#EXTM3U\n#EXT-X-MAP:URI=\"/hls/live/init.mp4\"\n#EXTINF:2.000,\n/hls/live/segment_1.m4s\n" +
+		"#EXT-X-PRELOAD-HINT:TYPE=PART,URI=\"/hls/live/segment_2.part0.m4s\"\n"
+
+	r := httptest.NewRequest(http.MethodGet, "/hls/live/playlist.m3u8", nil)
+	assert.Equal(t, playlist, signPlaylist(r, playlist), "nothing changes without a token")
+
+	r = httptest.NewRequest(http.MethodGet, "/hls/live/playlist.m3u8?token=abc", nil)
+	assert.Equal(t, "#EXTM3U\n#EXT-X-MAP:URI=\"/hls/live/init.mp4?token=abc\"\n#EXTINF:2.000,\n/hls/live/segment_1.m4s?token=abc\n"+
+		"#EXT-X-PRELOAD-HINT:TYPE=PART,URI=\"/hls/live/segment_2.part0.m4s?token=abc\"\n", signPlaylist(r, playlist))
+}
+
+func TestWrapStreamAuth(t *testing.T) {
+	common.SetupLogging(common.LLError, "/dev/null")
+	settings = &Settings{TitleLength: 50, SessionKey: "signed-url-test-key", RoomAccess: AccessPin, RoomAccessPin: "1234", AccessLink: "http://example.com/"}
+	sstore = sessions.NewCookieStore([]byte(settings.SessionKey))
+
+	served := false
+	handler := wrapStreamAuth(func(w http.ResponseWriter, r *http.Request) {
+		served = true
+	})
+
+	handler(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/hls/movies/playlist.m3u8", nil))
+	assert.False(t, served, "the PIN is needed without a token")
+
+	link, err := url.Parse(streamURL("movies", "viewer1", time.Now()))
+	require.NoError(t, err)
+	assert.Equal(t, "/live/movies", link.Path)
+	assert.Equal(t, "example.com", link.Host)
+
+	r := httptest.NewRequest(http.MethodGet, "/hls/movies_720p/segment_1.ts?token="+link.Query().Get("token"), nil)
+	handler(httptest.NewRecorder(), r)
+	assert.True(t, served)
+	assert.Empty(t, requestViewerID(r), "whoever has the URL isn't the session it was made for")
+
+	served = false
+	handler(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/hls/live/segment_1.ts?token="+link.Query().Get("token"), nil))
+	assert.False(t, served)
+}
@@ -82,13 +82,50 @@ function setPlaying(title, link) {
     }
 }
 
+let intermissionTimer = null;
+
+/**
+ * Counts down to the end of an intermission, 0 stops the countdown
+ * @param {number} seconds
+ */
+function setIntermission(seconds) {
+    clearInterval(intermissionTimer);
+    intermissionTimer = null;
+    if (!(seconds > 0)) {
+        $('#intermission').hide();
+        return;
+    }
+
+    let end = Date.now() + seconds * 1000;
+    let update = () => {
+        let left = Math.round((end - Date.now()) / 1000);
+        if (left <= 0) {
+            setIntermission(0);
+            return;
+        }
+        let pad = (n) => String(n).padStart(2, '0');
+        $('#intermission').text(`Intermission, back in ${Math.floor(left / 60)}:${pad(left % 60)}`);
+    };
+    update();
+    $('#intermission').show();
+    intermissionTimer = setInterval(update, 1000);
+}
+
+// True when the chat of a VOD is replayed instead of the live chat
+function isReplay() {
+    return typeof vodID !== 'undefined' && vodID !== '';
+}
+
 function getWsUri() {
     port = window.location.port;
     if (port != '') {
         port = `:${port}`;
     }
     proto = location.protocol == 'https:' ? 'wss://' : 'ws://';
-    return `${proto}${window.location.hostname}${port}/ws`;
+    if (isReplay()) {
+        return `${proto}${window.location.hostname}${port}/vod/${vodID}/chat`;
+    }
+    return `${proto}${window.location.hostname}${port}/ws?channel=${encodeURIComponent(streamName)}`;
 }
 
 /**
@@ -271,7 +308,10 @@ function handleChatCommand(data) {
             break;
         case CommandType.CmdPurgeChat:
             purgeChat();
-            appendMessages(`<span class="notice">Chat has been purged by a moderator.</span>`);
+            // A replay starts over when seeking back
+            if (!isReplay()) {
+                appendMessages(`<span class="notice">Chat has been purged by a moderator.</span>`);
+            }
             break;
         case CommandType.CmdHelp:
             openMenu('/help');
@@ -279,6 +319,9 @@ function handleChatCommand(data) {
         case CommandType.CmdEmotes:
             openMenu('/emotes');
             break;
+        case CommandType.CmdIntermission:
+            setIntermission(data.Arguments ? parseInt(data.Arguments[0]) : 0);
+            break;
     }
 }
 
@@ -633,6 +676,22 @@ function setupWebSocket() {
     }
 }
 
+// The replayed chat follows the position of the player
+function setupReplay() {
+    $('#joinbox').css('display', 'none');
+    $('#chat').css('display', 'grid');
+    $('#msgbox').css('display', 'none');
+    $('#send').css('display', 'none');
+
+    let video = document.querySelector('#videoElement');
+    if (!video) {
+        return;
+    }
+    const sendPosition = () => sendMessage(String(video.currentTime), ClientDataType.CdPosition, false);
+    video.addEventListener('timeupdate', sendPosition);
+    video.addEventListener('seeked', sendPosition);
+}
+
 function setupEvents() {
     $('#name').on({
         keypress: (e) => {
@@ -687,6 +746,10 @@ window.addEventListener('onresize', updateSuggestionCss);
 window.addEventListener('load', () => {
     setNotifyBox();
     setupWebSocket();
+    if (isReplay()) {
+        setupReplay();
+        return;
+    }
     setupEvents();
 
     // Make sure name is focused on start
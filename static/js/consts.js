@@ -9,6 +9,7 @@ const ClientDataType = {
     CdEmote: 5,
     CdJoin: 6,
     CdNotify: 7,
+    CdPosition: 8,
 };
 Object.freeze(ClientDataType);
 
@@ -28,6 +29,7 @@ const CommandType = {
     CmdPurgeChat: 2,
     CmdHelp: 3,
     CmdEmotes: 4,
+    CmdIntermission: 5,
 };
 Object.freeze(CommandType);
 
@@ -59,6 +59,27 @@ function debugError(...args) {
     }
 }
 
+// URL of the stream shown on this page
+function liveURL() {
+    if (typeof streamName === 'undefined' || streamName === 'live') {
+        return '/live';
+    }
+    return `/live/${encodeURIComponent(streamName)}`;
+}
+
+// True when the page replays a VOD instead of the live stream
+function isVOD() {
+    return typeof vodID !== 'undefined' && vodID !== '';
+}
+
+// HLS playlist of the stream or VOD shown on this page
+function hlsURL() {
+    if (isVOD()) {
+        return `/vod/${vodID}/playlist.m3u8`;
+    }
+    return `${liveURL()}?format=hls`;
+}
+
 // Initialize debug mode on page load
 document.addEventListener('DOMContentLoaded', initializeDebugMode);
 
@@ -143,7 +164,8 @@ function initPlayer() {
     debugLog('initPlayer: isMobile():', isMobile());
     debugLog('initPlayer: supportsHLS():', supportsHLS());
     
-    const useHLS = shouldUseHLS();
+    // VODs are only available as HLS
+    const useHLS = isVOD() || shouldUseHLS();
     debugLog('initPlayer: shouldUseHLS():', useHLS);
     
     if (useHLS) {
@@ -157,7 +179,7 @@ function initHLSPlayer() {
     debugLog('Initializing HLS player');
     
     let videoElement = document.querySelector('#videoElement');
-    const hlsSource = '/live?format=hls';
+    const hlsSource = hlsURL();
     
     // Check for native HLS support (iOS Safari)
     if (supportsHLS()) {
@@ -308,6 +330,11 @@ function initHLSWithLibrary(videoElement, hlsSource) {
         startPosition: -1                   // Start from live edge
     };
 
+    // With a DVR window viewers can rewind, so don't pull them back to the live edge
+    if (typeof dvrEnabled !== 'undefined' && dvrEnabled) {
+        hlsConfig.liveMaxLatencyDurationCount = Infinity;
+    }
+
     var hls;
     try {
         // Try with our configuration first
@@ -645,7 +672,7 @@ function initMPEGTSPlayer() {
     let videoElement = document.querySelector('#videoElement');
     let flvPlayer = mpegts.createPlayer({
         type: 'flv',
-        url: '/live'
+        url: liveURL()
     }, {
         isLive: true,
         liveBufferLatencyChasing: true,
@@ -707,7 +734,7 @@ function recoverHLSPlayer() {
     if (!videoElement) return;
     
     // Get current source URL
-    const currentSource = window.hlsPlayer?.url || '/live?format=hls';
+    const currentSource = window.hlsPlayer?.url || hlsURL();
     
     // Cleanup existing player
     cleanup();
@@ -0,0 +1,723 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Eyevinn/hls-m3u8/m3u8"
+	"github.com/zorchenhimer/MovieNight/common"
+)
+
+const (
+	vodDetailsFile  = "vod.json"
+	vodChatFile     = "chat.jsonl"
+	vodChaptersFile = "chapters.vtt"
+)
+
+// VOD is a stream that was kept to be watched again at /vod/<ID>.  Its
+// details are kept next to the segments in vod.json.
+type VOD struct {
+	ID       string
+	Stream   string
+	Title    string
+	Started  time.Time
+	Ended    time.Time // zero while the stream is going
+	Duration float64   // seconds
+	Init     string    // file name of the first fMP4 init segment
+	Segments []VODSegment
+	Chapters []VODChapter
+}
+
+// VODSegment is a single HLS segment of a VOD
+type VODSegment struct {
+	File            string
+	Duration        float64
+	ProgramDateTime time.Time
+	Discontinuity   bool
+	Init            string // file name of the fMP4 init segment
+}
+
+// VODChapter is a chapter that was marked during the stream
+type VODChapter struct {
+	Chapter
+	Time float64 // seconds into the VOD
+}
+
+// ReplayMessage is a chat message sent during a VOD
+type ReplayMessage struct {
+	Time float64 // seconds into the VOD
+	Data common.ChatDataJSON
+}
+
+var vodIDPattern = regexp.MustCompile(`^[0-9]{8}-[0-9]{6}-[0-9a-zA-Z]{6}$`)
+
+// URL is the page the VOD is watched on
+func (v VOD) URL() string {
+	return "/vod/" + v.ID
+}
+
+// vodWriter keeps the segments and the chat of a live stream for a VOD
+type vodWriter struct {
+	dir  string
+	room *ChatRoom // recorded along with the stream, may be nil
+
+	saveMtx     sync.Mutex // keeps the writes of vod.json in order, taken before mutex
+	mutex       sync.Mutex
+	vod         VOD
+	chat        *os.File
+	lastSegment time.Time // when the newest segment was added
+	lastInit    []byte    // init segment written last
+	initFile    string    // file name of lastInit
+	finished    bool
+}
+
+func newVODWriter(parent, stream string, room *ChatRoom) (*vodWriter, error) {
+	now := time.Now()
+	id := fmt.Sprintf("%s-%s", now.Format("20060102-150405"), randStringRunes(6))
+	dir := filepath.Join(parent, id)
+
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return nil, fmt.Errorf("could not create VOD directory: %w", err)
+	}
+
+	chat, err := os.Create(filepath.Join(dir, vodChatFile))
+	if err != nil {
+		return nil, fmt.Errorf("could not create VOD chat: %w", err)
+	}
+
+	v := &vodWriter{
+		dir:         dir,
+		room:        room,
+		vod:         VOD{ID: id, Stream: stream, Started: now},
+		chat:        chat,
+		lastSegment: now,
+	}
+	err = v.save()
+	if err != nil {
+		chat.Close()
+		return nil, err
+	}
+	return v, nil
+}
+
+// addSegment writes a finished HLS segment to the VOD.  init is the fMP4 init
+// segment, nil for TS.  The caller must not hold the mutex of the HLSChannel,
+// the viewers would wait for the disk.
+func (v *vodWriter) addSegment(init []byte, segment HLSSegment) {
+	if !v.writeSegment(init, segment) {
+		return
+	}
+
+	// A VOD whose server went down is finished from what was saved so far
+	err := v.save()
+	if err != nil {
+		common.LogErrorf("[VOD] %v\n", err)
+	}
+}
+
+// writeSegment writes the segment and adds it to the details.  It returns
+// false if it wasn't added.
+func (v *vodWriter) writeSegment(init []byte, segment HLSSegment) bool {
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+
+	if v.finished {
+		return false
+	}
+
+	// The init segment changes along with the codecs
+	if init != nil && !bytes.Equal(init, v.lastInit) {
+		name := fmt.Sprintf("init_%d.mp4", len(v.vod.Segments))
+		err := os.WriteFile(filepath.Join(v.dir, name), init, 0644)
+		if err != nil {
+			common.LogErrorf("[VOD] Could not write init segment of %s: %v\n", v.vod.ID, err)
+			return false
+		}
+		v.lastInit, v.initFile = init, name
+		if v.vod.Init == "" {
+			v.vod.Init = name
+		}
+	}
+
+	file := fmt.Sprintf("segment_%05d%s", len(v.vod.Segments), path.Ext(segment.URI))
+	err := os.WriteFile(filepath.Join(v.dir, file), segment.Data, 0644)
+	if err != nil {
+		common.LogErrorf("[VOD] Could not write segment of %s: %v\n", v.vod.ID, err)
+		return false
+	}
+
+	vodSegment := VODSegment{
+		File:            file,
+		Duration:        segment.Duration,
+		ProgramDateTime: segment.ProgramDateTime,
+		Discontinuity:   segment.Discontinuity,
+		Init:            v.initFile,
+	}
+	v.vod.Segments = append(v.vod.Segments, vodSegment)
+	v.vod.Duration += segment.Duration
+	v.lastSegment = time.Now()
+	return true
+}
+
+// mediaTime is how far into the VOD the live stream was at t.  Caller must
+// hold the mutex.
+func (v *vodWriter) mediaTime(t time.Time) float64 {
+	return v.vod.Duration + t.Sub(v.lastSegment).Seconds()
+}
+
+// addChapter marks a chapter at the current position of the VOD
+func (v *vodWriter) addChapter(chapter Chapter) {
+	if v == nil {
+		return
+	}
+
+	v.mutex.Lock()
+	if v.finished {
+		v.mutex.Unlock()
+		return
+	}
+	v.vod.Chapters = append(v.vod.Chapters, VODChapter{Chapter: chapter, Time: v.mediaTime(chapter.Start)})
+	v.mutex.Unlock()
+
+	err := v.save()
+	if err != nil {
+		common.LogErrorf("[VOD] %v\n", err)
+	}
+}
+
+// replayable checks if a chat message is kept for the replay.  Commands
+// other than the title changes only make sense live.
+func replayable(data common.ChatData) bool {
+	switch data.Type {
+	case common.DTChat, common.DTEvent:
+		return true
+	case common.DTCommand:
+		cmd, ok := data.Data.(common.DataCommand)
+		return ok && cmd.Command == common.CmdPlaying
+	}
+	return false
+}
+
+// addChat records a message sent to the room during the stream
+func (v *vodWriter) addChat(data common.ChatData) {
+	if !replayable(data) {
+		return
+	}
+
+	msg, err := data.ToJSON()
+	if err != nil {
+		common.LogErrorf("[VOD] Could not encode chat message: %v\n", err)
+		return
+	}
+
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+
+	if v.finished {
+		return
+	}
+
+	line, err := json.Marshal(ReplayMessage{Time: v.mediaTime(time.Now()), Data: msg})
+	if err != nil {
+		common.LogErrorf("[VOD] Could not encode chat message: %v\n", err)
+		return
+	}
+	_, err = v.chat.Write(append(line, '\n'))
+	if err != nil {
+		common.LogErrorf("[VOD] Could not write chat of %s: %v\n", v.vod.ID, err)
+	}
+}
+
+// finish closes the VOD.  A stream that didn't get to a single segment isn't
+// kept.
+func (v *vodWriter) finish() (VOD, bool) {
+	v.saveMtx.Lock()
+	defer v.saveMtx.Unlock()
+
+	v.mutex.Lock()
+	if v.finished {
+		v.mutex.Unlock()
+		return v.vod, false
+	}
+	v.finished = true
+
+	err := v.chat.Close()
+	if err != nil {
+		common.LogErrorf("[VOD] Could not close chat of %s: %v\n", v.vod.ID, err)
+	}
+
+	v.vod.Ended = time.Now()
+	if v.room != nil {
+		v.vod.Title, _ = v.room.Playing()
+	}
+	vod := v.vod
+	v.mutex.Unlock()
+
+	if len(vod.Segments) == 0 {
+		err = os.RemoveAll(v.dir)
+		if err != nil {
+			common.LogErrorf("[VOD] Could not remove %s: %v\n", v.dir, err)
+		}
+		return vod, false
+	}
+
+	err = saveVOD(v.dir, vod)
+	if err != nil {
+		common.LogErrorf("[VOD] %v\n", err)
+		return vod, false
+	}
+	return vod, true
+}
+
+// save writes the details of the VOD as they are now.  The caller must not
+// hold the mutex.
+func (v *vodWriter) save() error {
+	v.saveMtx.Lock()
+	defer v.saveMtx.Unlock()
+
+	v.mutex.Lock()
+	vod := v.vod
+	vod.Segments = append([]VODSegment(nil), v.vod.Segments...)
+	vod.Chapters = append([]VODChapter(nil), v.vod.Chapters...)
+	v.mutex.Unlock()
+
+	return saveVOD(v.dir, vod)
+}
+
+// saveVOD writes the details of a VOD to its directory, along with its
+// chapters once it ended.  vod.json is replaced in one go, so a crash doesn't
+// leave half of it behind.
+func saveVOD(dir string, vod VOD) error {
+	if !vod.Ended.IsZero() && len(vod.Chapters) > 0 {
+		marks := []chapterMark{}
+		for _, chapter := range vod.Chapters {
+			marks = append(marks, chapterMark{At: time.Duration(chapter.Time * float64(time.Second)), Title: chapter.Title})
+		}
+		err := saveChaptersVTT(filepath.Join(dir, vodChaptersFile), marks, time.Duration(vod.Duration*float64(time.Second)))
+		if err != nil {
+			common.LogErrorf("[VOD] Could not save the chapters of %s: %v\n", vod.ID, err)
+		}
+	}
+
+	details, err := json.MarshalIndent(vod, "", "\t")
+	if err != nil {
+		return fmt.Errorf("could not encode VOD details: %w", err)
+	}
+
+	file := filepath.Join(dir, vodDetailsFile)
+	err = os.WriteFile(file+".tmp", details, 0644)
+	if err == nil {
+		err = os.Rename(file+".tmp", file)
+	}
+	if err != nil {
+		return fmt.Errorf("could not write VOD details: %w", err)
+	}
+	return nil
+}
+
+// finishCrashedVODs finishes the VODs a server that went down was still
+// writing, from the details that were saved along the way
+func finishCrashedVODs(dir string) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			common.LogErrorf("[VOD] Could not read VOD directory: %v\n", err)
+		}
+		return
+	}
+
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		vod, err := loadVOD(dir, entry.Name())
+		if err != nil || !vod.Ended.IsZero() {
+			continue
+		}
+
+		if len(vod.Segments) == 0 {
+			err = os.RemoveAll(filepath.Join(dir, vod.ID))
+			if err != nil {
+				common.LogErrorf("[VOD] Could not remove %s: %v\n", vod.ID, err)
+			}
+			continue
+		}
+
+		// The stream ended with the last segment that was saved
+		last := vod.Segments[len(vod.Segments)-1]
+		vod.Ended = vod.Started.Add(time.Duration(vod.Duration * float64(time.Second)))
+		if !last.ProgramDateTime.IsZero() {
+			vod.Ended = last.ProgramDateTime.Add(time.Duration(last.Duration * float64(time.Second)))
+		}
+
+		err = saveVOD(filepath.Join(dir, vod.ID), vod)
+		if err != nil {
+			common.LogErrorf("[VOD] %v\n", err)
+			continue
+		}
+		common.LogInfof("[VOD] Finished %s that was cut off, %.0fs of %s\n", vod.ID, vod.Duration, vod.Stream)
+	}
+}
+
+// startVOD starts keeping the stream for a VOD.  The chat of the channel's
+// group is kept along with it.  The caller is expected to hold the channel
+// lock.
+func (ch *Channel) startVOD(streamPath string) {
+	if !settings.KeepVODs || ch.vod != nil || ch.hlsChan == nil {
+		return
+	}
+
+	room, err := chatRoomFor(groupName(streamPath))
+	if err != nil {
+		common.LogErrorf("[VOD] %v\n", err)
+	}
+
+	writer, err := newVODWriter(settings.GetVODDir(), streamPath, room)
+	if err != nil {
+		common.LogErrorf("[VOD] Could not start VOD of %s: %v\n", streamPath, err)
+		return
+	}
+
+	ch.vod = writer
+	ch.hlsChan.setVOD(writer)
+	if room != nil {
+		room.addReplay(writer)
+	}
+	common.LogInfof("[VOD] Keeping %s as %s\n", streamPath, writer.vod.ID)
+}
+
+// finishVOD stops keeping the stream and lets the chat know where to watch
+// it again.  The caller is expected to hold the channel lock.
+func (ch *Channel) finishVOD() {
+	if ch.vod == nil {
+		return
+	}
+
+	writer := ch.vod
+	ch.vod = nil
+	ch.hlsChan.setVOD(nil)
+	if writer.room != nil {
+		writer.room.removeReplay(writer)
+	}
+
+	vod, ok := writer.finish()
+	if !ok {
+		return
+	}
+
+	common.LogInfof("[VOD] Finished %s, %.0fs of %s\n", vod.ID, vod.Duration, vod.Stream)
+	if writer.room != nil {
+		writer.room.AddChatMsg(common.NewChatMessage("", ColorServerMessage,
+			fmt.Sprintf(`The stream can be watched again with its chat: <a href="%s" target="_blank">%s</a>`, vod.URL(), vod.URL()),
+			common.CmdlUser, common.MsgServer))
+	}
+}
+
+// addReplay and removeReplay keep track of the VODs the room's messages are
+// recorded to
+func (cr *ChatRoom) addReplay(writer *vodWriter) {
+	cr.replaysMtx.Lock()
+	defer cr.replaysMtx.Unlock()
+	cr.replays = append(cr.replays, writer)
+}
+
+func (cr *ChatRoom) removeReplay(writer *vodWriter) {
+	cr.replaysMtx.Lock()
+	defer cr.replaysMtx.Unlock()
+	for i, w := range cr.replays {
+		if w == writer {
+			cr.replays = append(cr.replays[:i], cr.replays[i+1:]...)
+			return
+		}
+	}
+}
+
+// recordReplays adds a broadcast message to the VODs of the room
+func (cr *ChatRoom) recordReplays(data common.ChatData) {
+	cr.replaysMtx.Lock()
+	defer cr.replaysMtx.Unlock()
+	for _, writer := range cr.replays {
+		writer.addChat(data)
+	}
+}
+
+// loadVOD reads the details of a VOD
+func loadVOD(dir, id string) (VOD, error) {
+	var vod VOD
+	if !vodIDPattern.MatchString(id) {
+		return vod, fmt.Errorf("invalid VOD ID %q", id)
+	}
+
+	data, err := os.ReadFile(filepath.Join(dir, id, vodDetailsFile))
+	if err != nil {
+		return vod, err
+	}
+	err = json.Unmarshal(data, &vod)
+	return vod, err
+}
+
+// listVODs returns the finished VODs, newest first
+func listVODs(dir string) ([]VOD, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return []VOD{}, nil
+		}
+		return nil, fmt.Errorf("could not read VOD directory: %w", err)
+	}
+
+	vods := []VOD{}
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		vod, err := loadVOD(dir, entry.Name())
+		if err != nil || vod.Ended.IsZero() {
+			continue
+		}
+		vod.Segments = nil
+		vods = append(vods, vod)
+	}
+
+	sort.Slice(vods, func(i, j int) bool {
+		return vods[i].Started.After(vods[j].Started)
+	})
+	return vods, nil
+}
+
+// loadReplay reads the chat of a VOD
+func loadReplay(dir, id string) ([]ReplayMessage, error) {
+	f, err := os.Open(filepath.Join(dir, id, vodChatFile))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	messages := []ReplayMessage{}
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, 1024*1024)
+	for scanner.Scan() {
+		var msg ReplayMessage
+		err = json.Unmarshal(scanner.Bytes(), &msg)
+		if err != nil {
+			// Most likely the last line of a crashed server
+			common.LogErrorf("[VOD] Skipping broken chat message of %s: %v\n", id, err)
+			continue
+		}
+		messages = append(messages, msg)
+	}
+
+	sort.SliceStable(messages, func(i, j int) bool {
+		return messages[i].Time < messages[j].Time
+	})
+	return messages, scanner.Err()
+}
+
+// vodPlaylist builds the finished HLS playlist of a VOD
+func vodPlaylist(vod VOD) (string, error) {
+	count := uint(len(vod.Segments))
+	playlist, err := m3u8.NewMediaPlaylist(0, count)
+	if err != nil {
+		return "", err
+	}
+
+	playlist.SetVersion(3)
+	if vod.Init != "" {
+		playlist.SetVersion(7)
+		playlist.SetDefaultMap(vod.Init, 0, 0)
+	}
+	playlist.MediaType = m3u8.VOD
+
+	for _, segment := range vod.Segments {
+		err = appendSegment(playlist, HLSSegment{
+			URI:             segment.File,
+			Duration:        segment.Duration,
+			ProgramDateTime: segment.ProgramDateTime,
+			Discontinuity:   segment.Discontinuity,
+			InitURI:         segment.Init,
+		})
+		if err != nil {
+			return "", err
+		}
+	}
+	for _, chapter := range vod.Chapters {
+		playlist.DateRanges = append(playlist.DateRanges, chapter.dateRange())
+	}
+	playlist.Close()
+	return playlist.String(), nil
+}
+
+// replayRange works out which chat messages a replay at position needs.
+// sent is the number of messages the viewer already has.  Seeking back starts
+// the chat over, and at most limit messages are sent at once.
+func replayRange(messages []ReplayMessage, sent int, position float64, limit int) (purge bool, start, end int) {
+	end = sort.Search(len(messages), func(i int) bool {
+		return messages[i].Time > position
+	})
+
+	if end < sent {
+		purge = true
+		sent = 0
+	}
+
+	start = sent
+	if limit > 0 && end-start > limit {
+		start = end - limit
+	}
+	return purge, start, end
+}
+
+// handleVODChat streams the chat of a VOD over a websocket.  The player
+// reports its position with CdPosition and gets the messages up to it.
+func handleVODChat(w http.ResponseWriter, r *http.Request, vod VOD) {
+	messages, err := loadReplay(settings.GetVODDir(), vod.ID)
+	if err != nil {
+		common.LogErrorf("[VOD] Could not load the chat of %s: %v\n", vod.ID, err)
+		http.NotFound(w, r)
+		return
+	}
+
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		common.LogErrorln("Error upgrading to websocket:", err)
+		return
+	}
+
+	chatConn := &chatConnection{Conn: conn, forwardedFor: common.ExtractForwarded(r)}
+	defer chatConn.Close()
+
+	send := func(data common.ChatDataJSON) bool {
+		err := chatConn.WriteData(data)
+		if err != nil {
+			common.LogDebugf("[VOD] Replay of %s stopped: %v\n", vod.ID, err)
+			return false
+		}
+		return true
+	}
+
+	title, err := common.NewChatCommand(common.CmdPlaying, []string{vod.Title, ""}).ToJSON()
+	if err != nil || !send(title) {
+		return
+	}
+
+	sent := 0
+	for {
+		var data common.ClientData
+		err := chatConn.ReadData(&data)
+		if err != nil {
+			return
+		}
+		if data.Type != common.CdPosition {
+			continue
+		}
+
+		position, err := strconv.ParseFloat(data.Message, 64)
+		if err != nil {
+			continue
+		}
+
+		purge, start, end := replayRange(messages, sent, position, settings.MaxMessageCount)
+		if purge {
+			cmd, err := common.NewChatCommand(common.CmdPurgeChat, nil).ToJSON()
+			if err != nil || !send(cmd) {
+				return
+			}
+		}
+		for _, msg := range messages[start:end] {
+			if !send(msg.Data) {
+				return
+			}
+		}
+		sent = end
+	}
+}
+
+// handleVOD serves the VODs at /vod/<ID> (the player page),
+// /vod/<ID>/playlist.m3u8, its segments, /vod/<ID>/chapters.vtt and
+// /vod/<ID>/chat (the chat replay)
+func handleVOD(w http.ResponseWriter, r *http.Request) {
+	id, file, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/vod/"), "/")
+
+	dir := settings.GetVODDir()
+	vod, err := loadVOD(dir, id)
+	if err != nil || vod.Ended.IsZero() {
+		http.NotFound(w, r)
+		return
+	}
+
+	switch file {
+	case "":
+		renderIndex(w, r, vod.Stream, &vod)
+		return
+	case "playlist.m3u8":
+		playlist, err := vodPlaylist(vod)
+		if err != nil {
+			common.LogErrorf("[VOD] Could not build the playlist of %s: %v\n", vod.ID, err)
+			http.Error(w, "Could not build playlist", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/vnd.apple.mpegurl")
+		_, err = w.Write([]byte(playlist))
+		if err != nil {
+			common.LogErrorf("[VOD] Could not write playlist: %v\n", err)
+		}
+		return
+	case "chat":
+		handleVODChat(w, r, vod)
+		return
+	}
+
+	known := file == vod.Init || (file == vodChaptersFile && len(vod.Chapters) > 0)
+	for _, segment := range vod.Segments {
+		known = known || segment.File == file || segment.Init == file
+	}
+	if !known {
+		http.NotFound(w, r)
+		return
+	}
+
+	f, err := os.Open(filepath.Join(dir, vod.ID, file))
+	if err != nil {
+		common.LogErrorf("[VOD] Could not open %s of %s: %v\n", file, vod.ID, err)
+		http.NotFound(w, r)
+		return
+	}
+	defer f.Close()
+
+	contentType := hlsSegmentContentType(file)
+	if file == vodChaptersFile {
+		contentType = "text/vtt"
+	}
+	w.Header().Set("Content-Type", contentType)
+	http.ServeContent(w, r, file, vod.Ended, f)
+}
+
+// handleVODsAPI lists the finished VODs as JSON
+func handleVODsAPI(w http.ResponseWriter, r *http.Request) {
+	vods, err := listVODs(settings.GetVODDir())
+	if err != nil {
+		common.LogErrorf("[VOD] %v\n", err)
+		http.Error(w, "Could not list VODs", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-cache")
+	err = json.NewEncoder(w).Encode(vods)
+	if err != nil {
+		common.LogErrorf("Could not write VOD list: %v\n", err)
+	}
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/zorchenhimer/MovieNight/common"
+)
+
+func TestVODWriter(t *testing.T) {
+	common.SetupLogging(common.LLError, "/dev/null")
+	dir := t.TempDir()
+	settings = &Settings{TitleLength: 50, KeepVODs: true, VODDir: dir}
+
+	room := newRoom()
+	room.playing = "Double Feature"
+	writer, err := newVODWriter(dir, "live", room)
+	require.NoError(t, err)
+	room.addReplay(writer)
+
+	room.AddChatMsg(common.NewChatMessage("viewer", "#fff", "first", common.CmdlUser, common.MsgChat))
+	room.AddCmdMsg(common.CmdRefreshPlayer, nil)
+	require.Eventually(t, func() bool {
+		data, err := os.ReadFile(filepath.Join(writer.dir, vodChatFile))
+		return err == nil && len(data) > 0
+	}, time.Second, 10*time.Millisecond, "the chat of the room is recorded")
+
+	for i := 0; i < 3; i++ {
+		writer.addSegment(nil, HLSSegment{URI: fmt.Sprintf("/live/segment_%d.ts", i), Duration: 4, Data: []byte{'a' + byte(i)}, Sequence: uint64(i)})
+	}
+	writer.addChat(common.NewChatMessage("viewer", "#fff", "second", common.CmdlUser, common.MsgChat))
+	room.removeReplay(writer)
+
+	_, err = loadVOD(dir, writer.vod.ID)
+	require.NoError(t, err)
+	w := httptest.NewRecorder()
+	handleVOD(w, httptest.NewRequest(http.MethodGet, "/vod/"+writer.vod.ID+"/playlist.m3u8", nil))
+	assert.Equal(t, http.StatusNotFound, w.Code, "VODs can't be watched before the stream is over")
+
+	vod, ok := writer.finish()
+	require.True(t, ok)
+	assert.Equal(t, "Double Feature", vod.Title)
+	assert.Equal(t, 12.0, vod.Duration)
+
+	messages, err := loadReplay(dir, vod.ID)
+	require.NoError(t, err)
+	require.Len(t, messages, 2, "commands other than the title aren't replayed")
+	assert.Less(t, messages[0].Time, 1.0)
+	assert.GreaterOrEqual(t, messages[1].Time, 12.0, "the second message was sent after the segments")
+
+	w = httptest.NewRecorder()
+	handleVOD(w, httptest.NewRequest(http.MethodGet, "/vod/"+vod.ID+"/playlist.m3u8", nil))
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), "#EXT-X-PLAYLIST-TYPE:VOD")
+	assert.Contains(t, w.Body.String(), "#EXT-X-ENDLIST")
+	assert.Contains(t, w.Body.String(), "\nsegment_00002.ts\n")
+
+	w = httptest.NewRecorder()
+	handleVOD(w, httptest.NewRequest(http.MethodGet, "/vod/"+vod.ID+"/segment_00001.ts", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "b", w.Body.String())
+
+	for _, path := range []string{"/vod/" + vod.ID + "/vod.json", "/vod/" + vod.ID + "/../settings.json", "/vod/nope/playlist.m3u8"} {
+		w = httptest.NewRecorder()
+		handleVOD(w, httptest.NewRequest(http.MethodGet, path, nil))
+		assert.Equal(t, http.StatusNotFound, w.Code, path)
+	}
+
+	vods, err := listVODs(dir)
+	require.NoError(t, err)
+	require.Len(t, vods, 1)
+	assert.Equal(t, vod.ID, vods[0].ID)
+
+	// Streams that never got a segment aren't kept
+	empty, err := newVODWriter(dir, "live", nil)
+	require.NoError(t, err)
+	_, ok = empty.finish()
+	assert.False(t, ok)
+	_, err = os.Stat(empty.dir)
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestFinishCrashedVODs(t *testing.T) {
+	common.SetupLogging(common.LLError, "/dev/null")
+	dir := t.TempDir()
+
+	start := time.Now()
+	writer, err := newVODWriter(dir, "live", nil)
+	require.NoError(t, err)
+	for i := 0; i < 3; i++ {
+		writer.addSegment(nil, HLSSegment{URI: fmt.Sprintf("/live/segment_%d.ts", i), Duration: 4, Data: []byte{'a'},
+			ProgramDateTime: start.Add(time.Duration(i) * 4 * time.Second)})
+	}
+	writer.addChapter(Chapter{ID: "chapter-1", Title: "Second Feature", Start: time.Now()})
+
+	empty, err := newVODWriter(dir, "other", nil)
+	require.NoError(t, err)
+
+	// The server goes down without finishing either of them
+	writer.chat.Close()
+	empty.chat.Close()
+	vods, err := listVODs(dir)
+	require.NoError(t, err)
+	assert.Empty(t, vods)
+
+	finishCrashedVODs(dir)
+	vods, err = listVODs(dir)
+	require.NoError(t, err)
+	require.Len(t, vods, 1, "the VOD without segments is dropped")
+	assert.Equal(t, writer.vod.ID, vods[0].ID)
+	assert.Equal(t, 12.0, vods[0].Duration)
+	assert.WithinDuration(t, start.Add(12*time.Second), vods[0].Ended, time.Millisecond)
+
+	vod, err := loadVOD(dir, writer.vod.ID)
+	require.NoError(t, err)
+	assert.Len(t, vod.Segments, 3)
+	assert.Len(t, vod.Chapters, 1)
+	_, err = os.Stat(filepath.Join(dir, vod.ID, vodChaptersFile))
+	assert.NoError(t, err, "the chapters are written once the VOD is finished")
+	_, err = os.Stat(empty.dir)
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestReplayRange(t *testing.T) {
+	messages := []ReplayMessage{{Time: 1}, {Time: 2}, {Time: 3}, {Time: 10}, {Time: 11}}
+
+	purge, start, end := replayRange(messages, 0, 2.5, 0)
+	assert.False(t, purge)
+	assert.Equal(t, 0, start)
+	assert.Equal(t, 2, end)
+
+	purge, start, end = replayRange(messages, 2, 10, 0)
+	assert.False(t, purge)
+	assert.Equal(t, 2, start, "only the new messages are sent")
+	assert.Equal(t, 4, end)
+
+	purge, start, end = replayRange(messages, 4, 2, 0)
+	assert.True(t, purge, "seeking back starts over")
+	assert.Equal(t, 0, start)
+	assert.Equal(t, 2, end)
+
+	purge, start, end = replayRange(messages, 0, 20, 2)
+	assert.False(t, purge)
+	assert.Equal(t, 3, start, "a long jump only sends the last messages")
+	assert.Equal(t, 5, end)
+}
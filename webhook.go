@@ -0,0 +1,171 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/nareix/joy4/av"
+	"github.com/zorchenhimer/MovieNight/common"
+)
+
+const (
+	webhookOnPublish     = "on_publish"
+	webhookOnPublishDone = "on_publish_done"
+)
+
+var errPublishDenied = errors.New("publish was denied by the webhook")
+
+// WebhookConfig holds the publish webhook settings
+type WebhookConfig struct {
+	OnPublish     string        // URL asked before a stream is allowed to start
+	OnPublishDone string        // URL told when a stream ends
+	Timeout       time.Duration // how long to wait for a response
+	FailOpen      bool          // allow the stream when the webhook can't be reached
+}
+
+// PublishEvent is POSTed as JSON to the webhooks
+type PublishEvent struct {
+	Action     string // on_publish or on_publish_done
+	Stream     string
+	Key        string
+	RemoteAddr string
+	Owner      string // owner of the stream key if it is one of ours
+	Streams    []StreamInfo
+	Duration   float64 // seconds the stream was live, only sent with on_publish_done
+}
+
+// StreamInfo describes one of the published streams
+type StreamInfo struct {
+	Type       string
+	Width      int
+	Height     int
+	SampleRate int
+	Channels   int
+}
+
+// PublishResponse is the optional JSON body of the on_publish response
+type PublishResponse struct {
+	Owner string // replaces the owner of the stream
+}
+
+var webhookClient = &http.Client{}
+
+// describeStreams lists the codecs of the published streams
+func describeStreams(streams []av.CodecData) []StreamInfo {
+	info := make([]StreamInfo, 0, len(streams))
+	for _, stream := range streams {
+		si := StreamInfo{Type: stream.Type().String()}
+		switch codec := stream.(type) {
+		case av.VideoCodecData:
+			si.Width, si.Height = codec.Width(), codec.Height()
+		case av.AudioCodecData:
+			si.SampleRate, si.Channels = codec.SampleRate(), codec.ChannelLayout().Count()
+		}
+		info = append(info, si)
+	}
+	return info
+}
+
+// authorizePublish decides if a publisher can start streamPath and returns
+// the owner of the stream.  Without an on_publish webhook only the stream keys
+// are checked.  With one the webhook has the final say.
+func authorizePublish(event PublishEvent) (string, error) {
+	owner, keyErr := settings.CheckStreamKey(event.Key, event.Stream)
+
+	config := settings.GetWebhookConfig()
+	if config.OnPublish == "" {
+		return owner, keyErr
+	}
+
+	event.Action = webhookOnPublish
+	event.Owner = owner
+	if owner == "" {
+		owner = event.Stream
+	}
+
+	resp, err := postWebhook(config.OnPublish, config.Timeout, event)
+	if errors.Is(err, errPublishDenied) {
+		return "", err
+	}
+	if err != nil {
+		if config.FailOpen {
+			// Only the stream keys are left to go by
+			common.LogErrorf("Publish webhook failed, checking the stream key of %s only: %v\n", event.Stream, err)
+			if keyErr != nil {
+				return "", keyErr
+			}
+			return owner, nil
+		}
+		return "", fmt.Errorf("publish webhook failed: %w", err)
+	}
+
+	if resp.Owner != "" {
+		owner = resp.Owner
+	}
+	return owner, nil
+}
+
+// publishDone tells the on_publish_done webhook that a stream ended
+func publishDone(event PublishEvent, duration time.Duration) {
+	config := settings.GetWebhookConfig()
+	if config.OnPublishDone == "" {
+		return
+	}
+
+	event.Action = webhookOnPublishDone
+	event.Duration = duration.Seconds()
+	go func() {
+		_, err := postWebhook(config.OnPublishDone, config.Timeout, event)
+		if err != nil {
+			common.LogErrorf("Publish done webhook for %s failed: %v\n", event.Stream, err)
+		}
+	}()
+}
+
+// postWebhook sends the event to the URL.  A 2xx response allows the stream,
+// a 4xx response denies it and anything else is an error.
+func postWebhook(url string, timeout time.Duration, event PublishEvent) (PublishResponse, error) {
+	var resp PublishResponse
+
+	body, err := json.Marshal(event)
+	if err != nil {
+		return resp, fmt.Errorf("could not encode event: %w", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return resp, fmt.Errorf("could not create request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	r, err := webhookClient.Do(req)
+	if err != nil {
+		return resp, err
+	}
+	defer r.Body.Close()
+
+	switch {
+	case r.StatusCode >= 200 && r.StatusCode < 300:
+		// The body is optional
+		data, err := io.ReadAll(io.LimitReader(r.Body, 64*1024))
+		if err == nil && len(bytes.TrimSpace(data)) > 0 {
+			if err = json.Unmarshal(data, &resp); err != nil {
+				common.LogDebugf("Could not decode webhook response: %v\n", err)
+			}
+		}
+		return resp, nil
+	case r.StatusCode >= 400 && r.StatusCode < 500:
+		return resp, fmt.Errorf("%w: %s", errPublishDenied, r.Status)
+	default:
+		return resp, fmt.Errorf("unexpected status %s", r.Status)
+	}
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/nareix/joy4/av"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/zorchenhimer/MovieNight/common"
+)
+
+func TestAuthorizePublish_NoWebhook(t *testing.T) {
+	settings = &Settings{TitleLength: 50, StreamKey: "mainkey"}
+
+	owner, err := authorizePublish(PublishEvent{Stream: "live", Key: "mainkey"})
+	require.NoError(t, err)
+	assert.Equal(t, "host", owner)
+
+	_, err = authorizePublish(PublishEvent{Stream: "live", Key: "wrong"})
+	assert.Error(t, err)
+}
+
+func TestAuthorizePublish_Webhook(t *testing.T) {
+	common.SetupLogging(common.LLError, "/dev/null")
+
+	var got PublishEvent
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&got))
+		switch {
+		case got.Key == "broken" || got.Stream == "down":
+			w.WriteHeader(http.StatusInternalServerError)
+		case got.Key == "scheduled":
+			w.Write([]byte(`{"Owner": "Tuesday Host"}`))
+		default:
+			w.WriteHeader(http.StatusForbidden)
+		}
+	}))
+	defer server.Close()
+
+	settings = &Settings{TitleLength: 50, StreamKey: "mainkey", OnPublishURL: server.URL, WebhookTimeout: 1}
+
+	streams := testStreams(t, av.AAC)
+
+	owner, err := authorizePublish(PublishEvent{Stream: "live", Key: "scheduled", RemoteAddr: "10.0.0.1:1234", Streams: describeStreams(streams)})
+	require.NoError(t, err, "the webhook allows keys we don't know about")
+	assert.Equal(t, "Tuesday Host", owner)
+	assert.Equal(t, webhookOnPublish, got.Action)
+	assert.Equal(t, "10.0.0.1:1234", got.RemoteAddr)
+	require.Len(t, got.Streams, 1)
+	assert.Equal(t, "AAC", got.Streams[0].Type)
+	assert.Equal(t, 44100, got.Streams[0].SampleRate)
+
+	_, err = authorizePublish(PublishEvent{Stream: "live", Key: "mainkey"})
+	assert.ErrorIs(t, err, errPublishDenied, "the webhook has the final say")
+
+	// Fail closed
+	_, err = authorizePublish(PublishEvent{Stream: "live", Key: "broken"})
+	assert.Error(t, err)
+	assert.NotErrorIs(t, err, errPublishDenied)
+
+	// Fail open falls back to the stream keys, and an explicit deny still denies
+	settings.WebhookFailOpen = true
+	owner, err = authorizePublish(PublishEvent{Stream: "down", Key: "mainkey"})
+	require.NoError(t, err)
+	assert.Equal(t, "host", owner)
+	_, err = authorizePublish(PublishEvent{Stream: "down", Key: "wrong"})
+	assert.Error(t, err, "a wrong key is still denied while the webhook is down")
+	_, err = authorizePublish(PublishEvent{Stream: "movies", Key: "nope"})
+	assert.ErrorIs(t, err, errPublishDenied)
+}
+
+func TestPostWebhook_Timeout(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(200 * time.Millisecond)
+	}))
+	defer server.Close()
+
+	_, err := postWebhook(server.URL, 50*time.Millisecond, PublishEvent{Stream: "live"})
+	assert.Error(t, err)
+}